@@ -0,0 +1,367 @@
+package main
+
+// This file implements archiving the console output of the subprocess to log
+// files, which are rotated by size and by day, compressed, and deleted after
+// a while. Journald and Discord don't keep everything, the archive does.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"dgbridge/src/ext"
+	"dgbridge/src/lib"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Format of the date in the names of rotated files.
+const archiveDateFormat = "2006-01-02"
+
+// ArchiveConfig configures writing the output of the subprocess to log files.
+// Archiving is disabled unless Dir is set.
+type ArchiveConfig struct {
+	Dir      string       // Directory of the log files. Empty disables archiving.
+	Name     string       // Base name of the log files. Empty means the name of the process, or console.
+	MaxSize  ext.ByteSize // Rotate the log file once it grows larger than this
+	MaxFiles int          // Number of rotated files to keep, 0 to keep all
+	MaxAge   ext.Duration // Delete rotated files older than this, 0 to keep them regardless of age
+	Compress bool         // Compress rotated files with gzip
+	Buffer   int          // Number of lines kept while the file can't be written fast enough. Lines are dropped beyond that.
+}
+
+// DefaultArchiveConfig returns the archive settings used when none are configured.
+func DefaultArchiveConfig() ArchiveConfig {
+	return ArchiveConfig{
+		MaxSize:  10 << 20,
+		MaxFiles: 30,
+		Compress: true,
+		Buffer:   10000,
+	}
+}
+
+// ConsoleArchive writes the lines of the subprocess' output to a log file,
+// with their time and stream. Lines are queued, so that a slow disk never
+// holds up relaying the output.
+//
+// The current file is <Name>.log. When it is rotated, it is renamed to
+// <Name>-<date>.log, or <Name>-<date>.<n>.log if that exists, and compressed
+// to <Name>-<date>.log.gz in the background.
+type ConsoleArchive struct {
+	config     ArchiveConfig
+	subprocess *SubprocessContext
+	logger     *log.Logger
+	queue      chan archiveLine
+	dropped    atomic.Int64   // Number of lines dropped since the last write
+	file       *os.File       // Current file, nil if it couldn't be opened
+	writer     *bufio.Writer  // Buffers the writes to file
+	size       int64          // Size of the current file
+	day        string         // Day that the current file was started
+	rotated    *regexp.Regexp // Matches the names of the rotated files, and not those of another Name
+	compress   sync.Mutex     // Serializes compressing rotated files and enforcing the retention
+	background sync.WaitGroup // Tracks the compression goroutines
+	running    sync.WaitGroup // Tracks run, which waits for background before returning
+}
+
+// archiveLine is a line of output waiting to be written.
+type archiveLine struct {
+	time   time.Time
+	stream lib.Stream
+	text   string
+}
+
+// NewConsoleArchive creates a ConsoleArchive for the output of the specified
+// subprocess. Nothing is written until Start is called.
+//
+// Parameters:
+//
+//	name: name of the process, used as the base name of the files if the
+//	configuration doesn't set one.
+func NewConsoleArchive(subprocess *SubprocessContext, config ArchiveConfig, name string) *ConsoleArchive {
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.Name == "" {
+		config.Name = "console"
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = DefaultArchiveConfig().Buffer
+	}
+	return &ConsoleArchive{
+		config:     config,
+		subprocess: subprocess,
+		logger:     subprocess.logger,
+		queue:      make(chan archiveLine, config.Buffer),
+		rotated:    regexp.MustCompile(`^` + regexp.QuoteMeta(config.Name) + `-\d{4}-\d{2}-\d{2}(\.\d+)?\.log(\.gz)?$`),
+	}
+}
+
+// Start starts archiving the subprocess' output in goroutines, if a directory
+// is configured. It must be called before the subprocess is started.
+func (self *ConsoleArchive) Start() {
+	if self.config.Dir == "" {
+		return
+	}
+	if err := os.MkdirAll(self.config.Dir, 0o755); err != nil {
+		self.logger.Printf("[error] error creating archive directory: %v\n", err)
+		return
+	}
+	stdoutCh := self.subprocess.StdoutLineEvent.Listen()
+	stderrCh := self.subprocess.StderrLineEvent.Listen()
+	stdoutStream := self.subprocess.OutputStream()
+	go func() {
+		defer self.subprocess.StdoutLineEvent.Off(stdoutCh)
+		defer self.subprocess.StderrLineEvent.Off(stderrCh)
+		// Once the events are closed, run writes the rest and closes the file.
+		defer close(self.queue)
+		for {
+			select {
+			case line, ok := <-stdoutCh:
+				if !ok {
+					return
+				}
+				self.enqueue(archiveLine{time: time.Now(), stream: stdoutStream, text: line})
+			case line, ok := <-stderrCh:
+				if !ok {
+					return
+				}
+				self.enqueue(archiveLine{time: time.Now(), stream: lib.StreamStderr, text: line})
+			}
+		}
+	}()
+	self.running.Add(1)
+	go self.run()
+}
+
+// Wait waits until the archive is done once the subprocess' events are
+// closed: the queued lines are written, the file is closed, and the rotated
+// files are compressed. It returns right away if the archive wasn't started.
+func (self *ConsoleArchive) Wait() {
+	self.running.Wait()
+}
+
+// enqueue queues a line for writing, or drops it if the queue is full.
+func (self *ConsoleArchive) enqueue(line archiveLine) {
+	select {
+	case self.queue <- line:
+	default:
+		self.dropped.Add(1)
+	}
+}
+
+// run writes the queued lines until the queue is closed, then closes the
+// file and waits for the rotated files to be compressed. The file is flushed
+// whenever the queue is empty.
+func (self *ConsoleArchive) run() {
+	defer self.running.Done()
+	// A half-written compressed file must not be left behind.
+	defer self.background.Wait()
+	for line := range self.queue {
+		self.write(line)
+		if len(self.queue) == 0 {
+			self.flush()
+		}
+	}
+	if self.file != nil {
+		self.flush()
+		if err := self.file.Close(); err != nil {
+			self.logger.Printf("[error] error closing console archive: %v\n", err)
+		}
+		self.file = nil
+		self.writer = nil
+	}
+}
+
+// write writes a line to the current file, rotating it first if needed.
+func (self *ConsoleArchive) write(line archiveLine) {
+	if dropped := self.dropped.Swap(0); dropped > 0 {
+		self.logger.Printf("[warn] The console archive fell behind, %d lines were dropped\n", dropped)
+	}
+	text := fmt.Sprintf("%v [%v] %v\n",
+		line.time.Format("2006-01-02T15:04:05.000Z07:00"), line.stream, ext.StripTerminalSequences(line.text))
+	day := line.time.Format(archiveDateFormat)
+	if self.file != nil && (day != self.day || (self.size > 0 && self.size+int64(len(text)) > int64(self.config.MaxSize))) {
+		self.rotate()
+	}
+	if self.file == nil && !self.open(day) {
+		return
+	}
+	n, err := self.writer.WriteString(text)
+	self.size += int64(n)
+	if err != nil {
+		self.logger.Printf("[error] error writing console archive: %v\n", err)
+	}
+}
+
+// open opens the current file, appending to it. A file left over from an
+// earlier day is rotated first.
+//
+// Returns:
+//
+//	false if the file couldn't be opened.
+func (self *ConsoleArchive) open(day string) bool {
+	path := self.currentPath()
+	if info, err := os.Stat(path); err == nil {
+		if fileDay := info.ModTime().Format(archiveDateFormat); fileDay != day {
+			self.rotateFile(path, fileDay)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		self.logger.Printf("[error] error opening console archive: %v\n", err)
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		self.logger.Printf("[error] error opening console archive: %v\n", err)
+		return false
+	}
+	self.file = file
+	self.writer = bufio.NewWriter(file)
+	self.size = info.Size()
+	self.day = day
+	return true
+}
+
+// flush writes the buffered lines to the current file.
+func (self *ConsoleArchive) flush() {
+	if self.writer == nil {
+		return
+	}
+	if err := self.writer.Flush(); err != nil {
+		self.logger.Printf("[error] error writing console archive: %v\n", err)
+	}
+}
+
+// rotate closes the current file and rotates it.
+func (self *ConsoleArchive) rotate() {
+	self.flush()
+	if err := self.file.Close(); err != nil {
+		self.logger.Printf("[error] error closing console archive: %v\n", err)
+	}
+	self.file = nil
+	self.writer = nil
+	self.rotateFile(self.currentPath(), self.day)
+}
+
+// rotateFile renames a file that was started on a day, then compresses it and
+// enforces the retention in the background.
+func (self *ConsoleArchive) rotateFile(path string, day string) {
+	rotated := self.rotatedPath(day)
+	if err := os.Rename(path, rotated); err != nil {
+		self.logger.Printf("[error] error rotating console archive: %v\n", err)
+		return
+	}
+	self.background.Add(1)
+	go func() {
+		defer self.background.Done()
+		self.compress.Lock()
+		defer self.compress.Unlock()
+		if self.config.Compress {
+			if err := compressFile(rotated); err != nil {
+				self.logger.Printf("[error] error compressing console archive: %v\n", err)
+			}
+		}
+		self.enforceRetention(time.Now())
+	}()
+}
+
+func (self *ConsoleArchive) currentPath() string {
+	return filepath.Join(self.config.Dir, self.config.Name+".log")
+}
+
+// rotatedPath returns a name for a file started on a day that isn't used by
+// another rotated file yet.
+func (self *ConsoleArchive) rotatedPath(day string) string {
+	base := filepath.Join(self.config.Dir, self.config.Name+"-"+day)
+	path := base + ".log"
+	for n := 1; fileExists(path) || fileExists(path+".gz"); n++ {
+		path = fmt.Sprintf("%v.%d.log", base, n)
+	}
+	return path
+}
+
+// enforceRetention deletes the rotated files beyond MaxFiles, the oldest
+// first, and the ones older than MaxAge.
+func (self *ConsoleArchive) enforceRetention(now time.Time) {
+	entries, err := os.ReadDir(self.config.Dir)
+	if err != nil {
+		self.logger.Printf("[error] error listing console archive: %v\n", err)
+		return
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if !self.rotated.MatchString(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	// Newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for i, info := range files {
+		tooMany := self.config.MaxFiles > 0 && i >= self.config.MaxFiles
+		tooOld := self.config.MaxAge.Duration > 0 && now.Sub(info.ModTime()) > self.config.MaxAge.Duration
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(filepath.Join(self.config.Dir, info.Name())); err != nil {
+			self.logger.Printf("[error] error deleting old console archive: %v\n", err)
+		}
+	}
+}
+
+// compressFile compresses a file to <path>.gz with gzip, and deletes it.
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so that a partial file is never
+	// mistaken for a complete one.
+	temporary := path + ".gz.tmp"
+	target, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	writer.Name = filepath.Base(path)
+	writer.ModTime = info.ModTime()
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+	// Keep the time of the last line, for the retention.
+	_ = os.Chtimes(temporary, info.ModTime(), info.ModTime())
+	if err := os.Rename(temporary, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
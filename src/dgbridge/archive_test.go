@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"dgbridge/src/lib"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestArchive creates a ConsoleArchive that writes to a temporary directory.
+func newTestArchive(t *testing.T, config ArchiveConfig) *ConsoleArchive {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sh", "-c", "echo hello; echo oops >&2"}},
+	})
+	config.Dir = t.TempDir()
+	return NewConsoleArchive(&subprocess, config, "")
+}
+
+// archiveFiles returns the names of the files in the archive's directory.
+func archiveFiles(t *testing.T, archive *ConsoleArchive) []string {
+	archive.background.Wait()
+	entries, err := os.ReadDir(archive.config.Dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readGzip(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	contents, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return string(contents)
+}
+
+func TestArchiveRotateBySize(t *testing.T) {
+	archive := newTestArchive(t, ArchiveConfig{MaxSize: 100})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		// Each line is about 60 bytes long, so every line starts a new file.
+		archive.write(archiveLine{time: now, stream: lib.StreamStdout, text: "a line of output"})
+	}
+	archive.flush()
+	day := now.Format(archiveDateFormat)
+	assert.Equal(t, []string{"console-" + day + ".1.log", "console-" + day + ".log", "console.log"},
+		archiveFiles(t, archive))
+}
+
+func TestArchiveRotateByDay(t *testing.T) {
+	archive := newTestArchive(t, ArchiveConfig{MaxSize: 1 << 20, Compress: true})
+	day1 := time.Date(2023, 5, 1, 23, 59, 0, 0, time.Local)
+	day2 := day1.Add(2 * time.Minute)
+	archive.write(archiveLine{time: day1, stream: lib.StreamStdout, text: "\x1b[31mbefore\x1b[0m midnight"})
+	archive.write(archiveLine{time: day2, stream: lib.StreamStderr, text: "after midnight"})
+	archive.flush()
+
+	assert.Equal(t, []string{"console-2023-05-01.log.gz", "console.log"}, archiveFiles(t, archive))
+	assert.Equal(t, day1.Format("2006-01-02T15:04:05.000Z07:00")+" [stdout] before midnight\n",
+		readGzip(t, filepath.Join(archive.config.Dir, "console-2023-05-01.log.gz")))
+	contents, err := os.ReadFile(archive.currentPath())
+	assert.NoError(t, err)
+	assert.Equal(t, day2.Format("2006-01-02T15:04:05.000Z07:00")+" [stderr] after midnight\n", string(contents))
+}
+
+func TestArchiveRetention(t *testing.T) {
+	archive := newTestArchive(t, ArchiveConfig{MaxSize: 1 << 20, MaxFiles: 2})
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 5; i++ {
+		archive.write(archiveLine{time: start.AddDate(0, 0, i), stream: lib.StreamStdout, text: "line"})
+		archive.flush()
+		archive.background.Wait()
+		// The retention goes by modification time.
+		_ = os.Chtimes(archive.currentPath(), start.AddDate(0, 0, i), start.AddDate(0, 0, i))
+	}
+	assert.Equal(t, []string{"console-2023-05-03.log", "console-2023-05-04.log", "console.log"},
+		archiveFiles(t, archive))
+}
+
+func TestArchiveRetentionSharedDir(t *testing.T) {
+	archive := newTestArchive(t, ArchiveConfig{Name: "lobby", MaxSize: 1 << 20, MaxFiles: 1})
+	// Files of another process whose name starts with the same name
+	others := []string{"lobby-old-2023-05-01.log", "lobby-old-2023-05-02.log.gz", "lobby-old.log"}
+	for _, name := range others {
+		assert.NoError(t, os.WriteFile(filepath.Join(archive.config.Dir, name), nil, 0o644))
+	}
+	for _, name := range []string{"lobby-2023-05-01.log.gz", "lobby-2023-05-02.1.log.gz"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(archive.config.Dir, name), nil, 0o644))
+	}
+	_ = os.Chtimes(filepath.Join(archive.config.Dir, "lobby-2023-05-01.log.gz"), time.Unix(0, 0), time.Unix(0, 0))
+	archive.enforceRetention(time.Now())
+	assert.Equal(t, append([]string{"lobby-2023-05-02.1.log.gz"}, others...), archiveFiles(t, archive))
+}
+
+func TestArchiveSubprocess(t *testing.T) {
+	archive := newTestArchive(t, DefaultArchiveConfig())
+	archive.Start()
+	assert.NoError(t, archive.subprocess.Start())
+	<-archive.subprocess.Exited()
+
+	assert.Eventually(t, func() bool {
+		contents, _ := os.ReadFile(archive.currentPath())
+		return regexp.MustCompile(`(?m)^\S+ \[stdout\] hello$`).Match(contents) &&
+			regexp.MustCompile(`(?m)^\S+ \[stderr\] oops$`).Match(contents)
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestArchiveWait(t *testing.T) {
+	// Every line is larger than MaxSize, so the second one rotates the first.
+	archive := newTestArchive(t, ArchiveConfig{MaxSize: 10, Compress: true})
+	archive.Start()
+	// The exit is broadcast after the last lines.
+	exitCh := archive.subprocess.ExitEvent.Listen()
+	assert.NoError(t, archive.subprocess.Start())
+	<-exitCh
+	archive.subprocess.Close()
+
+	// Once the events are closed, Wait returns after the rotated file was
+	// compressed.
+	archive.Wait()
+	entries, err := os.ReadDir(archive.config.Dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	day := time.Now().Format(archiveDateFormat)
+	assert.Equal(t, []string{"console-" + day + ".log.gz", "console.log"}, names)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"dgbridge/src/ext"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CommandSpec describes how to start a subprocess.
+type CommandSpec struct {
+	Argv    []string          // Program and its arguments
+	Dir     string            // Working directory. Empty means dgbridge's working directory.
+	Env     map[string]string // Extra environment variables, applied after EnvFile
+	EnvFile string            // Path to a .env file with extra environment variables
+	Shell   bool              // Join Argv with spaces and run the result with /bin/sh -c
+}
+
+// ParseCommandLine creates a CommandSpec from a command string.
+// Unless shell is true, the string is split into arguments with POSIX shell quoting rules.
+func ParseCommandLine(command string, shell bool) (CommandSpec, error) {
+	if shell {
+		return CommandSpec{Argv: []string{command}, Shell: true}, nil
+	}
+	argv, err := ext.SplitShellWords(command)
+	if err != nil {
+		return CommandSpec{}, err
+	}
+	return CommandSpec{Argv: argv}, nil
+}
+
+// createCommand returns a command handle created from the specified command spec.
+// It doesn't run the command. The env file is read on every call, so that
+// changes apply when the subprocess is restarted.
+func createCommand(spec CommandSpec) (*exec.Cmd, error) {
+	if len(spec.Argv) == 0 {
+		return nil, fmt.Errorf("no command specified")
+	}
+	var cmd *exec.Cmd
+	if spec.Shell {
+		cmd = exec.Command("/bin/sh", "-c", strings.Join(spec.Argv, " "))
+	} else {
+		cmd = exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	}
+	cmd.Dir = spec.Dir
+
+	env := os.Environ()
+	if spec.EnvFile != "" {
+		fileEnv, err := loadEnvFile(spec.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading env file: %v", err)
+		}
+		env = append(env, fileEnv...)
+	}
+	for key, value := range spec.Env {
+		env = append(env, key+"="+value)
+	}
+	// When a variable is specified more than once, exec uses the last value.
+	cmd.Env = env
+	return cmd, nil
+}
+
+// loadEnvFile reads KEY=VALUE pairs from a .env file.
+//
+// Blank lines and lines starting with # are ignored, an optional "export "
+// prefix is removed, and values may be wrapped in single or double quotes.
+//
+// Returns:
+//
+//	the variables in "KEY=VALUE" form
+func loadEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var env []string
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("%v:%d: expected KEY=VALUE", path, lineNumber)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, scanner.Err()
+}
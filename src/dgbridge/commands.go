@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// botCommand is a command that Discord users can run by sending a message
+// that starts with the command prefix in a relay channel.
+//
+// Commands that act on a process take the name of the process as their
+// first argument. It can be left out in a channel that only one process
+// relays to.
+type botCommand struct {
+	usage       string // Arguments of the command, shown by the help command
+	description string // Shown by the help command
+	admin       bool   // Only admins may run the command
+	run         func(self *BotContext, s *discordgo.Session, m *discordgo.MessageCreate, args []string)
+}
+
+// botCommands returns all commands, by name.
+func botCommands() map[string]botCommand {
+	return map[string]botCommand{
+		"help": {
+			description: "Lists the available commands",
+			run:         (*BotContext).helpCommand,
+		},
+		"jobs": {
+			usage:       "[process]",
+			description: "Lists the scheduled jobs",
+			run:         (*BotContext).jobsCommand,
+		},
+		"pause": {
+			usage:       "[process] <job>",
+			description: "Pauses a scheduled job",
+			admin:       true,
+			run:         (*BotContext).pauseCommand,
+		},
+		"resume": {
+			usage:       "[process] <job>",
+			description: "Resumes a paused scheduled job",
+			admin:       true,
+			run:         (*BotContext).resumeCommand,
+		},
+		"processes": {
+			description: "Lists the supervised processes",
+			run:         (*BotContext).processesCommand,
+		},
+		"status": {
+			usage:       "[process]",
+			description: "Shows the memory and CPU used by the server",
+			run:         (*BotContext).statusCommand,
+		},
+		"send": {
+			usage:       "<process> <message>",
+			description: "Relays a message to a specific process of the channel",
+			run:         (*BotContext).sendCommand,
+		},
+		"stop": {
+			usage:       "[process]",
+			description: "Stops the server with the shutdown sequence",
+			admin:       true,
+			run:         (*BotContext).stopCommand,
+		},
+	}
+}
+
+// handleCommand runs the command in a message, if there is one.
+//
+// Returns:
+//
+//	true if the message was a command, false if it should be relayed.
+func (self *BotContext) handleCommand(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	if self.commandPrefix == "" || !strings.HasPrefix(m.Content, self.commandPrefix) {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(m.Content, self.commandPrefix))
+	if len(fields) == 0 {
+		return false
+	}
+	command, ok := botCommands()[fields[0]]
+	if !ok {
+		return false
+	}
+	if command.admin && !self.isAdmin(m) {
+		self.reply(s, m, ":no_entry: You are not allowed to run this command.")
+		return true
+	}
+	log.Printf("[info] %v ran command: %v\n", m.Author.Username, m.Content)
+	command.run(self, s, m, fields[1:])
+	return true
+}
+
+// isAdmin reports whether the author of a message is listed as an admin,
+// either by user ID or by one of their role IDs.
+func (self *BotContext) isAdmin(m *discordgo.MessageCreate) bool {
+	ids := []string{m.Author.ID}
+	if m.Member != nil {
+		ids = append(ids, m.Member.Roles...)
+	}
+	for _, admin := range self.admins {
+		for _, id := range ids {
+			if admin == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetProcess selects the process that a command acts on: the process
+// named by the first argument, or else the only process of the channel. Only
+// admins may select a process that doesn't relay the channel. If no process
+// can be selected, the user is told so.
+//
+// Returns:
+//
+//	the process and the remaining arguments, or nil if no process was selected.
+func (self *BotContext) targetProcess(
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (*Process, []string) {
+	process, args, problem := self.selectProcess(m, args)
+	if process == nil {
+		self.reply(s, m, problem)
+	}
+	return process, args
+}
+
+// selectProcess selects the process that a command acts on, like
+// targetProcess.
+//
+// Returns:
+//
+//	the process and the remaining arguments, or nil and what to tell the user.
+func (self *BotContext) selectProcess(m *discordgo.MessageCreate, args []string) (*Process, []string, string) {
+	channelProcesses := self.channelProcesses(m.ChannelID)
+	allowed := channelProcesses
+	if self.isAdmin(m) {
+		allowed = self.processes
+	}
+	if len(args) > 0 {
+		if process := findProcess(self.processes, args[0]); process != nil {
+			if findProcess(allowed, args[0]) == nil {
+				return nil, nil, fmt.Sprintf(":no_entry: Process `%v` doesn't relay this channel.", process.Name)
+			}
+			return process, args[1:], ""
+		}
+	}
+	if len(channelProcesses) == 1 {
+		return channelProcesses[0], args, ""
+	}
+	var names []string
+	for _, process := range allowed {
+		names = append(names, "`"+process.Name+"`")
+	}
+	return nil, nil, fmt.Sprintf(":warning: Please specify a process: %v.", strings.Join(names, ", "))
+}
+
+// argumentText returns the text of a command after its first n arguments,
+// with its spacing preserved.
+func (self *BotContext) argumentText(m *discordgo.MessageCreate, n int) string {
+	text := strings.TrimPrefix(m.Content, self.commandPrefix)
+	// Skip the command name, then the arguments.
+	for i := 0; i <= n; i++ {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		end := strings.IndexFunc(text, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		text = text[end:]
+	}
+	return strings.TrimLeftFunc(text, unicode.IsSpace)
+}
+
+// reply sends a message to the channel that a message was sent to.
+func (self *BotContext) reply(s *discordgo.Session, m *discordgo.MessageCreate, content string) {
+	_, err := s.ChannelMessageSend(m.ChannelID, content)
+	if err != nil {
+		log.Printf("error sending message to discord: %v", err)
+	}
+}
+
+func (self *BotContext) helpCommand(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
+	commands := botCommands()
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var help strings.Builder
+	help.WriteString("Available commands:\n")
+	for _, name := range names {
+		command := commands[name]
+		usage := strings.TrimSpace(self.commandPrefix + name + " " + command.usage)
+		_, _ = fmt.Fprintf(&help, "`%v`: %v", usage, command.description)
+		if command.admin {
+			help.WriteString(" (admin)")
+		}
+		help.WriteString("\n")
+	}
+	self.reply(s, m, help.String())
+}
+
+func (self *BotContext) processesCommand(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
+	var list strings.Builder
+	list.WriteString("Processes:\n")
+	for _, process := range self.processes {
+		name := process.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		status := "stopped"
+		if process.Subprocess.Running() {
+			status = "running"
+		}
+		_, _ = fmt.Fprintf(&list, "`%v` in <#%v>: %v\n", name, process.ChannelId, status)
+	}
+	self.reply(s, m, list.String())
+}
+
+func (self *BotContext) sendCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		self.reply(s, m, ":warning: Please specify a process and a message.")
+		return
+	}
+	process := findProcess(self.processes, args[0])
+	if process == nil {
+		self.reply(s, m, fmt.Sprintf(":warning: No process named `%v`.", args[0]))
+		return
+	}
+	// Only admins may reach a process from a channel it doesn't relay.
+	if process.ChannelId != m.ChannelID && !self.isAdmin(m) {
+		self.reply(s, m, fmt.Sprintf(":no_entry: Process `%v` doesn't relay this channel.", process.Name))
+		return
+	}
+	self.relayToProcess(process, m, self.argumentText(m, 1))
+}
+
+func (self *BotContext) stopCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	process, _ := self.targetProcess(s, m, args)
+	if process == nil {
+		return
+	}
+	if process.Tail != nil {
+		self.reply(s, m, ":warning: This server isn't run by dgbridge, it can't be stopped.")
+		return
+	}
+	go process.Supervisor.Shutdown(nil)
+}
+
+func (self *BotContext) statusCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	process, _ := self.targetProcess(s, m, args)
+	if process == nil {
+		return
+	}
+	if process.Tail != nil {
+		self.reply(s, m, ":warning: This server isn't run by dgbridge, its resources can't be shown.")
+		return
+	}
+	stats, err := process.Monitor.Stats()
+	if err != nil {
+		self.reply(s, m, fmt.Sprintf(":warning: Error reading the server's resources: %v.", err))
+		return
+	}
+	if !stats.Running {
+		self.reply(s, m, "The server is stopped.")
+		return
+	}
+	var status strings.Builder
+	_, _ = fmt.Fprintf(&status, "Up for %v\n", formatRemaining(stats.Uptime))
+	_, _ = fmt.Fprintf(&status, "Memory: %v", stats.Rss)
+	if stats.MemoryLimit > 0 {
+		_, _ = fmt.Fprintf(&status, " (%.1f%% of %v)", stats.MemoryPercent(), stats.MemoryLimit)
+	}
+	_, _ = fmt.Fprintf(&status, "\nCPU: %.1f%%\n", stats.Cpu)
+	_, _ = fmt.Fprintf(&status, "Processes: %d, threads: %d, open files: %d\n", stats.Processes, stats.Threads, stats.Fds)
+	self.reply(s, m, status.String())
+}
+
+func (self *BotContext) jobsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	process, _ := self.targetProcess(s, m, args)
+	if process == nil {
+		return
+	}
+	jobs := process.Scheduler.Jobs()
+	if len(jobs) == 0 {
+		self.reply(s, m, "No scheduled jobs.")
+		return
+	}
+	var list strings.Builder
+	list.WriteString("Scheduled jobs:\n")
+	for _, job := range jobs {
+		_, _ = fmt.Fprintf(&list, "`%v` (`%v`): ", job.Name, job.Cron)
+		switch {
+		case job.Paused:
+			list.WriteString("paused")
+		case job.NextRun.IsZero():
+			list.WriteString("never runs")
+		default:
+			_, _ = fmt.Fprintf(&list, "next run <t:%d:R>", job.NextRun.Unix())
+		}
+		list.WriteString("\n")
+	}
+	self.reply(s, m, list.String())
+}
+
+func (self *BotContext) pauseCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	self.setJobPaused(s, m, args, true)
+}
+
+func (self *BotContext) resumeCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	self.setJobPaused(s, m, args, false)
+}
+
+// setJobPaused pauses or resumes the job named in the arguments of a command.
+func (self *BotContext) setJobPaused(s *discordgo.Session, m *discordgo.MessageCreate, args []string, paused bool) {
+	process, args := self.targetProcess(s, m, args)
+	if process == nil {
+		return
+	}
+	if len(args) != 1 {
+		self.reply(s, m, ":warning: Please specify the name of a job.")
+		return
+	}
+	if err := process.Scheduler.SetPaused(args[0], paused); err != nil {
+		self.reply(s, m, fmt.Sprintf(":warning: %v.", err))
+		return
+	}
+	if paused {
+		self.reply(s, m, fmt.Sprintf(":pause_button: Job `%v` paused.", args[0]))
+	} else {
+		self.reply(s, m, fmt.Sprintf(":arrow_forward: Job `%v` resumed.", args[0]))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSelectProcess(t *testing.T) {
+	lobby := &Process{Name: "lobby", ChannelId: "1"}
+	survival := &Process{Name: "survival", ChannelId: "2"}
+	creative := &Process{Name: "creative", ChannelId: "2"}
+	bot := &BotContext{processes: []*Process{lobby, survival, creative}, admins: []string{"admin"}}
+	message := func(channelId string, authorId string) *discordgo.MessageCreate {
+		return &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: channelId,
+			Author:    &discordgo.User{ID: authorId},
+		}}
+	}
+	tests := []struct {
+		Name    string
+		Message *discordgo.MessageCreate
+		Args    []string
+		Expect  *Process
+		Rest    []string
+		Problem string
+	}{
+		{
+			Name:    "Only process of the channel",
+			Message: message("1", "user"),
+			Args:    []string{"save"},
+			Expect:  lobby,
+			Rest:    []string{"save"},
+		},
+		{
+			Name:    "Named process of the channel",
+			Message: message("2", "user"),
+			Args:    []string{"creative", "save"},
+			Expect:  creative,
+			Rest:    []string{"save"},
+		},
+		{
+			Name:    "Process of another channel",
+			Message: message("1", "user"),
+			Args:    []string{"survival"},
+			Problem: ":no_entry: Process `survival` doesn't relay this channel.",
+		},
+		{
+			Name:    "Process of another channel for an admin",
+			Message: message("1", "admin"),
+			Args:    []string{"survival"},
+			Expect:  survival,
+			Rest:    []string{},
+		},
+		{
+			Name:    "Several processes in the channel",
+			Message: message("2", "user"),
+			Problem: ":warning: Please specify a process: `survival`, `creative`.",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			process, rest, problem := bot.selectProcess(test.Message, test.Args)
+			assert.Equal(t, test.Expect, process)
+			assert.Equal(t, test.Rest, rest)
+			assert.Equal(t, test.Problem, problem)
+		})
+	}
+}
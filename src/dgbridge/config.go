@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Config is the root of a dgbridge configuration file.
+//
+// Settings given on the command line take precedence over the configuration file.
+type Config struct {
+	Token         string         `validate:"required"` // Discord authentication token
+	CommandPrefix string         // Prefix of bot commands, empty to disable commands
+	Admins        []string       // IDs of the Discord users and roles allowed to run admin commands
+	Control       ControlConfig  // Unix socket that `dgbridge attach` connects to
+	ProcessConfig `validate:"-"` // The subprocess, unless Processes is used
+	Processes     ProcessList    `validate:"-"` // Subprocesses supervised by one dgbridge instance
+}
+
+// ProcessConfig holds the settings of a supervised subprocess.
+type ProcessConfig struct {
+	Name      string            // Identifies the process in logs and Discord commands. Required in Processes.
+	ChannelId string            `validate:"required"` // Discord channel ID
+	RulesFile string            `validate:"required"` // Path to the file with translation rules
+	Command   CommandSpec       // How to start the subprocess
+	Tail      TailConfig        // Log file to follow instead of starting the subprocess
+	Input     InputConfig       // Where lines for the subprocess go instead of its stdin
+	Pty       PtyConfig         // Pseudo-terminal settings
+	Output    OutputConfig      // How the subprocess' output is read
+	Encoding  EncodingConfig    // Character encodings of the subprocess' input and output
+	Restart   RestartPolicy     // When to restart the subprocess
+	Shutdown  ShutdownConfig    // How to stop the subprocess
+	Crash     CrashReportConfig // Crash reports posted when the subprocess exits abnormally
+	Monitor   MonitorConfig     // Sampling the resources used by the subprocess, and alerts
+	Archive   ArchiveConfig     // Log files that the subprocess' output is archived to
+	Watchdog  WatchdogConfig    // Detecting a hung subprocess
+	Signals   SignalMap         // What to do when dgbridge receives a signal
+	Schedule  []ScheduledJob    `validate:"dive"` // Jobs run on a cron schedule
+}
+
+// DefaultConfig returns the configuration used for settings that are neither
+// in the configuration file nor on the command line.
+func DefaultConfig() Config {
+	return Config{
+		CommandPrefix: "!",
+		Control:       DefaultControlConfig(),
+		ProcessConfig: DefaultProcessConfig(),
+	}
+}
+
+// DefaultProcessConfig returns the settings of a subprocess that are neither
+// in the configuration file nor on the command line.
+func DefaultProcessConfig() ProcessConfig {
+	return ProcessConfig{
+		Tail:     DefaultTailConfig(),
+		Input:    DefaultInputConfig(),
+		Output:   DefaultOutputConfig(),
+		Encoding: DefaultEncodingConfig(),
+		Restart:  DefaultRestartPolicy(),
+		Shutdown: DefaultShutdownConfig(),
+		Crash:    DefaultCrashReportConfig(),
+		Monitor:  DefaultMonitorConfig(),
+		Archive:  DefaultArchiveConfig(),
+		Watchdog: DefaultWatchdogConfig(),
+		Signals:  DefaultSignalMap(),
+	}
+}
+
+// ProcessList is the list of subprocesses in a configuration file.
+type ProcessList []ProcessConfig
+
+// UnmarshalJSON loads each subprocess on top of DefaultProcessConfig.
+func (self *ProcessList) UnmarshalJSON(b []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	processes := make(ProcessList, 0, len(entries))
+	for _, entry := range entries {
+		process := DefaultProcessConfig()
+		if err := json.Unmarshal(entry, &process); err != nil {
+			return err
+		}
+		processes = append(processes, process)
+	}
+	*self = processes
+	return nil
+}
+
+// ProcessConfigs returns the subprocesses to supervise: the ones in
+// Processes, or the one configured at the top level if Processes is empty.
+func (self *Config) ProcessConfigs() []ProcessConfig {
+	if len(self.Processes) > 0 {
+		return self.Processes
+	}
+	return []ProcessConfig{self.ProcessConfig}
+}
+
+// LoadConfig loads a configuration file on top of DefaultConfig.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	fileContents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(fileContents, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks that all required settings are present.
+func (self *Config) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(self); err != nil {
+		return err
+	}
+	if len(self.Processes) == 0 {
+		return self.ProcessConfig.validate(validate)
+	}
+	if settings := self.topLevelProcessSettings(); len(settings) > 0 {
+		return fmt.Errorf("%v must be set in each of Processes when Processes is used", strings.Join(settings, ", "))
+	}
+	names := make(map[string]bool)
+	for _, process := range self.Processes {
+		if process.Name == "" {
+			return fmt.Errorf("every process in Processes needs a Name")
+		}
+		if strings.ContainsAny(process.Name, " \t\n") {
+			return fmt.Errorf("process name %q must not contain spaces", process.Name)
+		}
+		if names[process.Name] {
+			return fmt.Errorf("duplicate process name %q", process.Name)
+		}
+		names[process.Name] = true
+		if err := process.validate(validate); err != nil {
+			return fmt.Errorf("process %v: %v", process.Name, err)
+		}
+	}
+	return nil
+}
+
+// topLevelProcessSettings returns the names of the settings of a subprocess
+// that are set at the top level, which are ignored when Processes is used.
+func (self *Config) topLevelProcessSettings() []string {
+	config := reflect.ValueOf(self.ProcessConfig)
+	defaults := reflect.ValueOf(DefaultProcessConfig())
+	var settings []string
+	for i := 0; i < config.NumField(); i++ {
+		if !reflect.DeepEqual(config.Field(i).Interface(), defaults.Field(i).Interface()) {
+			settings = append(settings, config.Type().Field(i).Name)
+		}
+	}
+	return settings
+}
+
+// validate checks that all required settings of a subprocess are present.
+func (self *ProcessConfig) validate(validate *validator.Validate) error {
+	if err := validate.Struct(self); err != nil {
+		return err
+	}
+	if len(self.Command.Argv) == 0 && self.Tail.Path == "" {
+		return fmt.Errorf("no command or log file to follow specified")
+	}
+	if len(self.Command.Argv) > 0 && self.Tail.Path != "" {
+		return fmt.Errorf("a command and a log file to follow can't be used together")
+	}
+	if err := self.Input.Validate(); err != nil {
+		return err
+	}
+	if _, err := self.Signals.Resolve(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadConfigProcesses(t *testing.T) {
+	path := writeConfig(t, `{
+		"Token": "TOKEN",
+		"Processes": [
+			{"Name": "lobby", "ChannelId": "1", "RulesFile": "lobby.json", "Command": {"Argv": ["lobby"]}},
+			{"Name": "survival", "ChannelId": "2", "RulesFile": "survival.json", "Command": {"Argv": ["survival"]},
+			 "Restart": {"Mode": "always"}, "Signals": {"USR1": "ignore"}}
+		]
+	}`)
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+
+	processes := config.ProcessConfigs()
+	assert.Len(t, processes, 2)
+	// Settings that aren't in the file keep their defaults.
+	assert.Equal(t, DefaultRestartPolicy(), processes[0].Restart)
+	assert.Equal(t, RestartAlways, processes[1].Restart.Mode)
+	assert.Equal(t, DefaultRestartPolicy().Delay, processes[1].Restart.Delay)
+	assert.Equal(t, SignalIgnore, processes[1].Signals["SIGUSR1"].Kind)
+	assert.Equal(t, SignalForward, processes[0].Signals["SIGUSR1"].Kind)
+	assert.Equal(t, SignalShutdown, processes[1].Signals["SIGTERM"].Kind)
+}
+
+func TestValidateProcesses(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Config string
+		Error  string
+	}{
+		{
+			Name: "missing name",
+			Config: `{"Token": "TOKEN", "Processes": [
+				{"ChannelId": "1", "RulesFile": "r.json", "Command": {"Argv": ["a"]}}]}`,
+		},
+		{
+			Name: "duplicate name",
+			Config: `{"Token": "TOKEN", "Processes": [
+				{"Name": "a", "ChannelId": "1", "RulesFile": "r.json", "Command": {"Argv": ["a"]}},
+				{"Name": "a", "ChannelId": "2", "RulesFile": "r.json", "Command": {"Argv": ["b"]}}]}`,
+		},
+		{
+			Name: "missing channel",
+			Config: `{"Token": "TOKEN", "Processes": [
+				{"Name": "a", "RulesFile": "r.json", "Command": {"Argv": ["a"]}}]}`,
+		},
+		{
+			Name: "top-level command",
+			Config: `{"Token": "TOKEN", "Command": {"Argv": ["a"]}, "Processes": [
+				{"Name": "a", "ChannelId": "1", "RulesFile": "r.json", "Command": {"Argv": ["a"]}}]}`,
+			Error: "Command must be set in each of Processes when Processes is used",
+		},
+		{
+			Name: "top-level settings",
+			Config: `{"Token": "TOKEN", "Restart": {"Mode": "always"}, "Watchdog": {"OutputTimeout": "5m"},
+				"Schedule": [{"Name": "save", "Cron": "0 * * * *", "Stdin": ["save-all"]}], "Processes": [
+				{"Name": "a", "ChannelId": "1", "RulesFile": "r.json", "Command": {"Argv": ["a"]}}]}`,
+			Error: "Restart, Watchdog, Schedule must be set in each of Processes when Processes is used",
+		},
+	}
+	for _, test := range tests {
+		config, err := LoadConfig(writeConfig(t, test.Config))
+		assert.NoError(t, err, test.Name)
+		err = config.Validate()
+		if test.Error != "" {
+			assert.EqualError(t, err, test.Error, test.Name)
+		} else {
+			assert.Error(t, err, test.Name)
+		}
+	}
+}
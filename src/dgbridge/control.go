@@ -0,0 +1,260 @@
+package main
+
+// This file implements the control socket, a Unix socket that `dgbridge
+// attach` connects to when dgbridge runs without a terminal, e.g. under
+// systemd. Attached clients see the console output of the servers and can
+// type lines into their input, like with `screen -r`.
+
+import (
+	"bufio"
+	"dgbridge/src/ext"
+	"errors"
+	"fmt"
+	"github.com/alexflint/go-arg"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Number of output lines queued for a client that can't keep up. Lines are
+// dropped beyond that, so that a slow client never holds up the relay.
+const controlClientBuffer = 1000
+
+// ControlConfig configures the control socket.
+type ControlConfig struct {
+	Socket string       // Path of the Unix socket. Empty disables the control socket.
+	Mode   ext.FileMode // Permissions of the socket. Whoever may write to it may attach.
+}
+
+// DefaultControlConfig returns the control socket settings used when none are configured.
+func DefaultControlConfig() ControlConfig {
+	return ControlConfig{
+		Mode: ext.FileMode{FileMode: 0o600},
+	}
+}
+
+// ControlServer accepts clients on the control socket. Every client receives
+// the output of every process, and its lines are written to the input of a
+// process, addressed like the lines of dgbridge's own stdin.
+type ControlServer struct {
+	config    ControlConfig
+	processes []*Process
+	listener  net.Listener
+	mutex     sync.Mutex // Guards clients
+	clients   map[*controlClient]struct{}
+}
+
+// controlClient is a client attached to the control socket.
+type controlClient struct {
+	conn    net.Conn
+	output  chan string  // Lines waiting to be sent to the client
+	dropped atomic.Int64 // Number of lines dropped since the last one sent
+}
+
+// NewControlServer creates a ControlServer for the specified processes. The
+// socket is not created until Start is called.
+func NewControlServer(config ControlConfig, processes []*Process) *ControlServer {
+	return &ControlServer{
+		config:    config,
+		processes: processes,
+		clients:   make(map[*controlClient]struct{}),
+	}
+}
+
+// Start creates the socket, and starts goroutines that accept clients and
+// relay the output of the processes to them. This function is non-blocking.
+func (self *ControlServer) Start() error {
+	if err := removeStaleSocket(self.config.Socket); err != nil {
+		return err
+	}
+	// Nobody else may connect before the permissions are set.
+	oldMask := syscall.Umask(0o177)
+	listener, err := net.Listen("unix", self.config.Socket)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(self.config.Socket, self.config.Mode.FileMode); err != nil {
+		_ = listener.Close()
+		return err
+	}
+	self.listener = listener
+	log.Printf("[info] Listening for control clients on %v\n", self.config.Socket)
+
+	for _, process := range self.processes {
+		self.relayOutput(process, &process.Subprocess.StdoutLineEvent)
+		self.relayOutput(process, &process.Subprocess.StderrLineEvent)
+		if process.Responses != nil {
+			self.relayOutput(process, process.Responses)
+		}
+	}
+	go self.accept()
+	return nil
+}
+
+// Close stops accepting clients, disconnects the attached ones and removes
+// the socket.
+func (self *ControlServer) Close() {
+	_ = self.listener.Close()
+	self.mutex.Lock()
+	for client := range self.clients {
+		_ = client.conn.Close()
+	}
+	self.mutex.Unlock()
+}
+
+// removeStaleSocket removes a socket left behind by a dgbridge instance that
+// didn't exit cleanly.
+//
+// Returns:
+//
+//	an error if another instance is still listening on the socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// Listening reports why the path can't be used.
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("another dgbridge instance is listening on %v", path)
+	}
+	return os.Remove(path)
+}
+
+// accept serves the clients that connect to the socket until it is closed.
+func (self *ControlServer) accept() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("[error] error accepting control client:", err)
+			}
+			return
+		}
+		go self.serve(conn)
+	}
+}
+
+// serve relays the output to a client and writes its lines to the processes
+// until it disconnects.
+func (self *ControlServer) serve(conn net.Conn) {
+	client := &controlClient{conn: conn, output: make(chan string, controlClientBuffer)}
+	self.mutex.Lock()
+	self.clients[client] = struct{}{}
+	count := len(self.clients)
+	self.mutex.Unlock()
+	log.Printf("[info] Control client attached, %d attached\n", count)
+
+	go client.writeOutput()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		process, line := addressedProcess(self.processes, scanner.Text())
+		if process == nil {
+			client.send("[dgbridge] Several processes are running, start the line with @<name> to send it to one of them")
+			continue
+		}
+		process.Subprocess.WriteStdinLineEvent.Broadcast(line + "\n")
+	}
+
+	self.mutex.Lock()
+	delete(self.clients, client)
+	count = len(self.clients)
+	close(client.output)
+	self.mutex.Unlock()
+	_ = conn.Close()
+	log.Printf("[info] Control client detached, %d attached\n", count)
+}
+
+// relayOutput starts a goroutine that sends the lines of an output of a
+// process to the attached clients.
+func (self *ControlServer) relayOutput(process *Process, event *ext.EventChannel[string]) {
+	lineCh := event.Listen()
+	go func() {
+		defer event.Off(lineCh)
+		for line := range lineCh {
+			self.mutex.Lock()
+			for client := range self.clients {
+				client.send(process.prefix() + line)
+			}
+			self.mutex.Unlock()
+		}
+	}()
+}
+
+// send queues a line for the client, or drops it if the client can't keep up.
+func (self *controlClient) send(line string) {
+	select {
+	case self.output <- line:
+	default:
+		self.dropped.Add(1)
+	}
+}
+
+// writeOutput writes the queued lines to the client until its queue is closed.
+func (self *controlClient) writeOutput() {
+	writer := bufio.NewWriter(self.conn)
+	for line := range self.output {
+		if dropped := self.dropped.Swap(0); dropped > 0 {
+			_, _ = fmt.Fprintf(writer, "[dgbridge] %d lines were dropped because the client fell behind\n", dropped)
+		}
+		_, _ = writer.WriteString(line + "\n")
+		if len(self.output) > 0 {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			// The client is gone. Reading from it fails too, which detaches it.
+			_ = self.conn.Close()
+		}
+	}
+}
+
+// AttachArgs are the command line arguments of `dgbridge attach`.
+type AttachArgs struct {
+	Socket string `arg:"positional,required" help:"Path of the control socket of the dgbridge instance"`
+}
+
+// runAttach runs `dgbridge attach` with the specified arguments, then exits.
+func runAttach(argv []string) {
+	var args AttachArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dgbridge attach"}, &args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = parser.Parse(argv)
+	if errors.Is(err, arg.ErrHelp) {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if err != nil {
+		parser.Fail(err.Error())
+	}
+	conn, err := net.Dial("unix", args.Socket)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Attached to %v. Press Ctrl+D to detach.\n", args.Socket)
+	if err := attach(conn.(*net.UnixConn), os.Stdin, os.Stdout); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// attach copies input to a connection to the control socket and its output
+// to output, until input ends or dgbridge closes the connection.
+func attach(conn *net.UnixConn, input io.Reader, output io.Writer) error {
+	defer conn.Close()
+	go func() {
+		_, _ = io.Copy(conn, input)
+		// dgbridge closes the connection once it has read everything.
+		_ = conn.CloseWrite()
+	}()
+	_, err := io.Copy(output, conn)
+	return err
+}
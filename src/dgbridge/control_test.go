@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startControlServer starts a ControlServer for processes that aren't started.
+func startControlServer(t *testing.T, names ...string) (*ControlServer, []*Process) {
+	var processes []*Process
+	for _, name := range names {
+		subprocess := NewSubprocess(SubprocessParameters{})
+		processes = append(processes, &Process{Name: name, Subprocess: &subprocess})
+	}
+	config := DefaultControlConfig()
+	config.Socket = filepath.Join(t.TempDir(), "control.sock")
+	server := NewControlServer(config, processes)
+	assert.NoError(t, server.Start())
+	t.Cleanup(server.Close)
+	return server, processes
+}
+
+// dialControl connects a client and waits until the server has registered it.
+func dialControl(t *testing.T, server *ControlServer, clients int) net.Conn {
+	conn, err := net.Dial("unix", server.config.Socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.clients) == clients
+	}, time.Second, 10*time.Millisecond)
+	return conn
+}
+
+func TestControlServer(t *testing.T) {
+	server, processes := startControlServer(t, "")
+	info, err := os.Stat(server.config.Socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	first := bufio.NewReader(dialControl(t, server, 1))
+	second := dialControl(t, server, 2)
+	secondReader := bufio.NewReader(second)
+
+	// Every client receives the output.
+	processes[0].Subprocess.StdoutLineEvent.Broadcast("hello")
+	processes[0].Subprocess.StderrLineEvent.Broadcast("oops")
+	for _, reader := range []*bufio.Reader{first, secondReader} {
+		var lines []string
+		for i := 0; i < 2; i++ {
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			lines = append(lines, line)
+		}
+		// stdout and stderr aren't ordered with each other.
+		assert.ElementsMatch(t, []string{"hello\n", "oops\n"}, lines)
+	}
+
+	// Lines from a client go to the input.
+	stdinCh := processes[0].Subprocess.WriteStdinLineEvent.Listen()
+	defer processes[0].Subprocess.WriteStdinLineEvent.Off(stdinCh)
+	_, err = second.Write([]byte("say hi\n"))
+	assert.NoError(t, err)
+	select {
+	case line := <-stdinCh:
+		assert.Equal(t, "say hi\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("line wasn't written to the input")
+	}
+}
+
+func TestControlServerProcesses(t *testing.T) {
+	server, processes := startControlServer(t, "lobby", "survival")
+	conn := dialControl(t, server, 1)
+	reader := bufio.NewReader(conn)
+
+	processes[1].Subprocess.StdoutLineEvent.Broadcast("hello")
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "[survival] hello\n", line)
+
+	_, err = conn.Write([]byte("list\n"))
+	assert.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, "start the line with @<name>")
+
+	stdinCh := processes[0].Subprocess.WriteStdinLineEvent.Listen()
+	defer processes[0].Subprocess.WriteStdinLineEvent.Off(stdinCh)
+	_, err = conn.Write([]byte("@lobby list\n"))
+	assert.NoError(t, err)
+	select {
+	case line := <-stdinCh:
+		assert.Equal(t, "list\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("line wasn't written to the input")
+	}
+}
+
+func TestControlServerSocketInUse(t *testing.T) {
+	server, _ := startControlServer(t, "")
+	other := NewControlServer(server.config, nil)
+	assert.Error(t, other.Start())
+
+	// A socket left behind by an instance that is gone is replaced.
+	server.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	server.Close()
+	assert.FileExists(t, server.config.Socket)
+	assert.NoError(t, other.Start())
+	other.Close()
+}
+
+func TestAttach(t *testing.T) {
+	server, processes := startControlServer(t, "")
+	stdinCh := processes[0].Subprocess.WriteStdinLineEvent.Listen()
+	defer processes[0].Subprocess.WriteStdinLineEvent.Off(stdinCh)
+
+	conn, err := net.Dial("unix", server.config.Socket)
+	assert.NoError(t, err)
+	var output bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- attach(conn.(*net.UnixConn), strings.NewReader("list\n"), &output)
+	}()
+	select {
+	case line := <-stdinCh:
+		assert.Equal(t, "list\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("line wasn't written to the input")
+	}
+	// Detaches at the end of the input.
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("attach didn't return at the end of the input")
+	}
+}
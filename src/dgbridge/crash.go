@@ -0,0 +1,220 @@
+package main
+
+// This file implements crash reports: when the subprocess exits abnormally,
+// the last lines of its output are posted to Discord, so that nobody needs to
+// log in to the server to find out what happened.
+
+import (
+	"dgbridge/src/ext"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Largest crash report file that is attached to a crash report. Longer files
+// are truncated to fit in a Discord attachment.
+const maxCrashFileSize = 8 * 1024 * 1024
+
+// CrashReportConfig configures posting a crash report when the subprocess
+// exits abnormally.
+type CrashReportConfig struct {
+	Enabled     bool       // Post crash reports
+	ChannelId   string     // Channel that crash reports are posted to. Empty means the relay channel.
+	Lines       int        // Number of output lines attached to a crash report
+	FilePattern ext.Regexp // Output lines matching this name a crash report file with their first group, which is attached too
+	Dir         string     // Directory that attached crash report files must be in. Empty means the working directory.
+}
+
+// DefaultCrashReportConfig returns the crash report settings used when none are configured.
+func DefaultCrashReportConfig() CrashReportConfig {
+	return CrashReportConfig{
+		Lines: 100,
+	}
+}
+
+// CrashReport describes an abnormal exit of the subprocess.
+type CrashReport struct {
+	Status ExitStatus // How the subprocess exited
+	Log    string     // Last lines of the output
+	File   *CrashFile // Crash report file left by the subprocess, may be nil
+}
+
+// CrashFile is a crash report file written by the subprocess.
+type CrashFile struct {
+	Name     string // Base name of the file
+	Contents []byte // Contents of the file, truncated to maxCrashFileSize
+}
+
+// Summary returns a one-line description of the exit, e.g.
+// "was killed by signal SIGSEGV (core dumped) after 2h0m0s".
+func (self *CrashReport) Summary() string {
+	return fmt.Sprintf("%v after %v", self.Status, self.Status.Runtime.Round(time.Second))
+}
+
+// CrashReporter keeps the last lines of the output of a subprocess, and emits
+// a CrashReport when the subprocess exits abnormally, unless it was asked to
+// stop.
+type CrashReporter struct {
+	config     CrashReportConfig
+	dir        string // Directory that relative crash report file paths are resolved in
+	subprocess *SubprocessContext
+	lines      *ext.Ring[string] // Last lines of the current run's output
+	file       string            // Crash report file named by the current run's output
+	CrashEvent ext.EventChannel[CrashReport]
+}
+
+// NewCrashReporter creates a CrashReporter for the specified subprocess.
+// Nothing is recorded until Start is called.
+//
+// Parameters:
+//
+//	dir: working directory of the subprocess, which relative crash report
+//	file paths are resolved in.
+func NewCrashReporter(subprocess *SubprocessContext, config CrashReportConfig, dir string) *CrashReporter {
+	return &CrashReporter{
+		config:     config,
+		dir:        dir,
+		subprocess: subprocess,
+		lines:      ext.NewRing[string](config.Lines),
+	}
+}
+
+// Start starts recording the subprocess' output in a goroutine, if crash
+// reports are enabled. It must be called before the subprocess is started.
+// CrashEvent is closed once the subprocess' events are.
+func (self *CrashReporter) Start() {
+	if !self.config.Enabled {
+		self.CrashEvent.Close()
+		return
+	}
+	stdoutCh := self.subprocess.StdoutLineEvent.Listen()
+	stderrCh := self.subprocess.StderrLineEvent.Listen()
+	exitCh := self.subprocess.ExitEvent.Listen()
+	go func() {
+		defer self.CrashEvent.Close()
+		defer self.subprocess.StdoutLineEvent.Off(stdoutCh)
+		defer self.subprocess.StderrLineEvent.Off(stderrCh)
+		defer self.subprocess.ExitEvent.Off(exitCh)
+		// The subprocess broadcasts its last lines before its exit, so
+		// receiving both from one goroutine keeps them in order. The events
+		// are closed after the last exit.
+		for {
+			select {
+			case line, ok := <-stdoutCh:
+				if !ok {
+					return
+				}
+				self.record(line)
+			case line, ok := <-stderrCh:
+				if !ok {
+					return
+				}
+				self.record(line)
+			case status, ok := <-exitCh:
+				if !ok {
+					return
+				}
+				self.exited(status)
+			}
+		}
+	}()
+}
+
+// record adds a line of output to the log.
+func (self *CrashReporter) record(line string) {
+	line = ext.StripTerminalSequences(line)
+	self.lines.Push(line)
+	if self.config.FilePattern.Regexp == nil {
+		return
+	}
+	match := self.config.FilePattern.FindStringSubmatch(line)
+	if len(match) > 1 && match[1] != "" {
+		self.file = strings.TrimSpace(match[1])
+	}
+}
+
+// exited emits a CrashReport if the subprocess exited abnormally, and starts
+// a new log for the next run.
+func (self *CrashReporter) exited(status ExitStatus) {
+	defer func() {
+		self.lines.Clear()
+		self.file = ""
+	}()
+	if self.subprocess.StopRequested() || status.Success() {
+		return
+	}
+	report := CrashReport{
+		Status: status,
+		Log:    strings.Join(self.lines.Items(), "\n"),
+	}
+	if self.file != "" {
+		report.File = self.readFile(self.file)
+	}
+	self.subprocess.logger.Printf("[info] Subprocess crashed: %v\n", report.Summary())
+	self.CrashEvent.Broadcast(report)
+}
+
+// readFile reads the crash report file at path.
+//
+// Returns:
+//
+//	nil if the file can't be read, or isn't in the crash report directory.
+func (self *CrashReporter) readFile(path string) *CrashFile {
+	path, err := self.resolveFile(path)
+	if err != nil {
+		self.subprocess.logger.Printf("[warn] Not attaching crash report file: %v\n", err)
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		self.subprocess.logger.Printf("[error] error reading crash report file: %v\n", err)
+		return nil
+	}
+	defer file.Close()
+	contents, err := io.ReadAll(io.LimitReader(file, maxCrashFileSize))
+	if err != nil {
+		self.subprocess.logger.Printf("[error] error reading crash report file: %v\n", err)
+		return nil
+	}
+	return &CrashFile{Name: filepath.Base(path), Contents: contents}
+}
+
+// resolveFile resolves the path of a crash report file named by the output,
+// and checks that the file is in the crash report directory. Players can often
+// write to the output, e.g. in chat, so any other file could be a secret.
+//
+// Returns:
+//
+//	the absolute path of the file, with symbolic links resolved.
+func (self *CrashReporter) resolveFile(path string) (string, error) {
+	workDir, err := filepath.Abs(self.dir)
+	if err != nil {
+		return "", err
+	}
+	dir := self.config.Dir
+	if dir == "" {
+		dir = workDir
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(workDir, dir)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workDir, path)
+	}
+	// Resolving the links keeps a link in the directory from leading out of it.
+	path, err = filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside of %v", path, dir)
+	}
+	return path, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runCrashReporter runs a shell script as a subprocess and returns the crash
+// report emitted when it exits, or nil if none was emitted.
+func runCrashReporter(t *testing.T, script string, config CrashReportConfig, dir string) *CrashReport {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sh", "-c", script}, Dir: dir},
+	})
+	config.Enabled = true
+	reporter := NewCrashReporter(&subprocess, config, dir)
+	reportCh := reporter.CrashEvent.Listen()
+	defer reporter.CrashEvent.Off(reportCh)
+	reporter.Start()
+
+	assert.NoError(t, subprocess.Start())
+	select {
+	case report := <-reportCh:
+		return &report
+	case <-subprocess.Exited():
+	}
+	select {
+	case report := <-reportCh:
+		return &report
+	case <-time.After(500 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestCrashReport(t *testing.T) {
+	// The order of lines from stdout and stderr is only kept if they aren't
+	// written at the same time.
+	report := runCrashReporter(t, "echo line 1; sleep 0.2; echo oops >&2; sleep 0.2; for i in 2 3 4; do echo line $i; done; exit 3",
+		CrashReportConfig{Lines: 4}, "")
+	if assert.NotNil(t, report) {
+		assert.Equal(t, 3, report.Status.Code)
+		assert.Nil(t, report.Status.Signal)
+		assert.Equal(t, "oops\nline 2\nline 3\nline 4", report.Log)
+		assert.Nil(t, report.File)
+		assert.Regexp(t, "^exited with code 3 after ", report.Summary())
+	}
+}
+
+func TestCrashReportSignal(t *testing.T) {
+	report := runCrashReporter(t, "echo dying; kill -SEGV $$", CrashReportConfig{Lines: 10}, "")
+	if assert.NotNil(t, report) {
+		assert.Equal(t, syscall.SIGSEGV, report.Status.Signal)
+		assert.Equal(t, "dying", report.Log)
+		assert.Regexp(t, "^was killed by signal SIGSEGV", report.Summary())
+	}
+}
+
+func TestCrashReportFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "crash-reports"), 0o755))
+	script := "echo 'Time: now' > crash-reports/crash-1.txt; " +
+		"echo 'This crash report has been saved to: ./crash-reports/crash-1.txt'; exit 1"
+	report := runCrashReporter(t, script, CrashReportConfig{
+		Lines:       10,
+		FilePattern: ext.Regexp{Regexp: regexp.MustCompile(`crash report has been saved to: (.+)$`)},
+	}, dir)
+	if assert.NotNil(t, report) && assert.NotNil(t, report.File) {
+		assert.Equal(t, "crash-1.txt", report.File.Name)
+		assert.Equal(t, "Time: now\n", string(report.File.Contents))
+	}
+}
+
+func TestCrashReportFileOutside(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "id_rsa")
+	assert.NoError(t, os.WriteFile(secret, []byte("secret"), 0o600))
+	tests := []struct {
+		Name   string
+		Path   string
+		Config CrashReportConfig
+	}{
+		{Name: "Absolute path", Path: secret},
+		{Name: "Relative path", Path: "../" + filepath.Base(filepath.Dir(secret)) + "/id_rsa"},
+		{Name: "Link", Path: "link"},
+		{Name: "Outside of Dir", Path: "crash.txt", Config: CrashReportConfig{Dir: "crash-reports"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			// The server's directory is next to the secret's.
+			dir := filepath.Join(filepath.Dir(filepath.Dir(secret)), "server-"+filepath.Base(t.Name()))
+			assert.NoError(t, os.MkdirAll(filepath.Join(dir, "crash-reports"), 0o755))
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "crash.txt"), []byte("crash"), 0o600))
+			assert.NoError(t, os.Symlink(secret, filepath.Join(dir, "link")))
+			config := test.Config
+			config.Lines = 10
+			config.FilePattern = ext.Regexp{Regexp: regexp.MustCompile(`^saved to: (.+)$`)}
+			report := runCrashReporter(t, "echo 'saved to: "+test.Path+"'; exit 1", config, dir)
+			if assert.NotNil(t, report) {
+				assert.Nil(t, report.File)
+			}
+		})
+	}
+}
+
+func TestCrashReportNormalExit(t *testing.T) {
+	assert.Nil(t, runCrashReporter(t, "echo bye", CrashReportConfig{Lines: 10}, ""))
+}
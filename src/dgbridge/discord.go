@@ -1,27 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"dgbridge/src/ext"
 	"dgbridge/src/lib"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"log"
+	"strings"
 	"sync"
 )
 
 // BotParameters holds data to be passed to StartDiscordBot.
 type BotParameters struct {
-	Token          string             // Discord auth token
-	RelayChannelId string             // Saved in BotContext
-	Subprocess     *SubprocessContext // Saved in BotContext
-	Rules          lib.Rules          // Saved in BotContext
+	Token         string     // Discord auth token
+	Processes     []*Process // Saved in BotContext
+	CommandPrefix string     // Saved in BotContext
+	Admins        []string   // Saved in BotContext
 }
 
 type BotContext struct {
-	relayChannelId string             // ID of destination Discord channel
-	subprocess     *SubprocessContext // Subprocess context
-	rules          lib.Rules          // Message conversion rules
-	readyOnce      sync.Once          // Tracks if bot was initialized
+	processes     []*Process // Supervised subprocesses, each with its relay channel and rules
+	commandPrefix string     // Prefix of bot commands, empty to disable commands
+	admins        []string   // IDs of the users and roles allowed to run admin commands
+	readyOnce     sync.Once  // Tracks if bot was initialized
 }
 
 // StartDiscordBot starts the discord bot. This function is non-blocking.
@@ -36,10 +38,10 @@ func StartDiscordBot(params BotParameters) (func(), error) {
 		return nil, fmt.Errorf("error creating Discord session: %v", err)
 	}
 	context := BotContext{
-		relayChannelId: params.RelayChannelId,
-		subprocess:     params.Subprocess,
-		rules:          params.Rules,
-		readyOnce:      sync.Once{},
+		processes:     params.Processes,
+		commandPrefix: params.CommandPrefix,
+		admins:        params.Admins,
+		readyOnce:     sync.Once{},
 	}
 	dg.AddHandler(context.ready())
 	dg.AddHandler(context.messageCreate())
@@ -58,64 +60,277 @@ func StartDiscordBot(params BotParameters) (func(), error) {
 func (self *BotContext) ready() func(s *discordgo.Session, r *discordgo.Ready) {
 	return func(s *discordgo.Session, r *discordgo.Ready) {
 		self.readyOnce.Do(func() {
-			go self.startRelayJob(s, &self.subprocess.StdoutLineEvent)
-			go self.startRelayJob(s, &self.subprocess.StderrLineEvent)
+			for _, process := range self.processes {
+				process := process
+				subprocess := process.Subprocess
+				// dgbridge exits once the jobs posted the last notices and
+				// crash report.
+				process.goRelay(func() {
+					self.startRelayJob(s, process, &subprocess.StdoutLineEvent, subprocess.OutputStream())
+				})
+				process.goRelay(func() {
+					self.startRelayJob(s, process, &subprocess.StderrLineEvent, lib.StreamStderr)
+				})
+				process.goRelay(func() { self.startNoticeJob(s, process) })
+				process.goRelay(func() { self.startAnnounceJob(s, process) })
+				process.goRelay(func() { self.startCrashJob(s, process) })
+				process.goRelay(func() { self.startAlertJob(s, process, &process.Monitor.AlertEvent) })
+				process.goRelay(func() { self.startAlertJob(s, process, &process.Watchdog.AlertEvent) })
+				if process.Responses != nil && process.RelayResponses {
+					process.goRelay(func() { self.startResponseJob(s, process) })
+				}
+			}
 		})
 	}
 }
 
-// Relays the output of a subprocess to a discord channel.
+// Relays the output of a subprocess to its discord channel.
 // It continuously listens to the specified event for data to relay.
+// Multi-line messages are grouped into one event before the rules are applied,
+// if the subprocess' output is configured so.
 //
 // If an error occurs when sending a message to Discord, error is simply
-// logged to stdout.
+// logged to stdout. While Discord can't keep up, the lines are buffered, and
+// the ones beyond the buffer are dropped as configured in the output settings.
 //
 // Parameters:
 //
 //	s:
 //		A pointer to a discordgo session, used to send the message to discord
 //		channel.
+//	process:
+//		The process whose output is relayed
 //	event:
 //		Which subprocess event to listen to
-func (self *BotContext) startRelayJob(session *discordgo.Session, event *ext.EventChannel[string]) {
-	lineCh := event.Listen()
+//	stream:
+//		Which stream the event's lines come from, used to select the rules
+func (self *BotContext) startRelayJob(
+	session *discordgo.Session,
+	process *Process,
+	event *ext.EventChannel[string],
+	stream lib.Stream,
+) {
+	output := &process.Subprocess.output
+	rules := lib.FilterRules(process.Rules.SubprocessToDiscord, stream)
+	// Discord must never hold up the output, or the subprocess stalls once
+	// its pipe is full.
+	// The bot connects after the subprocess was started, so the lines written
+	// in the meantime are replayed.
+	lineCh := event.ListenWith(ext.ListenOptions[string]{
+		Buffer:   output.RelayBuffer,
+		Overflow: output.RelayOverflow,
+		Merge:    joinLines,
+		Replay:   true,
+	})
 	defer event.Off(lineCh)
-	for line := range lineCh {
-		line = lib.ApplyRules(self.rules.SubprocessToDiscord, nil, line)
-		if line == "" {
-			// No rules matched.
-			continue
+	var dropped uint64
+	output.Grouping.groupLines(lineCh, func(line string) {
+		if total := event.Dropped(lineCh); total > dropped {
+			if output.RelayOverflow == ext.OverflowCoalesce {
+				log.Printf("[warn] Discord fell behind, %d lines were merged\n", total-dropped)
+			} else {
+				log.Printf("[warn] Discord fell behind, %d lines were dropped\n", total-dropped)
+			}
+			dropped = total
 		}
-		_, err := session.ChannelMessageSend(self.relayChannelId, line)
+		// Nothing is sent if no rules matched.
+		for _, message := range output.applyRules(rules, process.Rules.Sets, line) {
+			channelId := message.Destination
+			if channelId == "" {
+				channelId = process.ChannelId
+			}
+			_, err := session.ChannelMessageSend(channelId, message.Text)
+			if err != nil {
+				log.Printf("error sending message to discord: %v", err)
+			}
+		}
+	})
+}
+
+// Relays the notices of a process' supervisor to its discord channel as-is,
+// without applying any rules. When several processes are supervised, notices
+// are prefixed with the name of the process.
+func (self *BotContext) startNoticeJob(session *discordgo.Session, process *Process) {
+	event := &process.Supervisor.NoticeEvent
+	noticeCh := event.Listen()
+	defer event.Off(noticeCh)
+	for notice := range noticeCh {
+		if len(self.processes) > 1 {
+			notice = fmt.Sprintf("**%v** %v", process.Name, notice)
+		}
+		_, err := session.ChannelMessageSend(process.ChannelId, notice)
+		if err != nil {
+			log.Printf("error sending notice to discord: %v", err)
+		}
+	}
+}
+
+// Posts the announcements of a process' scheduled jobs to their channel, or to
+// the process' relay channel if they don't specify one.
+func (self *BotContext) startAnnounceJob(session *discordgo.Session, process *Process) {
+	event := &process.Scheduler.AnnounceEvent
+	announceCh := event.Listen()
+	defer event.Off(announceCh)
+	for announcement := range announceCh {
+		channelId := announcement.ChannelId
+		if channelId == "" {
+			channelId = process.ChannelId
+		}
+		_, err := session.ChannelMessageSend(channelId, announcement.Content)
+		if err != nil {
+			log.Printf("error sending announcement to discord: %v", err)
+		}
+	}
+}
+
+// Posts the crash reports of a process to its crash channel, with the last
+// lines of its output and its crash report file attached.
+func (self *BotContext) startCrashJob(session *discordgo.Session, process *Process) {
+	event := &process.Crashes.CrashEvent
+	reportCh := event.Listen()
+	defer event.Off(reportCh)
+	for report := range reportCh {
+		content := fmt.Sprintf(":boom: Server crashed: %v.", report.Summary())
+		if len(self.processes) > 1 {
+			content = fmt.Sprintf("**%v** %v", process.Name, content)
+		}
+		message := &discordgo.MessageSend{Content: content}
+		if report.Log != "" {
+			message.Files = append(message.Files, &discordgo.File{
+				Name:        "output.txt",
+				ContentType: "text/plain",
+				Reader:      strings.NewReader(report.Log),
+			})
+		}
+		if report.File != nil {
+			message.Files = append(message.Files, &discordgo.File{
+				Name:        report.File.Name,
+				ContentType: "text/plain",
+				Reader:      bytes.NewReader(report.File.Contents),
+			})
+		}
+		_, err := session.ChannelMessageSendComplex(process.CrashChannelId, message)
+		if err != nil {
+			log.Printf("error sending crash report to discord: %v", err)
+		}
+	}
+}
+
+// Posts the alerts of a process' resource monitoring or watchdog to their
+// channel, or to the process' relay channel if they don't specify one. When
+// several processes are supervised, alerts are prefixed with the name of the
+// process.
+func (self *BotContext) startAlertJob(
+	session *discordgo.Session,
+	process *Process,
+	event *ext.EventChannel[Announcement],
+) {
+	alertCh := event.Listen()
+	defer event.Off(alertCh)
+	for alert := range alertCh {
+		channelId := alert.ChannelId
+		if channelId == "" {
+			channelId = process.ChannelId
+		}
+		content := alert.Content
+		if len(self.processes) > 1 {
+			content = fmt.Sprintf("**%v** %v", process.Name, content)
+		}
+		_, err := session.ChannelMessageSend(channelId, content)
+		if err != nil {
+			log.Printf("error sending alert to discord: %v", err)
+		}
+	}
+}
+
+// Posts the responses to a process' RCON commands to its discord channel, in
+// a code block.
+func (self *BotContext) startResponseJob(session *discordgo.Session, process *Process) {
+	event := process.Responses
+	responseCh := event.Listen()
+	defer event.Off(responseCh)
+	for response := range responseCh {
+		_, err := session.ChannelMessageSend(process.ChannelId, codeBlock("", response))
 		if err != nil {
-			log.Printf("error sending message to discord: %v", err)
+			log.Printf("error sending response to discord: %v", err)
 		}
 	}
 }
 
+// codeBlock formats text as a code block that fits in a Discord message,
+// truncating it if needed.
+//
+// Parameters:
+//
+//	language: language used to highlight the text, e.g. ansi, may be empty
+func codeBlock(language string, text string) string {
+	maxLength := 2000 - len("```"+language+"\n\n```")
+	// A zero-width space keeps the text from ending the code block.
+	text = strings.ReplaceAll(text, "```", "`\u200b``")
+	if len(text) > maxLength {
+		text = strings.ToValidUTF8(text[:maxLength-len("...")], "")
+		// Don't leave half an escape sequence.
+		if i := strings.LastIndexByte(text, '\x1b'); i >= 0 && !strings.ContainsRune(text[i:], 'm') {
+			text = text[:i]
+		}
+		text += "..."
+	}
+	return "```" + language + "\n" + text + "\n```"
+}
+
 // Listens for Discord message creation events and relays the
-// contents of those messages to the subprocess.
+// contents of those messages to the subprocesses of the channel.
 func (self *BotContext) messageCreate() func(s *discordgo.Session, m *discordgo.MessageCreate) {
 	return func(s *discordgo.Session, m *discordgo.MessageCreate) {
 		if m.Author.ID == s.State.User.ID {
 			// Is bot's own message
 			return
 		}
-		if !(m.ChannelID == self.relayChannelId) {
-			// Is not relay channel
+		processes := self.channelProcesses(m.ChannelID)
+		if len(processes) == 0 {
+			// Is not a relay channel
 			return
 		}
-		msg := m.Content
-		msg = lib.ApplyRules(self.rules.DiscordToSubprocess, &lib.Props{
-			Author: lib.Author{
-				Username:      m.Author.Username,
-				Discriminator: m.Author.Discriminator,
-				AccentColor:   m.Author.AccentColor,
-			}}, msg)
-		if msg == "" {
-			// No rules matched.
+		if self.handleCommand(s, m) {
 			return
 		}
-		self.subprocess.WriteStdinLineEvent.Broadcast(msg + "\n")
+		for _, process := range processes {
+			self.relayToProcess(process, m, m.Content)
+		}
+	}
+}
+
+// relayToProcess applies a process' rules to a message and writes the results
+// to the process' stdin, or to the stdin of the process named by the
+// destination of a result.
+func (self *BotContext) relayToProcess(process *Process, m *discordgo.MessageCreate, msg string) {
+	outputs := lib.ApplyRules(process.Rules.DiscordToSubprocess, process.Rules.Sets, &lib.Props{
+		Author: lib.Author{
+			Username:      m.Author.Username,
+			Discriminator: m.Author.Discriminator,
+			AccentColor:   m.Author.AccentColor,
+		}}, msg)
+	// Nothing is written if no rules matched.
+	for _, output := range outputs {
+		target := process
+		if output.Destination != "" {
+			target = findProcess(self.processes, output.Destination)
+			if target == nil {
+				log.Printf("[warn] Rule output for unknown process %q dropped\n", output.Destination)
+				continue
+			}
+		}
+		target.Subprocess.WriteStdinLineEvent.Broadcast(output.Text + "\n")
+	}
+}
+
+// channelProcesses returns the processes that relay to a channel.
+func (self *BotContext) channelProcesses(channelId string) []*Process {
+	var processes []*Process
+	for _, process := range self.processes {
+		if process.ChannelId == channelId {
+			processes = append(processes, process)
+		}
 	}
+	return processes
 }
@@ -0,0 +1,24 @@
+package main
+
+import "dgbridge/src/ext"
+
+// EncodingConfig configures the character encodings of a server that doesn't
+// use UTF-8. Its output is converted to UTF-8 before the rules are applied,
+// and the lines written to it are converted from UTF-8.
+type EncodingConfig struct {
+	Input       ext.Encoding // Encoding of the lines written to the subprocess, e.g. windows-1252
+	Output      ext.Encoding // Encoding of the subprocess' output and log file
+	Replacement string       // Written instead of the characters that the input encoding can't represent
+}
+
+// DefaultEncodingConfig returns the encoding settings used when none are configured.
+func DefaultEncodingConfig() EncodingConfig {
+	return EncodingConfig{
+		Replacement: "?",
+	}
+}
+
+// encodeInput converts a line written to the subprocess to its input encoding.
+func (self *EncodingConfig) encodeInput(line string) string {
+	return self.Input.Encode(line, self.Replacement)
+}
@@ -0,0 +1,67 @@
+package main
+
+// This file describes how a subprocess exited, for the restart policy, crash
+// reports and dgbridge's own exit code.
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ExitStatus describes how a subprocess exited.
+type ExitStatus struct {
+	Code       int           // Exit code, -1 if the subprocess was killed by a signal or waiting for it failed
+	Signal     os.Signal     // Signal that killed the subprocess, nil if it exited
+	CoreDumped bool          // The subprocess dumped core
+	Runtime    time.Duration // How long the subprocess ran
+	Err        error         // Error waiting for the subprocess, nil if it was waited for
+}
+
+// newExitStatus creates the ExitStatus of a subprocess from the result of
+// waiting for it.
+func newExitStatus(state *os.ProcessState, err error, runtime time.Duration) ExitStatus {
+	status := ExitStatus{Code: -1, Runtime: runtime, Err: err}
+	if state == nil {
+		return status
+	}
+	status.Code = state.ExitCode()
+	if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+		status.Signal = waitStatus.Signal()
+		status.CoreDumped = waitStatus.CoreDump()
+	}
+	return status
+}
+
+// Success reports whether the subprocess exited with code 0.
+func (self ExitStatus) Success() bool {
+	return self.Code == 0 && self.Signal == nil && self.Err == nil
+}
+
+// ShellCode returns the exit code that a shell reports for the subprocess:
+// its exit code, or 128 plus the number of the signal that killed it.
+func (self ExitStatus) ShellCode() int {
+	if sig, ok := self.Signal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	if self.Code < 0 {
+		return 1
+	}
+	return self.Code
+}
+
+// String describes how the subprocess exited, e.g. "exited with code 1" or
+// "was killed by signal SIGSEGV (core dumped)".
+func (self ExitStatus) String() string {
+	switch {
+	case self.Err != nil:
+		return fmt.Sprintf("could not be waited for (%v)", self.Err)
+	case self.Signal != nil && self.CoreDumped:
+		return fmt.Sprintf("was killed by signal %v (core dumped)", signalName(self.Signal))
+	case self.Signal != nil:
+		return fmt.Sprintf("was killed by signal %v", signalName(self.Signal))
+	default:
+		return fmt.Sprintf("exited with code %d", self.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    ExitStatus
+		success   bool
+		shellCode int
+		str       string
+	}{
+		{"success", ExitStatus{Code: 0}, true, 0, "exited with code 0"},
+		{"failure", ExitStatus{Code: 3}, false, 3, "exited with code 3"},
+		{"signal", ExitStatus{Code: -1, Signal: syscall.SIGKILL}, false, 137, "was killed by signal SIGKILL"},
+		{"core dump", ExitStatus{Code: -1, Signal: syscall.SIGSEGV, CoreDumped: true}, false, 139, "was killed by signal SIGSEGV (core dumped)"},
+		{"wait error", ExitStatus{Code: -1, Err: errors.New("no child processes")}, false, 1, "could not be waited for (no child processes)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.success, tt.status.Success())
+			assert.Equal(t, tt.shellCode, tt.status.ShellCode())
+			assert.Equal(t, tt.str, tt.status.String())
+		})
+	}
+}
+
+func TestNewExitStatus(t *testing.T) {
+	t.Run("exit code", func(t *testing.T) {
+		cmd := exec.Command("sh", "-c", "exit 5")
+		err := cmd.Run()
+		status := newExitStatus(cmd.ProcessState, nil, time.Second)
+		assert.Error(t, err)
+		assert.Equal(t, 5, status.Code)
+		assert.Nil(t, status.Signal)
+		assert.Equal(t, time.Second, status.Runtime)
+		assert.Equal(t, 5, status.ShellCode())
+	})
+	t.Run("signal", func(t *testing.T) {
+		cmd := exec.Command("sh", "-c", "kill -TERM $$")
+		_ = cmd.Run()
+		status := newExitStatus(cmd.ProcessState, nil, 0)
+		assert.Equal(t, syscall.SIGTERM, status.Signal)
+		assert.Equal(t, 143, status.ShellCode())
+		assert.Equal(t, "was killed by signal SIGTERM", status.String())
+	})
+	t.Run("wait error", func(t *testing.T) {
+		status := newExitStatus(nil, errors.New("wait failed"), 0)
+		assert.Equal(t, -1, status.Code)
+		assert.False(t, status.Success())
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+// This file implements joining the lines of multi-line messages, e.g. Java
+// stack traces, into one event before the rules are applied to them.
+
+import (
+	"dgbridge/src/ext"
+	"strings"
+	"time"
+)
+
+// GroupingConfig configures joining continuation lines with the line they
+// continue, so that rules can match a whole stack trace or multi-line message.
+// Grouping is disabled unless Start or Continuation is set.
+type GroupingConfig struct {
+	Start        ext.Regexp   // Lines matching this start a new event. If set, other lines continue the current event.
+	Continuation ext.Regexp   // Lines matching this continue the current event, e.g. ^\s+at
+	Timeout      ext.Duration // Emit an event once no line was added to it for this long
+	MaxLines     int          // Emit an event once it has this many lines
+}
+
+// DefaultGroupingConfig returns the grouping settings used when none are configured.
+func DefaultGroupingConfig() GroupingConfig {
+	return GroupingConfig{
+		Timeout:  ext.Duration{Duration: 500 * time.Millisecond},
+		MaxLines: 100,
+	}
+}
+
+// Enabled reports whether lines are grouped.
+func (self *GroupingConfig) Enabled() bool {
+	return self.Start.Regexp != nil || self.Continuation.Regexp != nil
+}
+
+// continues reports whether a line continues the current event.
+func (self *GroupingConfig) continues(line string) bool {
+	// Colors could get in the way of the patterns.
+	line = ext.StripTerminalSequences(line)
+	if self.Continuation.Regexp != nil && self.Continuation.MatchString(line) {
+		return true
+	}
+	return self.Start.Regexp != nil && !self.Start.MatchString(line)
+}
+
+// groupLines reads lines until lines is closed, and calls emit for each group
+// of lines, joined with newlines. Without grouping, emit is called for each
+// line.
+func (self *GroupingConfig) groupLines(lines <-chan string, emit func(event string)) {
+	if !self.Enabled() {
+		for line := range lines {
+			emit(line)
+		}
+		return
+	}
+	timeout := self.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultGroupingConfig().Timeout.Duration
+	}
+	maxLines := self.MaxLines
+	if maxLines <= 0 {
+		maxLines = DefaultGroupingConfig().MaxLines
+	}
+
+	var event []string
+	flush := func() {
+		if len(event) > 0 {
+			emit(strings.Join(event, "\n"))
+			event = nil
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if len(event) > 0 && !self.continues(line) {
+				flush()
+			}
+			event = append(event, line)
+			if len(event) >= maxLines {
+				flush()
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			flush()
+		}
+	}
+}
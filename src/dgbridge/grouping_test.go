@@ -0,0 +1,122 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestGroupLines(t *testing.T) {
+	pattern := func(expr string) ext.Regexp {
+		return ext.Regexp{Regexp: regexp.MustCompile(expr)}
+	}
+	stackTrace := []string{
+		"[12:00:00] [Server thread/ERROR]: Encountered an unexpected exception",
+		"java.lang.NullPointerException: oops",
+		"\tat net.minecraft.server.Main.tick(Main.java:42)",
+		"\tat net.minecraft.server.Main.run(Main.java:7)",
+		"[12:00:01] [Server thread/INFO]: Steve joined the game",
+	}
+	tests := []struct {
+		Name   string
+		Config GroupingConfig
+		Lines  []string
+		Expect []string
+	}{
+		{
+			Name:   "Disabled",
+			Config: DefaultGroupingConfig(),
+			Lines:  []string{"one", "  two"},
+			Expect: []string{"one", "  two"},
+		},
+		{
+			Name: "Start pattern",
+			Config: GroupingConfig{
+				Start:   pattern(`^\[\d\d:\d\d:\d\d\]`),
+				Timeout: ext.Duration{Duration: time.Second},
+			},
+			Lines: stackTrace,
+			Expect: []string{
+				"[12:00:00] [Server thread/ERROR]: Encountered an unexpected exception\n" +
+					"java.lang.NullPointerException: oops\n" +
+					"\tat net.minecraft.server.Main.tick(Main.java:42)\n" +
+					"\tat net.minecraft.server.Main.run(Main.java:7)",
+				"[12:00:01] [Server thread/INFO]: Steve joined the game",
+			},
+		},
+		{
+			Name: "Continuation pattern",
+			Config: GroupingConfig{
+				Continuation: pattern(`^\s+at `),
+				Timeout:      ext.Duration{Duration: time.Second},
+			},
+			Lines: stackTrace,
+			Expect: []string{
+				"[12:00:00] [Server thread/ERROR]: Encountered an unexpected exception",
+				"java.lang.NullPointerException: oops\n" +
+					"\tat net.minecraft.server.Main.tick(Main.java:42)\n" +
+					"\tat net.minecraft.server.Main.run(Main.java:7)",
+				"[12:00:01] [Server thread/INFO]: Steve joined the game",
+			},
+		},
+		{
+			Name: "Colored lines",
+			Config: GroupingConfig{
+				Start:   pattern(`^\[`),
+				Timeout: ext.Duration{Duration: time.Second},
+			},
+			Lines:  []string{"\x1b[31m[ERROR] Failed", "\x1b[31mreason\x1b[0m", "[INFO] Done"},
+			Expect: []string{"\x1b[31m[ERROR] Failed\n\x1b[31mreason\x1b[0m", "[INFO] Done"},
+		},
+		{
+			Name: "Maximum number of lines",
+			Config: GroupingConfig{
+				Continuation: pattern(`^\s`),
+				Timeout:      ext.Duration{Duration: time.Second},
+				MaxLines:     2,
+			},
+			Lines:  []string{"one", " two", " three", "four"},
+			Expect: []string{"one\n two", " three", "four"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			lines := make(chan string)
+			go func() {
+				for _, line := range test.Lines {
+					lines <- line
+				}
+				close(lines)
+			}()
+			var events []string
+			test.Config.groupLines(lines, func(event string) {
+				events = append(events, event)
+			})
+			assert.Equal(t, test.Expect, events)
+		})
+	}
+}
+
+func TestGroupLinesTimeout(t *testing.T) {
+	config := GroupingConfig{
+		Continuation: ext.Regexp{Regexp: regexp.MustCompile(`^\s`)},
+		Timeout:      ext.Duration{Duration: 20 * time.Millisecond},
+	}
+	lines := make(chan string)
+	events := make(chan string, 4)
+	go config.groupLines(lines, func(event string) {
+		events <- event
+	})
+	defer close(lines)
+
+	lines <- "Exception"
+	lines <- "  at Main"
+	select {
+	case event := <-events:
+		assert.Equal(t, "Exception\n  at Main", event)
+	case <-time.After(time.Second):
+		t.Fatal("the event wasn't emitted after the timeout")
+	}
+}
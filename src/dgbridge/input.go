@@ -0,0 +1,184 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"dgbridge/src/rcon"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// InputConfig configures where the lines for a server are delivered when
+// they can't be written to its stdin, e.g. because dgbridge follows its log
+// file instead of running it.
+type InputConfig struct {
+	Fifo string     // Named pipe that lines are written to
+	Rcon RconConfig // RCON server that lines are sent to as commands
+}
+
+// RconConfig configures sending lines to a server as RCON commands.
+type RconConfig struct {
+	Address        string       // host:port of the RCON server. Empty to disable RCON.
+	Password       string       // RCON password
+	Timeout        ext.Duration // How long connecting and each command may take
+	RelayResponses bool         // Post the responses to commands to the relay channel
+}
+
+// DefaultInputConfig returns the input settings used when none are configured.
+func DefaultInputConfig() InputConfig {
+	return InputConfig{
+		Rcon: RconConfig{
+			Timeout: ext.Duration{Duration: 5 * time.Second},
+		},
+	}
+}
+
+// Validate checks that at most one input is configured.
+func (self *InputConfig) Validate() error {
+	if self.Fifo != "" && self.Rcon.Address != "" {
+		return fmt.Errorf("only one of Fifo and Rcon can be used")
+	}
+	return nil
+}
+
+// InputWriter delivers lines to a server instead of its stdin.
+type InputWriter interface {
+	// WriteLine delivers a line, without its trailing newline.
+	WriteLine(line string) error
+	// Close releases the writer once no more lines will be written, and
+	// closes its events.
+	Close() error
+}
+
+// NewInputWriter creates the InputWriter described by config.
+//
+// Returns:
+//
+//	nil if config doesn't describe any writer.
+func NewInputWriter(config InputConfig) InputWriter {
+	if config.Fifo != "" {
+		return NewFifoWriter(config.Fifo)
+	}
+	if config.Rcon.Address != "" {
+		return NewRconWriter(config.Rcon)
+	}
+	return nil
+}
+
+// FifoWriter writes lines to a named pipe, which the server reads commands from.
+type FifoWriter struct {
+	path  string
+	mutex sync.Mutex // Guards file
+	file  *os.File   // Open pipe, nil until a line is written or after an error
+}
+
+// NewFifoWriter creates a FifoWriter for the named pipe at path. The pipe is
+// opened when the first line is written, and again after errors, so that the
+// server may be restarted.
+func NewFifoWriter(path string) *FifoWriter {
+	return &FifoWriter{path: path}
+}
+
+func (self *FifoWriter) WriteLine(line string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.file == nil {
+		// Without O_NONBLOCK, opening the pipe would block until the server
+		// opens it for reading. This way, it fails with ENXIO instead.
+		file, err := os.OpenFile(self.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		self.file = file
+	}
+	_, err := self.file.WriteString(line + "\n")
+	if err != nil {
+		// The server probably closed the pipe.
+		_ = self.file.Close()
+		self.file = nil
+		return err
+	}
+	return nil
+}
+
+func (self *FifoWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// RconWriter sends lines to a server as RCON commands. It connects when the
+// first line is written, and reconnects after the connection is lost.
+type RconWriter struct {
+	config        RconConfig
+	mutex         sync.Mutex               // Guards client, so that commands are sent in order
+	client        *rcon.Client             // nil until a line is written or after an error
+	ResponseEvent ext.EventChannel[string] // Emits the non-empty responses to commands
+}
+
+// NewRconWriter creates an RconWriter for the server described by config.
+func NewRconWriter(config RconConfig) *RconWriter {
+	return &RconWriter{config: config}
+}
+
+func (self *RconWriter) WriteLine(line string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	response, err := self.execute(line)
+	if err != nil {
+		return err
+	}
+	response = minecraftFormatting.ReplaceAllString(response, "")
+	if response != "" {
+		self.ResponseEvent.Broadcast(response)
+	}
+	return nil
+}
+
+// Close closes the connection and ResponseEvent.
+func (self *RconWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.ResponseEvent.Close()
+	if self.client == nil {
+		return nil
+	}
+	err := self.client.Close()
+	self.client = nil
+	return err
+}
+
+// Minecraft formatting codes, e.g. §c for red text.
+var minecraftFormatting = regexp.MustCompile("\u00a7.")
+
+// execute sends a command, connecting first if there is no connection or if
+// the server closed it since the last command, e.g. because it restarted.
+func (self *RconWriter) execute(command string) (string, error) {
+	if self.client != nil && !self.client.Alive() {
+		_ = self.client.Close()
+		self.client = nil
+	}
+	if self.client == nil {
+		client, err := rcon.Dial(self.config.Address, self.config.Password, self.config.Timeout.Duration)
+		if err != nil {
+			return "", err
+		}
+		self.client = client
+	}
+	response, err := self.client.Execute(command)
+	if err != nil {
+		// The command isn't sent again, since it may have run already.
+		_ = self.client.Close()
+		self.client = nil
+		return "", err
+	}
+	return response, nil
+}
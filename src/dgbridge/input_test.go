@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFifoWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input")
+	assert.NoError(t, syscall.Mkfifo(path, 0o600))
+	writer := NewFifoWriter(path)
+
+	// Nobody reads the pipe yet.
+	assert.Error(t, writer.WriteLine("dropped"))
+
+	reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.NoError(t, writer.WriteLine("say hello"))
+	assert.NoError(t, writer.WriteLine("save-all"))
+
+	scanner := bufio.NewScanner(reader)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "say hello", scanner.Text())
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "save-all", scanner.Text())
+}
@@ -0,0 +1,174 @@
+package main
+
+// This file implements following a log file like `tail -F`, for servers that
+// dgbridge doesn't start itself.
+
+import (
+	"dgbridge/src/ext"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// TailConfig configures following the log file of a server that dgbridge
+// doesn't start, instead of running a command.
+type TailConfig struct {
+	Path         string       // Log file to follow, e.g. logs/latest.log. Empty to run Command instead.
+	FromStart    bool         // Relay the lines that are already in the file when dgbridge starts
+	PollInterval ext.Duration // How often to check the file for new lines
+}
+
+// DefaultTailConfig returns the log tail settings used when none are configured.
+func DefaultTailConfig() TailConfig {
+	return TailConfig{
+		PollInterval: ext.Duration{Duration: 250 * time.Millisecond},
+	}
+}
+
+// LogTail follows a log file and broadcasts its lines. Like `tail -F`, it
+// keeps following the path when the file is rotated, i.e. renamed or deleted
+// and created again, and starts over when the file is truncated.
+type LogTail struct {
+	config   TailConfig
+	encoding ext.Encoding // Encoding of the file
+	logger   *log.Logger
+	file     *os.File          // Currently followed file, nil if the path doesn't exist
+	info     os.FileInfo       // Identity of file, used to detect rotation
+	offset   int64             // Number of bytes read from file
+	lines    *ext.LineSplitter // Splits the file into lines, holding back the last line until its newline is written
+	done     chan struct{}
+}
+
+// NewLogTail creates a LogTail for the specified file, whose lines are
+// converted from the specified encoding to UTF-8. Lines longer than the
+// maximum line length of output are split or truncated like the output of a
+// subprocess. The file is not followed until Run is called.
+func NewLogTail(config TailConfig, encoding ext.Encoding, output OutputConfig, logger *log.Logger) *LogTail {
+	if config.PollInterval.Duration <= 0 {
+		config.PollInterval = DefaultTailConfig().PollInterval
+	}
+	return &LogTail{
+		config:   config,
+		encoding: encoding,
+		logger:   logger,
+		lines: ext.NewLineSplitter(ext.LineReaderOptions{
+			MaxLength: output.MaxLineLength,
+			LongLines: output.LongLines,
+		}),
+		done: make(chan struct{}),
+	}
+}
+
+// Run follows the file until Close is called, broadcasting each complete line
+// to event. This function is blocking.
+func (self *LogTail) Run(event *ext.EventChannel[string]) {
+	defer self.closeFile()
+	self.open(!self.config.FromStart)
+	for {
+		self.read(event.Broadcast)
+		select {
+		case <-self.done:
+			return
+		case <-time.After(self.config.PollInterval.Duration):
+		}
+		self.checkPath(event)
+	}
+}
+
+// Close stops following the file.
+func (self *LogTail) Close() {
+	close(self.done)
+}
+
+// open opens the file at the path, at its end if atEnd is set.
+// If the file doesn't exist, nothing is followed until it is created.
+func (self *LogTail) open(atEnd bool) {
+	file, err := os.Open(self.config.Path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			self.logger.Printf("[error] error opening log file: %v\n", err)
+		} else {
+			self.logger.Printf("[info] Waiting for log file %v to be created\n", self.config.Path)
+		}
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		self.logger.Printf("[error] error opening log file: %v\n", err)
+		_ = file.Close()
+		return
+	}
+	self.file = file
+	self.info = info
+	self.offset = 0
+	self.lines.Reset()
+	if atEnd {
+		self.offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			self.logger.Printf("[error] error seeking to the end of log file: %v\n", err)
+		}
+	}
+	self.logger.Printf("[info] Following log file %v\n", self.config.Path)
+}
+
+// read reads the data written to the file since the last read, a chunk at a
+// time, and calls emit for each complete line.
+func (self *LogTail) read(emit func(line string)) {
+	if self.file == nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := self.file.Read(buf)
+		self.offset += int64(n)
+		self.lines.Write(buf[:n], func(line string) {
+			emit(self.encoding.Decode(line))
+		})
+		if err != nil {
+			if err != io.EOF {
+				self.logger.Printf("[error] error reading log file: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// checkPath detects whether the file was rotated or truncated, and reopens it
+// if so.
+func (self *LogTail) checkPath(event *ext.EventChannel[string]) {
+	info, err := os.Stat(self.config.Path)
+	if err != nil {
+		// The file was deleted or renamed. Keep reading the old file until a
+		// new one is created.
+		return
+	}
+	if self.file == nil {
+		self.open(false)
+		return
+	}
+	if !os.SameFile(info, self.info) {
+		// Read what was written to the old file before it was rotated.
+		self.read(event.Broadcast)
+		self.logger.Printf("[info] Log file %v was rotated\n", self.config.Path)
+		self.closeFile()
+		self.open(false)
+		return
+	}
+	if info.Size() < self.offset {
+		self.logger.Printf("[info] Log file %v was truncated\n", self.config.Path)
+		if _, err := self.file.Seek(0, io.SeekStart); err != nil {
+			self.logger.Printf("[error] error seeking to the start of log file: %v\n", err)
+		}
+		self.offset = 0
+		self.lines.Reset()
+	}
+}
+
+func (self *LogTail) closeFile() {
+	if self.file != nil {
+		_ = self.file.Close()
+		self.file = nil
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receiveLines waits for n lines from lineCh.
+func receiveLines(t *testing.T, lineCh <-chan string, n int) []string {
+	var lines []string
+	for len(lines) < n {
+		select {
+		case line := <-lineCh:
+			lines = append(lines, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %q", lines)
+		}
+	}
+	return lines
+}
+
+func appendFile(t *testing.T, path string, contents string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	assert.NoError(t, err)
+	_, err = file.WriteString(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+}
+
+func TestLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latest.log")
+	appendFile(t, path, "old line\n")
+
+	var event ext.EventChannel[string]
+	lineCh := event.Listen()
+	defer event.Off(lineCh)
+	tail := NewLogTail(TailConfig{
+		Path:         path,
+		PollInterval: ext.Duration{Duration: 10 * time.Millisecond},
+	}, ext.Encoding{}, DefaultOutputConfig(), log.Default())
+	go tail.Run(&event)
+	defer tail.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Lines already in the file are skipped, and partial lines are held back.
+	appendFile(t, path, "first\r\nsec")
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "ond\n")
+	assert.Equal(t, []string{"first", "second"}, receiveLines(t, lineCh, 2))
+
+	// Rotation: lines written to the old file before the new one was created
+	// are relayed too.
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path+".1", "last of old\n")
+	appendFile(t, path, "first of new\n")
+	assert.Equal(t, []string{"last of old", "first of new"}, receiveLines(t, lineCh, 2))
+
+	// Truncation, as done by copytruncate log rotation
+	assert.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "after truncation\n")
+	assert.Equal(t, []string{"after truncation"}, receiveLines(t, lineCh, 1))
+}
+
+func TestLogTailFromStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latest.log")
+	encoding, err := ext.ParseEncoding("windows-1252")
+	assert.NoError(t, err)
+
+	var event ext.EventChannel[string]
+	lineCh := event.Listen()
+	defer event.Off(lineCh)
+	tail := NewLogTail(TailConfig{
+		Path:         path,
+		FromStart:    true,
+		PollInterval: ext.Duration{Duration: 10 * time.Millisecond},
+	}, encoding, DefaultOutputConfig(), log.Default())
+	go tail.Run(&event)
+	defer tail.Close()
+
+	// The file doesn't exist yet, so it is read from the start once created.
+	// Its lines are converted from its encoding.
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "one\ncaf\xe9\n")
+	assert.Equal(t, []string{"one", "café"}, receiveLines(t, lineCh, 2))
+}
+
+func TestLogTailLongLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latest.log")
+	output := DefaultOutputConfig()
+	output.MaxLineLength = 4
+	output.LongLines = ext.LongLineTruncate
+
+	var event ext.EventChannel[string]
+	lineCh := event.Listen()
+	defer event.Off(lineCh)
+	tail := NewLogTail(TailConfig{
+		Path:         path,
+		FromStart:    true,
+		PollInterval: ext.Duration{Duration: 10 * time.Millisecond},
+	}, ext.Encoding{}, output, log.Default())
+	go tail.Run(&event)
+	defer tail.Close()
+
+	// A file without newlines isn't held in memory, its lines are truncated
+	// like the output of a subprocess.
+	appendFile(t, path, "abcdefgh")
+	assert.Equal(t, []string{"abcd"}, receiveLines(t, lineCh, 1))
+	appendFile(t, path, "ijkl\nok\n")
+	assert.Equal(t, []string{"ok"}, receiveLines(t, lineCh, 1))
+}
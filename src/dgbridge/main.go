@@ -2,94 +2,420 @@ package main
 
 import (
 	"bufio"
+	"dgbridge/src/ext"
 	"dgbridge/src/lib"
 	"fmt"
 	"github.com/alexflint/go-arg"
 	"log"
 	"os"
+	"strings"
 )
 
 type CliArgs struct {
-	Token     string `arg:"required,-t,--token" help:"Discord authentication token"`
-	ChannelId string `arg:"required,-i,--channel_id" help:"Discord channel ID"`
-	RulesFile string `arg:"required,-r,--rules" help:"Path to the file with translation rules"`
-	Command   string `arg:"required,positional"`
+	Config          string          `arg:"-c,--config" help:"Path to a JSON configuration file"`
+	Token           string          `arg:"-t,--token" help:"Discord authentication token"`
+	ChannelId       string          `arg:"-i,--channel_id" help:"Discord channel ID"`
+	RulesFile       string          `arg:"-r,--rules" help:"Path to the file with translation rules"`
+	Shell           bool            `arg:"--shell" help:"Run the command through /bin/sh -c instead of splitting it into arguments"`
+	WorkDir         string          `arg:"--workdir" help:"Working directory of the subprocess"`
+	Env             []string        `arg:"-e,--env,separate" help:"Extra environment variable for the subprocess as KEY=VALUE, may be repeated"`
+	EnvFile         string          `arg:"--env_file" help:"Path to a .env file with extra environment variables for the subprocess"`
+	Pty             bool            `arg:"--pty" help:"Run the subprocess in a pseudo-terminal, merging its stdout and stderr"`
+	Restart         *RestartMode    `arg:"--restart" help:"When to restart the subprocess: never, on-failure or always [default: never]"`
+	RestartDelay    *ext.Duration   `arg:"--restart_delay" help:"Delay before restarting, doubled after each crash [default: 1s]"`
+	RestartMaxDelay *ext.Duration   `arg:"--restart_max_delay" help:"Maximum delay before restarting [default: 1m]"`
+	RestartMax      *int            `arg:"--restart_max" help:"Give up after this many restarts within the restart window, 0 to never give up [default: 5]"`
+	RestartWindow   *ext.Duration   `arg:"--restart_window" help:"Time window in which restarts are counted [default: 10m]"`
+	StopCommand     string          `arg:"--stop_command" help:"Line written to the subprocess' stdin to stop it, e.g. stop"`
+	StopTimeout     *ext.Duration   `arg:"--stop_timeout" help:"How long to wait for the subprocess to stop before sending SIGTERM [default: 30s]"`
+	TermTimeout     *ext.Duration   `arg:"--term_timeout" help:"How long to wait for the subprocess to stop after SIGTERM before sending SIGKILL [default: 10s]"`
+	MaxLineLength   *int            `arg:"--max_line_length" help:"Split the subprocess' output lines that are longer than this many bytes [default: 65536]"`
+	IdleFlush       *ext.Duration   `arg:"--idle_flush" help:"Relay a partial output line, e.g. a prompt, once the subprocess wrote nothing for this long, e.g. 500ms"`
+	Encoding        *ext.Encoding   `arg:"--encoding" help:"Character encoding of the subprocess' input and output, e.g. windows-1252 or shift_jis [default: utf-8]"`
+	Ansi            *AnsiMode       `arg:"--ansi" help:"What to do with colors in the subprocess' output: strip, or discord to post ansi code blocks [default: strip]"`
+	Tail            string          `arg:"--tail" help:"Follow this log file instead of running a command, e.g. logs/latest.log"`
+	TailFromStart   bool            `arg:"--tail_from_start" help:"Relay the lines already in the log file when starting to follow it"`
+	Fifo            string          `arg:"--fifo" help:"Write the lines for the server to this named pipe instead of its stdin"`
+	Rcon            string          `arg:"--rcon" help:"Send the lines for the server as commands to this RCON address instead of its stdin, e.g. localhost:25575"`
+	RconPassword    string          `arg:"--rcon_password,env:DGBRIDGE_RCON_PASSWORD" help:"RCON password"`
+	RconResponses   bool            `arg:"--rcon_responses" help:"Post the responses to RCON commands to the relay channel"`
+	CrashReports    bool            `arg:"--crash_reports" help:"Post the last lines of the output to Discord when the subprocess crashes"`
+	ControlSocket   string          `arg:"--control_socket" help:"Create a Unix socket at this path that dgbridge attach can connect to"`
+	Archive         string          `arg:"--archive" help:"Write the subprocess' output to rotated log files in this directory"`
+	Monitor         bool            `arg:"--monitor" help:"Sample the memory and CPU used by the subprocess periodically and check the alerts"`
+	MonitorInterval *ext.Duration   `arg:"--monitor_interval" help:"Time between samples of the resources used by the subprocess [default: 10s]"`
+	WatchdogTimeout *ext.Duration   `arg:"--watchdog_timeout" help:"Consider the subprocess hung when it writes no output for this long, e.g. 10m"`
+	WatchdogAction  *WatchdogAction `arg:"--watchdog_action" help:"What to do with a hung subprocess: alert, or restart it with the shutdown sequence [default: alert]"`
+	Signals         []string        `arg:"--signal,separate" help:"What to do when receiving a signal as SIGNAL=ACTION, e.g. SIGUSR1=stdin:save-all, may be repeated"`
+	Command         string          `arg:"positional" help:"Command to run, split into arguments with shell quoting rules"`
+}
+
+// Description is shown by --help.
+func (CliArgs) Description() string {
+	return "Relays the console of a game server to Discord.\n" +
+		"Use `dgbridge attach SOCKET` to attach to the control socket of a running instance.\n"
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "attach" {
+		runAttach(os.Args[2:])
+	}
 	fmt.Printf("Dgbridge (%v)\n", lib.Version)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	var args CliArgs
 	arg.MustParse(&args)
 
-	rules, err := lib.LoadRules(args.RulesFile)
+	config, err := loadConfig(args)
 	if err != nil {
-		log.Fatalf("error loading rules: %v\n", err)
+		log.Fatalf("error loading configuration: %v\n", err)
 	}
 
-	subprocess := NewSubprocess(args.Command)
+	var processes []*Process
+	for _, processConfig := range config.ProcessConfigs() {
+		process, err := NewProcess(processConfig)
+		if err != nil {
+			if processConfig.Name != "" {
+				log.Fatalf("process %v: %v\n", processConfig.Name, err)
+			}
+			log.Fatalf("%v\n", err)
+		}
+		processes = append(processes, process)
+	}
 
-	go relaySubprocessStdout(&subprocess)
-	go relaySubprocessStderr(&subprocess)
-	go relayStdinToSubprocessStdin(&subprocess)
+	for _, process := range processes {
+		process := process
+		process.goRelay(func() { relaySubprocessStdout(process) })
+		process.goRelay(func() { relaySubprocessStderr(process) })
+		if process.Responses != nil {
+			process.goRelay(func() { relayResponses(process) })
+		}
+	}
+	go relayStdinToSubprocessStdin(processes)
+	var control *ControlServer
+	if config.Control.Socket != "" {
+		control = NewControlServer(config.Control, processes)
+		if err := control.Start(); err != nil {
+			log.Fatalf("error creating control socket: %v\n", err)
+		}
+	}
 
-	// Create a goroutine that will wait for the subprocess to emit an exit event.
-	go func() {
-		log.Println("[debug] Waiting for child to exit")
-		exitCh := subprocess.ExitEvent.Listen()
-		defer subprocess.ExitEvent.Off(exitCh)
-		exitCode := <-exitCh
-		os.Exit(exitCode)
-	}()
+	// Create goroutines that will wait for the supervisors to give up on
+	// every subprocess.
+	exitCh := waitAllExited(processes)
 
-	err = subprocess.Start()
-	if err != nil {
-		log.Fatalln("[fatal] error starting command:", err)
+	for _, process := range processes {
+		err = process.Start()
+		if err != nil {
+			log.Fatalln("[fatal] "+process.prefix()+"error starting command:", err)
+		}
 	}
 
 	freeBotFunc, err := StartDiscordBot(BotParameters{
-		Token:          args.Token,
-		RelayChannelId: args.ChannelId,
-		Subprocess:     &subprocess,
-		Rules:          *rules,
+		Token:         config.Token,
+		Processes:     processes,
+		CommandPrefix: config.CommandPrefix,
+		Admins:        config.Admins,
 	})
 	if err != nil {
 		// This is a non-fatal error. We want the server to run even if the
 		// Discord connection failed.
 		log.Println("[error] failed to start Discord bot:", err)
 	}
-	defer freeBotFunc()
 
-	// Block forever
-	select {}
+	// Blocks forever if only log files are followed.
+	exitCode := <-exitCh
+	// The last notices, crash reports and archived lines are still on their way.
+	log.Println("[debug] Waiting for the relay jobs and archives to finish")
+	for _, process := range processes {
+		if process.Tail == nil {
+			process.Wait()
+		}
+	}
+	if freeBotFunc != nil {
+		freeBotFunc()
+	}
+	if control != nil {
+		control.Close()
+	}
+	os.Exit(exitCode)
+}
+
+// loadConfig loads the configuration file if one was specified, then applies
+// the command line arguments on top of it.
+func loadConfig(args CliArgs) (*Config, error) {
+	config := DefaultConfig()
+	if args.Config != "" {
+		loaded, err := LoadConfig(args.Config)
+		if err != nil {
+			return nil, err
+		}
+		config = *loaded
+	}
+	if err := args.applyTo(&config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// applyTo overrides the settings in config with the ones given on the command line.
+func (args *CliArgs) applyTo(config *Config) error {
+	if args.Token != "" {
+		config.Token = args.Token
+	}
+	if args.ControlSocket != "" {
+		config.Control.Socket = args.ControlSocket
+	}
+	if len(config.Processes) == 0 {
+		return args.applyToProcess(&config.ProcessConfig)
+	}
+	if args.ChannelId != "" || args.RulesFile != "" || args.Command != "" || args.Tail != "" || args.Fifo != "" ||
+		args.Rcon != "" {
+		return fmt.Errorf("--channel_id, --rules, --tail, --fifo, --rcon and the command must be set in Processes " +
+			"when the configuration file has Processes")
+	}
+	for i := range config.Processes {
+		if err := args.applyToProcess(&config.Processes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyToProcess overrides the settings of a subprocess with the ones given on
+// the command line.
+func (args *CliArgs) applyToProcess(config *ProcessConfig) error {
+	if args.ChannelId != "" {
+		config.ChannelId = args.ChannelId
+	}
+	if args.RulesFile != "" {
+		config.RulesFile = args.RulesFile
+	}
+	if args.Command != "" {
+		command, err := ParseCommandLine(args.Command, args.Shell || config.Command.Shell)
+		if err != nil {
+			return fmt.Errorf("error parsing command: %v", err)
+		}
+		config.Command.Argv = command.Argv
+		config.Command.Shell = command.Shell
+	} else if args.Shell {
+		config.Command.Shell = true
+	}
+	if args.WorkDir != "" {
+		config.Command.Dir = args.WorkDir
+	}
+	if args.EnvFile != "" {
+		config.Command.EnvFile = args.EnvFile
+	}
+	if args.Pty {
+		config.Pty.Enabled = true
+	}
+	if args.MaxLineLength != nil {
+		config.Output.MaxLineLength = *args.MaxLineLength
+	}
+	if args.IdleFlush != nil {
+		config.Output.IdleFlush = *args.IdleFlush
+	}
+	if args.Encoding != nil {
+		config.Encoding.Input = *args.Encoding
+		config.Encoding.Output = *args.Encoding
+	}
+	if args.Ansi != nil {
+		config.Output.Ansi = *args.Ansi
+	}
+	if args.CrashReports {
+		config.Crash.Enabled = true
+	}
+	if args.WatchdogTimeout != nil {
+		config.Watchdog.OutputTimeout = *args.WatchdogTimeout
+	}
+	if args.WatchdogAction != nil {
+		config.Watchdog.Action = *args.WatchdogAction
+	}
+	if args.Archive != "" {
+		config.Archive.Dir = args.Archive
+	}
+	if args.Monitor {
+		config.Monitor.Enabled = true
+	}
+	if args.MonitorInterval != nil {
+		config.Monitor.Interval = *args.MonitorInterval
+	}
+	if args.Tail != "" {
+		config.Tail.Path = args.Tail
+	}
+	if args.TailFromStart {
+		config.Tail.FromStart = true
+	}
+	if args.Fifo != "" {
+		config.Input.Fifo = args.Fifo
+	}
+	if args.Rcon != "" {
+		config.Input.Rcon.Address = args.Rcon
+	}
+	if args.RconPassword != "" {
+		config.Input.Rcon.Password = args.RconPassword
+	}
+	if args.RconResponses {
+		config.Input.Rcon.RelayResponses = true
+	}
+	for _, variable := range args.Env {
+		key, value, found := strings.Cut(variable, "=")
+		if !found {
+			return fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", variable)
+		}
+		if config.Command.Env == nil {
+			config.Command.Env = make(map[string]string)
+		}
+		config.Command.Env[key] = value
+	}
+	if args.Restart != nil {
+		config.Restart.Mode = *args.Restart
+	}
+	if args.RestartDelay != nil {
+		config.Restart.Delay = *args.RestartDelay
+	}
+	if args.RestartMaxDelay != nil {
+		config.Restart.MaxDelay = *args.RestartMaxDelay
+	}
+	if args.RestartMax != nil {
+		config.Restart.MaxRestarts = *args.RestartMax
+	}
+	if args.RestartWindow != nil {
+		config.Restart.Window = *args.RestartWindow
+	}
+	if args.StopCommand != "" {
+		config.Shutdown.StopCommand = args.StopCommand
+	}
+	if args.StopTimeout != nil {
+		config.Shutdown.StopTimeout = *args.StopTimeout
+	}
+	if args.TermTimeout != nil {
+		config.Shutdown.TermTimeout = *args.TermTimeout
+	}
+	for _, mapping := range args.Signals {
+		name, actionString, found := strings.Cut(mapping, "=")
+		if !found {
+			return fmt.Errorf("invalid signal mapping %q, expected SIGNAL=ACTION", mapping)
+		}
+		action, err := ParseSignalAction(actionString)
+		if err != nil {
+			return err
+		}
+		if err := config.Signals.Set(name, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitAllExited starts goroutines that wait until the supervisors have given
+// up on every subprocess that dgbridge runs, then send the exit code of
+// dgbridge: the exit code of the first subprocess that failed, or 0. Like a
+// shell, dgbridge exits with 128 plus the signal number if that subprocess was
+// killed by a signal. This function is non-blocking.
+//
+// Returns:
+//
+//	the channel that the exit code is sent to, nil if dgbridge runs no
+//	subprocess.
+func waitAllExited(allProcesses []*Process) <-chan int {
+	// Servers whose log file is followed never exit, as far as dgbridge knows.
+	var processes []*Process
+	for _, process := range allProcesses {
+		if process.Tail == nil {
+			processes = append(processes, process)
+		}
+	}
+	if len(processes) == 0 {
+		return nil
+	}
+	statuses := make(chan ExitStatus, len(processes))
+	for _, process := range processes {
+		exitCh := process.Supervisor.ExitEvent.Listen()
+		go func(process *Process, exitCh <-chan ExitStatus) {
+			defer process.Supervisor.ExitEvent.Off(exitCh)
+			statuses <- <-exitCh
+		}(process, exitCh)
+	}
+	exitCh := make(chan int, 1)
+	go func() {
+		log.Println("[debug] Waiting for children to exit")
+		exitCode := 0
+		for range processes {
+			if status := <-statuses; exitCode == 0 {
+				exitCode = status.ShellCode()
+			}
+		}
+		exitCh <- exitCode
+	}()
+	return exitCh
 }
 
-// relayStdinToSubprocessStdin continuously relays os.Stdin to the subprocess' stdin.
-func relayStdinToSubprocessStdin(ctx *SubprocessContext) {
+// relayStdinToSubprocessStdin continuously relays os.Stdin to the subprocesses' stdin.
+//
+// With several processes, each line must be addressed to a process by
+// starting it with @ and the name of the process, e.g. "@survival save-all".
+func relayStdinToSubprocessStdin(processes []*Process) {
 	// Relay os.Stdin to the subprocess' stdin.
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
+		process, line := addressedProcess(processes, scanner.Text())
+		if process == nil {
+			log.Println("[warn] Several processes are running, start the line with @<name> to send it to one of them")
+			continue
+		}
 		// It is required to append a newline to the line because  it is
 		// not included in Text().
-		ctx.WriteStdinLineEvent.Broadcast(scanner.Text() + "\n")
+		process.Subprocess.WriteStdinLineEvent.Broadcast(line + "\n")
 	}
 }
 
+// addressedProcess returns the process that a line of input is addressed to
+// with "@<name> ", and the rest of the line. Lines that aren't addressed go to
+// the only process, or to no process if there are several.
+func addressedProcess(processes []*Process, line string) (*Process, string) {
+	if name, rest, found := strings.Cut(line, " "); found && strings.HasPrefix(name, "@") {
+		if process := findProcess(processes, strings.TrimPrefix(name, "@")); process != nil {
+			return process, rest
+		}
+	}
+	if len(processes) == 1 {
+		return processes[0], line
+	}
+	return nil, line
+}
+
 // relaySubprocessStdout continuously relays the subprocess' stdout to os.Stdout.
-func relaySubprocessStdout(ctx *SubprocessContext) {
-	lineCh := ctx.StdoutLineEvent.Listen()
-	defer ctx.StdoutLineEvent.Off(lineCh)
+func relaySubprocessStdout(process *Process) {
+	event := &process.Subprocess.StdoutLineEvent
+	lineCh := event.Listen()
+	defer event.Off(lineCh)
 	for line := range lineCh {
-		_, _ = os.Stdout.WriteString(line + "\n")
+		_, _ = os.Stdout.WriteString(process.prefix() + line + "\n")
+	}
+}
+
+// relayResponses continuously relays the responses to RCON commands to os.Stdout.
+func relayResponses(process *Process) {
+	responseCh := process.Responses.Listen()
+	defer process.Responses.Off(responseCh)
+	for response := range responseCh {
+		for _, line := range strings.Split(response, "\n") {
+			_, _ = os.Stdout.WriteString(process.prefix() + line + "\n")
+		}
 	}
 }
 
 // relaySubprocessStderr continuously relays the subprocess' stderr to os.Stderr.
-func relaySubprocessStderr(ctx *SubprocessContext) {
-	lineCh := ctx.StderrLineEvent.Listen()
-	defer ctx.StderrLineEvent.Off(lineCh)
+func relaySubprocessStderr(process *Process) {
+	event := &process.Subprocess.StderrLineEvent
+	lineCh := event.Listen()
+	defer event.Off(lineCh)
 	for line := range lineCh {
-		_, _ = os.Stderr.WriteString(line + "\n")
+		_, _ = os.Stderr.WriteString(process.prefix() + line + "\n")
 	}
 }
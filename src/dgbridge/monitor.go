@@ -0,0 +1,527 @@
+package main
+
+// This file implements resource monitoring: the memory and CPU used by the
+// subprocess and its descendants are sampled from /proc, shown by the status
+// command, and checked against alert rules.
+
+import (
+	"bufio"
+	"bytes"
+	"dgbridge/src/ext"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Clock ticks per second of the CPU times in /proc (USER_HZ), which is 100 on
+// all common Linux platforms.
+const clockTicks = 100
+
+// ResourceMetric names a value of ResourceStats that alert rules can watch.
+type ResourceMetric string
+
+const (
+	MetricRss           ResourceMetric = "rss"            // Resident memory in bytes
+	MetricMemoryPercent ResourceMetric = "memory_percent" // Resident memory in percent of the memory limit
+	MetricCpu           ResourceMetric = "cpu"            // CPU usage in percent of one core
+	MetricThreads       ResourceMetric = "threads"        // Number of threads
+	MetricFds           ResourceMetric = "fds"            // Number of open file descriptors
+	MetricProcesses     ResourceMetric = "processes"      // Number of processes
+)
+
+// ParseResourceMetric converts a string to a ResourceMetric.
+func ParseResourceMetric(metric string) (ResourceMetric, error) {
+	switch ResourceMetric(metric) {
+	case MetricRss, MetricMemoryPercent, MetricCpu, MetricThreads, MetricFds, MetricProcesses:
+		return ResourceMetric(metric), nil
+	}
+	return "", fmt.Errorf("unknown metric %q (expected %v, %v, %v, %v, %v or %v)", metric,
+		MetricRss, MetricMemoryPercent, MetricCpu, MetricThreads, MetricFds, MetricProcesses)
+}
+
+func (metric *ResourceMetric) UnmarshalText(b []byte) error {
+	parsed, err := ParseResourceMetric(string(b))
+	if err != nil {
+		return err
+	}
+	*metric = parsed
+	return nil
+}
+
+// MonitorConfig configures sampling the resources used by the subprocess.
+type MonitorConfig struct {
+	Enabled     bool         // Sample the resources periodically and check the alerts
+	Interval    ext.Duration // Time between samples
+	MemoryLimit ext.ByteSize // Memory available to the subprocess. 0 means the limit of dgbridge's cgroup, or else the total memory.
+	Alerts      []AlertRule  `validate:"dive"` // Alerts posted when a metric stays above a threshold
+}
+
+// DefaultMonitorConfig returns the monitoring settings used when none are configured.
+func DefaultMonitorConfig() MonitorConfig {
+	return MonitorConfig{
+		Interval: ext.Duration{Duration: 10 * time.Second},
+	}
+}
+
+// AlertRule posts a message to Discord when a metric stays above a threshold
+// for a while, e.g. when the memory used is above 90% for 5 minutes.
+//
+// Messages are Go templates (see text/template) that can use:
+//
+//	{{.Name}}:      the name of the alert
+//	{{.Metric}}:    the metric, e.g. memory_percent
+//	{{.Value}}:     the value of the metric, e.g. "93.5%"
+//	{{.Threshold}}: the threshold, e.g. "90%"
+//	{{.For}}:       how long the value must stay above the threshold, e.g. "5 minutes"
+//	{{.Stats}}:     all the resources used by the subprocess, see ResourceStats
+type AlertRule struct {
+	Name      string         `validate:"required"` // Identifies the alert in logs
+	Metric    ResourceMetric // Value to watch
+	Above     string         // Threshold, a size such as "3GiB" for rss, a number otherwise
+	For       ext.Duration   // How long the value must stay above the threshold
+	Discord   string         // Message posted when the alert fires. Empty means a default message.
+	Resolved  string         // Message posted when the value drops below the threshold again, may be empty
+	ChannelId string         // Channel to post the messages to. Empty means the relay channel.
+}
+
+// Default message of an alert.
+const defaultAlertMessage = ":warning: Alert `{{.Name}}`: {{.Metric}} is {{.Value}}, " +
+	"above {{.Threshold}} for {{.For}}."
+
+// ResourceStats is a sample of the resources used by the subprocess and its
+// descendants.
+type ResourceStats struct {
+	Running     bool          // The subprocess was running. The other fields are zero otherwise.
+	Processes   int           // Number of processes: the subprocess and its descendants
+	Rss         ext.ByteSize  // Resident memory
+	MemoryLimit ext.ByteSize  // Memory available to the subprocess, 0 if unknown
+	Cpu         float64       // CPU usage in percent of one core since the previous sample
+	Threads     int           // Number of threads
+	Fds         int           // Number of open file descriptors
+	Uptime      time.Duration // How long the subprocess has been running
+}
+
+// MemoryPercent returns the resident memory in percent of the memory limit,
+// or 0 if the limit is unknown.
+func (self ResourceStats) MemoryPercent() float64 {
+	if self.MemoryLimit == 0 {
+		return 0
+	}
+	return float64(self.Rss) / float64(self.MemoryLimit) * 100
+}
+
+// Value returns the value of a metric.
+func (self ResourceStats) Value(metric ResourceMetric) float64 {
+	switch metric {
+	case MetricRss:
+		return float64(self.Rss)
+	case MetricMemoryPercent:
+		return self.MemoryPercent()
+	case MetricCpu:
+		return self.Cpu
+	case MetricThreads:
+		return float64(self.Threads)
+	case MetricFds:
+		return float64(self.Fds)
+	case MetricProcesses:
+		return float64(self.Processes)
+	}
+	return 0
+}
+
+// formatMetric formats a value of a metric for humans, e.g. "1.5GiB" or "93.5%".
+func formatMetric(metric ResourceMetric, value float64) string {
+	switch metric {
+	case MetricRss:
+		return ext.ByteSize(value).String()
+	case MetricMemoryPercent, MetricCpu:
+		return strconv.FormatFloat(value, 'f', 1, 64) + "%"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Monitor samples the resources used by a subprocess and its descendants from
+// /proc, and emits the messages of the alert rules.
+type Monitor struct {
+	config     MonitorConfig
+	subprocess *SubprocessContext
+	mutex      sync.Mutex // Guards stats, cpu and sampledAt
+	stats      ResourceStats
+	cpu        map[int]uint64 // CPU time of each process at the last sample, nil after the subprocess exited
+	sampledAt  time.Time      // When the last sample was taken
+	alerts     []*alertState
+	AlertEvent ext.EventChannel[Announcement] // Emits the messages of the alerts
+}
+
+// alertState is an AlertRule with its parsed threshold and templates.
+type alertState struct {
+	rule      AlertRule
+	threshold float64
+	discord   *template.Template
+	resolved  *template.Template // nil if no message is posted
+	since     time.Time          // When the value went above the threshold, zero if it is below
+	firing    bool               // The alert fired and hasn't resolved yet
+}
+
+// alertTemplateData is passed to the templates of an alert.
+type alertTemplateData struct {
+	Name      string
+	Metric    ResourceMetric
+	Value     string
+	Threshold string
+	For       string
+	Stats     ResourceStats
+}
+
+// NewMonitor creates a Monitor for the specified subprocess. The alert rules
+// are parsed, so that errors are reported before the monitor is started.
+func NewMonitor(subprocess *SubprocessContext, config MonitorConfig) (*Monitor, error) {
+	monitor := &Monitor{config: config, subprocess: subprocess}
+	for _, rule := range config.Alerts {
+		state, err := newAlertState(rule)
+		if err != nil {
+			return nil, fmt.Errorf("alert %q: %v", rule.Name, err)
+		}
+		monitor.alerts = append(monitor.alerts, state)
+	}
+	return monitor, nil
+}
+
+func newAlertState(rule AlertRule) (*alertState, error) {
+	if rule.Metric == "" {
+		return nil, fmt.Errorf("no metric")
+	}
+	state := &alertState{rule: rule}
+	var err error
+	if rule.Metric == MetricRss {
+		var size ext.ByteSize
+		size, err = ext.ParseByteSize(rule.Above)
+		state.threshold = float64(size)
+	} else {
+		state.threshold, err = strconv.ParseFloat(strings.TrimSuffix(rule.Above, "%"), 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold %q", rule.Above)
+	}
+	message := rule.Discord
+	if message == "" {
+		message = defaultAlertMessage
+	}
+	if state.discord, err = parseJobTemplate(message); err != nil {
+		return nil, err
+	}
+	if state.resolved, err = parseJobTemplate(rule.Resolved); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Start starts sampling the resources in a goroutine, if monitoring is enabled.
+// Sampling stops, and AlertEvent is closed, once the subprocess is closed.
+func (self *Monitor) Start() {
+	if !self.config.Enabled {
+		self.AlertEvent.Close()
+		return
+	}
+	if self.config.MemoryLimit == 0 {
+		self.config.MemoryLimit = memoryLimit()
+	}
+	interval := self.config.Interval.Duration
+	if interval <= 0 {
+		interval = DefaultMonitorConfig().Interval.Duration
+	}
+	go func() {
+		defer self.AlertEvent.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-self.subprocess.Closed():
+				return
+			}
+			stats, err := self.sample(now)
+			if err != nil {
+				self.subprocess.logger.Printf("[error] Resource monitoring stopped: %v\n", err)
+				return
+			}
+			self.checkAlerts(stats, now)
+		}
+	}()
+}
+
+// Stats returns the resources used by the subprocess: the last sample if
+// monitoring is enabled, or else a sample taken now, whose CPU usage is the
+// average since the subprocess started.
+func (self *Monitor) Stats() (ResourceStats, error) {
+	self.mutex.Lock()
+	stats, sampledAt := self.stats, self.sampledAt
+	self.mutex.Unlock()
+	if self.config.Enabled && !sampledAt.IsZero() {
+		return stats, nil
+	}
+	limit := self.config.MemoryLimit
+	if limit == 0 {
+		limit = memoryLimit()
+	}
+	stats, _, err := measureResources(self.subprocess, limit, nil, time.Time{}, time.Now())
+	return stats, err
+}
+
+// sample takes a sample and saves it for Stats.
+func (self *Monitor) sample(now time.Time) (ResourceStats, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	stats, cpu, err := measureResources(self.subprocess, self.config.MemoryLimit, self.cpu, self.sampledAt, now)
+	if err != nil {
+		return ResourceStats{}, err
+	}
+	self.stats, self.cpu, self.sampledAt = stats, cpu, now
+	return stats, nil
+}
+
+// checkAlerts updates the alerts with a sample, and emits the messages of the
+// alerts that fired or resolved.
+func (self *Monitor) checkAlerts(stats ResourceStats, now time.Time) {
+	for _, alert := range self.alerts {
+		if !stats.Running {
+			// Start over once the subprocess is restarted.
+			alert.since = time.Time{}
+			alert.firing = false
+			continue
+		}
+		value := stats.Value(alert.rule.Metric)
+		fired, resolved := alert.update(value, now)
+		data := alertTemplateData{
+			Name:      alert.rule.Name,
+			Metric:    alert.rule.Metric,
+			Value:     formatMetric(alert.rule.Metric, value),
+			Threshold: formatMetric(alert.rule.Metric, alert.threshold),
+			For:       formatRemaining(alert.rule.For.Duration),
+			Stats:     stats,
+		}
+		switch {
+		case fired:
+			self.subprocess.logger.Printf("[warn] Alert %q fired: %v is %v\n", alert.rule.Name, data.Metric, data.Value)
+			self.emit(alert, alert.discord, data)
+		case resolved:
+			self.subprocess.logger.Printf("[info] Alert %q resolved: %v is %v\n", alert.rule.Name, data.Metric, data.Value)
+			self.emit(alert, alert.resolved, data)
+		}
+	}
+}
+
+// emit posts a message of an alert, if it has one.
+func (self *Monitor) emit(alert *alertState, tmpl *template.Template, data alertTemplateData) {
+	if tmpl == nil {
+		return
+	}
+	var content bytes.Buffer
+	if err := tmpl.Execute(&content, data); err != nil {
+		self.subprocess.logger.Printf("[error] Alert %q: %v\n", alert.rule.Name, err)
+		return
+	}
+	self.AlertEvent.Broadcast(Announcement{
+		ChannelId: alert.rule.ChannelId,
+		Content:   content.String(),
+	})
+}
+
+// update records the value of the alert's metric at a time.
+//
+// Returns:
+//
+//	fired: the value has been above the threshold for long enough, and the
+//	alert didn't fire yet.
+//	resolved: the value dropped below the threshold after the alert fired.
+func (self *alertState) update(value float64, now time.Time) (fired bool, resolved bool) {
+	if value <= self.threshold {
+		resolved = self.firing
+		self.since = time.Time{}
+		self.firing = false
+		return false, resolved
+	}
+	if self.since.IsZero() {
+		self.since = now
+	}
+	if !self.firing && now.Sub(self.since) >= self.rule.For.Duration {
+		self.firing = true
+		return true, false
+	}
+	return false, false
+}
+
+// measureResources samples the resources used by the subprocess and its
+// descendants.
+//
+// Parameters:
+//
+//	limit: memory available to the subprocess, 0 if unknown
+//	lastCpu: CPU time of each process at the last sample, nil for none
+//	lastSample: when the last sample was taken
+//
+// Returns:
+//
+//	the sample, and the CPU time of each process for the next sample.
+func measureResources(
+	subprocess *SubprocessContext,
+	limit ext.ByteSize,
+	lastCpu map[int]uint64,
+	lastSample time.Time,
+	now time.Time,
+) (ResourceStats, map[int]uint64, error) {
+	pid, startedAt := subprocess.Pid()
+	if pid == 0 {
+		return ResourceStats{}, nil, nil
+	}
+	tree, err := processTree(pid)
+	if err != nil {
+		return ResourceStats{}, nil, err
+	}
+	stats := ResourceStats{
+		Running:     true,
+		Processes:   len(tree),
+		MemoryLimit: limit,
+		Uptime:      now.Sub(startedAt).Round(time.Second),
+	}
+	cpu := make(map[int]uint64, len(tree))
+	var ticks uint64
+	for pid, stat := range tree {
+		stats.Rss += ext.ByteSize(stat.rss * uint64(os.Getpagesize()))
+		stats.Threads += stat.threads
+		stats.Fds += countFds(pid)
+		cpu[pid] = stat.cpu
+		// Processes that started since the last sample count with all of
+		// their CPU time.
+		if last, ok := lastCpu[pid]; ok && last <= stat.cpu {
+			ticks += stat.cpu - last
+		} else {
+			ticks += stat.cpu
+		}
+	}
+	elapsed := now.Sub(lastSample)
+	if lastCpu == nil {
+		elapsed = now.Sub(startedAt)
+	}
+	if elapsed > 0 {
+		stats.Cpu = float64(ticks) / clockTicks / elapsed.Seconds() * 100
+	}
+	return stats, cpu, nil
+}
+
+// processTree returns the live processes descended from a process, including
+// itself, with their /proc/[pid]/stat.
+func processTree(root int) (map[int]procStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	stats := make(map[int]procStat)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil || stat.state == 'Z' {
+			// The process exited in the meantime.
+			continue
+		}
+		stats[pid] = stat
+		children[stat.ppid] = append(children[stat.ppid], pid)
+	}
+	tree := make(map[int]procStat)
+	queue := []int{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		stat, ok := stats[pid]
+		if !ok {
+			continue
+		}
+		tree[pid] = stat
+		queue = append(queue, children[pid]...)
+	}
+	return tree, nil
+}
+
+// countFds returns the number of open file descriptors of a process, or 0 if
+// they can't be read.
+func countFds(pid int) int {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// memoryLimit returns the memory limit of dgbridge's cgroup, which the
+// subprocess inherits, or else the total memory, or 0 if neither is known.
+func memoryLimit() ext.ByteSize {
+	if limit := cgroupMemoryLimit(); limit > 0 {
+		return limit
+	}
+	return totalMemory()
+}
+
+// cgroupMemoryLimit returns the memory limit of dgbridge's cgroup, or 0 if it
+// has none.
+func cgroupMemoryLimit() ext.ByteSize {
+	contents, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		// Lines are hierarchy-ID:controllers:path, with an empty list of
+		// controllers for cgroup v2.
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		var path string
+		switch {
+		case fields[1] == "":
+			path = filepath.Join("/sys/fs/cgroup", fields[2], "memory.max")
+		case strings.Contains(","+fields[1]+",", ",memory,"):
+			path = filepath.Join("/sys/fs/cgroup/memory", fields[2], "memory.limit_in_bytes")
+		default:
+			continue
+		}
+		value, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// cgroup v2 says "max" and v1 a huge number when there is no limit.
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+		if err == nil && limit < 1<<60 {
+			return ext.ByteSize(limit)
+		}
+	}
+	return 0
+}
+
+// totalMemory returns the total memory from /proc/meminfo, or 0 if it can't be read.
+func totalMemory() ext.ByteSize {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:       16314540 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kib, _ := strconv.ParseUint(fields[1], 10, 64)
+			return ext.ByteSize(kib * 1024)
+		}
+	}
+	return 0
+}
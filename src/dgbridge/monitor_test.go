@@ -0,0 +1,84 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAlertUpdate(t *testing.T) {
+	alert, err := newAlertState(AlertRule{
+		Name:   "memory",
+		Metric: MetricMemoryPercent,
+		Above:  "90%",
+		For:    ext.Duration{Duration: 5 * time.Minute},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 90.0, alert.threshold)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		After    time.Duration
+		Value    float64
+		Fired    bool
+		Resolved bool
+	}{
+		{After: 0, Value: 95},
+		{After: 2 * time.Minute, Value: 80},
+		// The value must stay above the threshold for the whole duration.
+		{After: 3 * time.Minute, Value: 95},
+		{After: 7 * time.Minute, Value: 95},
+		{After: 8 * time.Minute, Value: 99, Fired: true},
+		{After: 9 * time.Minute, Value: 99},
+		{After: 10 * time.Minute, Value: 90, Resolved: true},
+		{After: 11 * time.Minute, Value: 50},
+	}
+	for _, step := range steps {
+		fired, resolved := alert.update(step.Value, start.Add(step.After))
+		assert.Equal(t, step.Fired, fired, "fired after %v", step.After)
+		assert.Equal(t, step.Resolved, resolved, "resolved after %v", step.After)
+	}
+}
+
+func TestNewMonitorErrors(t *testing.T) {
+	_, err := NewMonitor(nil, MonitorConfig{Alerts: []AlertRule{{Name: "a", Above: "1"}}})
+	assert.Error(t, err)
+	_, err = NewMonitor(nil, MonitorConfig{Alerts: []AlertRule{{Name: "a", Metric: MetricRss, Above: "lots"}}})
+	assert.Error(t, err)
+	_, err = NewMonitor(nil, MonitorConfig{Alerts: []AlertRule{{Name: "a", Metric: MetricCpu, Above: "90", Discord: "{{.Value"}}})
+	assert.Error(t, err)
+
+	monitor, err := NewMonitor(nil, MonitorConfig{Alerts: []AlertRule{{Name: "a", Metric: MetricRss, Above: "2GiB"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2<<30), monitor.alerts[0].threshold)
+}
+
+func TestMonitorStats(t *testing.T) {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sh", "-c", "sleep 5 & sleep 5 & wait"}},
+	})
+	monitor, err := NewMonitor(&subprocess, MonitorConfig{MemoryLimit: 1 << 40})
+	assert.NoError(t, err)
+
+	stats, err := monitor.Stats()
+	assert.NoError(t, err)
+	assert.False(t, stats.Running)
+
+	assert.NoError(t, subprocess.Start())
+	defer func() {
+		_ = subprocess.Signal(syscall.SIGKILL)
+		<-subprocess.Exited()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	stats, err = monitor.Stats()
+	assert.NoError(t, err)
+	assert.True(t, stats.Running)
+	assert.Equal(t, 3, stats.Processes)
+	assert.Equal(t, 3, stats.Threads)
+	assert.Greater(t, stats.Rss, ext.ByteSize(0))
+	assert.Greater(t, stats.Fds, 0)
+	assert.Greater(t, stats.MemoryPercent(), 0.0)
+	assert.Equal(t, float64(stats.Rss), stats.Value(MetricRss))
+}
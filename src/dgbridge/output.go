@@ -0,0 +1,109 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"dgbridge/src/lib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// AnsiMode tells what to do with the ANSI escape sequences, e.g. colors, in
+// the subprocess' output before the rules are applied to it.
+type AnsiMode string
+
+const (
+	AnsiStrip   AnsiMode = "strip"   // Remove the sequences
+	AnsiDiscord AnsiMode = "discord" // Convert the colors for Discord and post the lines in ```ansi code blocks
+)
+
+// ParseAnsiMode converts a string to an AnsiMode.
+func ParseAnsiMode(mode string) (AnsiMode, error) {
+	switch AnsiMode(mode) {
+	case AnsiStrip, AnsiDiscord:
+		return AnsiMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown ANSI mode %q (expected %v or %v)", mode, AnsiStrip, AnsiDiscord)
+}
+
+func (mode *AnsiMode) UnmarshalText(b []byte) error {
+	parsed, err := ParseAnsiMode(string(b))
+	if err != nil {
+		return err
+	}
+	*mode = parsed
+	return nil
+}
+
+// OutputConfig configures how the output of the subprocess is read.
+type OutputConfig struct {
+	MaxLineLength int              // Longer lines are split or truncated
+	LongLines     ext.LongLineMode // What to do with longer lines: split or truncate
+	IdleFlush     ext.Duration     // Emit a partial line, e.g. a prompt, once no output was read for this long. 0 disables it.
+	Ansi          AnsiMode         // What to do with ANSI escape sequences before the rules are applied: strip or discord
+	Grouping      GroupingConfig   // Joining multi-line messages, e.g. stack traces, into one event
+	RelayBuffer   int              // Number of lines kept while Discord can't keep up, e.g. when rate limited
+	RelayOverflow ext.Overflow     // What to do with lines beyond RelayBuffer: drop_oldest, drop_newest, coalesce or block
+	ReplayLines   int              // Number of recent lines relayed once Discord is connected, 0 for no limit
+	ReplayAge     ext.Duration     // Age of the oldest line relayed once Discord is connected, 0 for no limit. Both 0 disables the replay.
+}
+
+// DefaultOutputConfig returns the output settings used when none are configured.
+func DefaultOutputConfig() OutputConfig {
+	return OutputConfig{
+		MaxLineLength: ext.DefaultMaxLineLength,
+		LongLines:     ext.LongLineSplit,
+		Ansi:          AnsiStrip,
+		Grouping:      DefaultGroupingConfig(),
+		RelayBuffer:   1000,
+		RelayOverflow: ext.OverflowDropOldest,
+		ReplayLines:   100,
+		ReplayAge:     ext.Duration{Duration: 10 * time.Minute},
+	}
+}
+
+// joinLines merges a line into the line waiting to be relayed, when the relay
+// coalesces the lines that Discord can't keep up with.
+func joinLines(buffered string, line string) string {
+	return buffered + "\n" + line
+}
+
+// readOutput reads the lines of one of the subprocess' outputs until it is
+// closed, converts them to UTF-8, and calls emit for each line. Read errors
+// are logged.
+//
+// Parameters:
+//
+//	name: name of the output for logging, e.g. stdout.
+func (self *SubprocessContext) readOutput(name string, r io.Reader, emit func(line string)) {
+	err := ext.ReadLines(self.encoding.Output.NewReader(r), ext.LineReaderOptions{
+		MaxLength: self.output.MaxLineLength,
+		LongLines: self.output.LongLines,
+		IdleFlush: self.output.IdleFlush.Duration,
+	}, emit)
+	// The pipes are closed if they don't drain in time, and reading a
+	// terminal fails with EIO once every process closed it.
+	if err != nil && !errors.Is(err, os.ErrClosed) && !errors.Is(err, syscall.EIO) {
+		self.logger.Printf("[error] error reading subprocess %v: %v\n", name, err)
+	}
+}
+
+// applyRules processes the ANSI escape sequences of a line of output, or of a
+// group of lines, and applies the rules to it.
+//
+// Returns:
+//
+//	the messages to post to Discord, or nil if no rules matched.
+func (self *OutputConfig) applyRules(rules []lib.Rule, sets lib.RuleSets, line string) []lib.Output {
+	if self.Ansi == AnsiDiscord {
+		outputs := lib.ApplyRulesColored(rules, sets, ext.ConvertAnsiColors(line))
+		for i := range outputs {
+			outputs[i].Text = codeBlock("ansi", outputs[i].Text)
+		}
+		return outputs
+	}
+	return lib.ApplyRules(rules, sets, nil, ext.StripTerminalSequences(line))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"dgbridge/src/lib"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Process is a subprocess supervised by dgbridge, together with the rules and
+// the Discord channel used to relay its messages.
+type Process struct {
+	Name           string                    // Identifies the process in logs and Discord commands, may be empty
+	ChannelId      string                    // ID of the relay channel
+	Rules          lib.Rules                 // Message conversion rules
+	Subprocess     *SubprocessContext        // The subprocess
+	Tail           *LogTail                  // Follows the log file of the subprocess instead of running it, may be nil
+	Responses      *ext.EventChannel[string] // Emits the responses to RCON commands, may be nil
+	RelayResponses bool                      // Post the responses to RCON commands to the relay channel
+	Supervisor     *Supervisor               // Restarts and stops the subprocess
+	Crashes        *CrashReporter            // Reports the abnormal exits of the subprocess
+	CrashChannelId string                    // ID of the channel that crash reports are posted to
+	Monitor        *Monitor                  // Samples the resources used by the subprocess
+	Archive        *ConsoleArchive           // Writes the output of the subprocess to log files
+	Watchdog       *Watchdog                 // Detects when the subprocess is hung
+	Scheduler      *Scheduler                // Runs the scheduled jobs of the subprocess
+	relays         sync.WaitGroup            // Tracks the jobs relaying the events of the process
+}
+
+// NewProcess loads the rules of a subprocess and sets up its supervisor and
+// scheduler. The subprocess is not started.
+func NewProcess(config ProcessConfig) (*Process, error) {
+	rules, err := lib.LoadRules(config.RulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rules: %v", err)
+	}
+	signals, err := config.Signals.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signal map: %v", err)
+	}
+
+	logger := log.Default()
+	if config.Name != "" {
+		logger = log.New(log.Writer(), processPrefix(config.Name), log.Flags()|log.Lmsgprefix)
+	}
+	input := NewInputWriter(config.Input)
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command:  config.Command,
+		Pty:      config.Pty,
+		Logger:   logger,
+		Input:    input,
+		Output:   config.Output,
+		Encoding: config.Encoding,
+	})
+	// The lines written before Discord is connected are relayed once it is.
+	replay := ext.ReplayOptions{Count: config.Output.ReplayLines, Age: config.Output.ReplayAge.Duration}
+	subprocess.StdoutLineEvent.SetReplay(replay)
+	subprocess.StderrLineEvent.SetReplay(replay)
+	var tail *LogTail
+	if config.Tail.Path != "" {
+		tail = NewLogTail(config.Tail, config.Encoding.Output, config.Output, logger)
+		if input == nil {
+			logger.Println("[warn] No input is configured, messages for the server will be dropped")
+		}
+	}
+	supervisor := NewSupervisor(&subprocess, SupervisorParameters{
+		Restart:  config.Restart,
+		Shutdown: config.Shutdown,
+		Signals:  signals,
+	})
+	monitor, err := NewMonitor(&subprocess, config.Monitor)
+	if err != nil {
+		return nil, fmt.Errorf("error loading alerts: %v", err)
+	}
+	scheduler, err := NewScheduler(&subprocess, monitor, config.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("error loading schedule: %v", err)
+	}
+	crashChannelId := config.Crash.ChannelId
+	if crashChannelId == "" {
+		crashChannelId = config.ChannelId
+	}
+	var responses *ext.EventChannel[string]
+	if writer, ok := input.(*RconWriter); ok {
+		responses = &writer.ResponseEvent
+	}
+	return &Process{
+		Name:           config.Name,
+		ChannelId:      config.ChannelId,
+		Rules:          *rules,
+		Subprocess:     &subprocess,
+		Tail:           tail,
+		Responses:      responses,
+		RelayResponses: config.Input.Rcon.RelayResponses,
+		Supervisor:     supervisor,
+		Crashes:        NewCrashReporter(&subprocess, config.Crash, config.Command.Dir),
+		CrashChannelId: crashChannelId,
+		Monitor:        monitor,
+		Archive:        NewConsoleArchive(&subprocess, config.Archive, config.Name),
+		Watchdog:       NewWatchdog(&subprocess, supervisor, config.Watchdog),
+		Scheduler:      scheduler,
+	}, nil
+}
+
+// Start starts the subprocess, or starts following its log file, and starts
+// its scheduled jobs, resource monitoring, watchdog and console archive.
+func (self *Process) Start() error {
+	self.Archive.Start()
+	if self.Tail != nil {
+		self.Subprocess.StartInput()
+		go self.Tail.Run(&self.Subprocess.StdoutLineEvent)
+	} else {
+		self.Crashes.Start()
+		self.Monitor.Start()
+		self.Watchdog.Start()
+		if err := self.Supervisor.Start(); err != nil {
+			return err
+		}
+	}
+	self.Scheduler.Start()
+	return nil
+}
+
+// goRelay runs a job that relays the events of the process in a goroutine,
+// which Wait waits for. The job must return once the events are closed.
+func (self *Process) goRelay(job func()) {
+	self.relays.Add(1)
+	go func() {
+		defer self.relays.Done()
+		job()
+	}()
+}
+
+// Wait waits until the relay jobs and the console archive are done, once the
+// supervisor gave up on the subprocess and its events are closed.
+func (self *Process) Wait() {
+	self.relays.Wait()
+	self.Archive.Wait()
+}
+
+// findProcess returns the process with the specified name, or nil.
+func findProcess(processes []*Process, name string) *Process {
+	for _, process := range processes {
+		if process.Name != "" && process.Name == name {
+			return process
+		}
+	}
+	return nil
+}
+
+// prefix returns the prefix of the process' lines in dgbridge's own output,
+// empty if the process has no name.
+func (self *Process) prefix() string {
+	if self.Name == "" {
+		return ""
+	}
+	return processPrefix(self.Name)
+}
+
+func processPrefix(name string) string {
+	return "[" + name + "] "
+}
@@ -0,0 +1,164 @@
+package main
+
+// This file implements the handling of the subprocess' process group. The
+// subprocess is started as the leader of its own process group, so that
+// signals reach the processes it starts too, e.g. the server started by a
+// wrapper script.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to wait for leftover processes to exit after each signal.
+const reapTimeout = 5 * time.Second
+
+// signalGroup sends a signal to every process in a process group.
+func signalGroup(pgid int, sig os.Signal) error {
+	sysSig, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", sig)
+	}
+	return syscall.Kill(-pgid, sysSig)
+}
+
+// reapGroup makes sure that no process of a process group is left alive.
+// Leftover processes are sent SIGTERM, then SIGKILL if they don't exit in time.
+func reapGroup(pgid int, logger *log.Logger) error {
+	if !groupAlive(pgid) {
+		return nil
+	}
+	logger.Printf("[warn] Processes left over in the subprocess' process group, sending SIGTERM: %v\n",
+		describeGroup(pgid))
+	_ = signalGroup(pgid, syscall.SIGTERM)
+	if waitGroupExit(pgid, reapTimeout) {
+		return nil
+	}
+	logger.Printf("[warn] Processes left over in the subprocess' process group, sending SIGKILL: %v\n",
+		describeGroup(pgid))
+	_ = signalGroup(pgid, syscall.SIGKILL)
+	if waitGroupExit(pgid, reapTimeout) {
+		return nil
+	}
+	return fmt.Errorf("processes survived SIGKILL: %v", describeGroup(pgid))
+}
+
+// waitGroupExit waits until no process of a process group is alive.
+//
+// Returns:
+//
+//	false if processes are still alive after the timeout.
+func waitGroupExit(pgid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for groupAlive(pgid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// groupAlive reports whether a process of a process group is still alive.
+// Zombies, which are waiting to be reaped by their parent, don't count.
+func groupAlive(pgid int) bool {
+	members, err := groupMembers(pgid)
+	if err != nil {
+		// No /proc, ask the kernel instead. This counts zombies too.
+		err := syscall.Kill(-pgid, 0)
+		return err == nil || err == syscall.EPERM
+	}
+	return len(members) > 0
+}
+
+// describeGroup returns the PIDs of the live processes in a process group, for logging.
+func describeGroup(pgid int) string {
+	members, err := groupMembers(pgid)
+	if err != nil {
+		return fmt.Sprintf("process group %d", pgid)
+	}
+	pids := make([]string, len(members))
+	for i, pid := range members {
+		pids[i] = strconv.Itoa(pid)
+	}
+	return "PIDs " + strings.Join(pids, ", ")
+}
+
+// groupMembers returns the PIDs of the live processes in a process group,
+// read from /proc.
+func groupMembers(pgid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var members []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil {
+			// The process exited in the meantime.
+			continue
+		}
+		if stat.pgid == pgid && stat.state != 'Z' {
+			members = append(members, pid)
+		}
+	}
+	return members, nil
+}
+
+// procStat holds the fields of /proc/[pid]/stat used by dgbridge. See proc(5).
+type procStat struct {
+	state   byte   // Process state, e.g. R (running), S (sleeping) or Z (zombie)
+	ppid    int    // PID of the parent
+	pgid    int    // Process group ID
+	cpu     uint64 // CPU time spent in user and kernel mode, in clock ticks
+	threads int    // Number of threads
+	rss     uint64 // Resident set size, in pages
+}
+
+// readProcStat reads /proc/[pid]/stat.
+func readProcStat(pid int) (procStat, error) {
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name is in parentheses and may itself contain spaces and
+	// parentheses, so the fields are counted from the last ')'.
+	end := strings.LastIndexByte(string(contents), ')')
+	if end < 0 {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(contents[end+1:]))
+	if len(fields) < 3 {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	var stat procStat
+	stat.state = fields[0][0]
+	stat.ppid, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, err
+	}
+	stat.pgid, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return procStat{}, err
+	}
+	// Fields 14 (utime), 15 (stime), 20 (num_threads) and 24 (rss), counted
+	// from 1 with the state as field 3.
+	if len(fields) < 22 {
+		return stat, nil
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	stat.cpu = utime + stime
+	stat.threads, _ = strconv.Atoi(fields[17])
+	stat.rss, _ = strconv.ParseUint(fields[21], 10, 64)
+	return stat, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// PtyConfig configures running the subprocess in a pseudo-terminal.
+//
+// In a pseudo-terminal, the subprocess' stdout and stderr are merged: every
+// line is emitted as a StdoutLineEvent from the lib.StreamPty stream.
+type PtyConfig struct {
+	Enabled bool   // Run the subprocess in a pseudo-terminal
+	Cols    uint16 // Terminal width. 0 means the width of dgbridge's terminal, or 80.
+	Rows    uint16 // Terminal height. 0 means the height of dgbridge's terminal, or 24.
+	Echo    bool   // Let the terminal echo the lines written to the subprocess
+}
+
+// watchPty allocates a pseudo-terminal and makes it the command's
+// controlling terminal. It broadcasts StdoutLineEvent whenever the terminal
+// emits a line, with terminal control sequences other than colors removed.
+//
+// Returns:
+//
+//	the master side of the terminal, which accepts the subprocess' input, and
+//	the slave side, which must be closed once the command was started.
+func (self *SubprocessContext) watchPty(cmd *exec.Cmd, readers *sync.WaitGroup) (*os.File, *os.File, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, nil, err
+	}
+	cols, rows := self.ptySize()
+	if err := setPtySize(master, cols, rows); err != nil {
+		self.logger.Println("[error] error setting terminal size:", err)
+	}
+	if err := setPtyEcho(slave, self.pty.Echo); err != nil {
+		_ = master.Close()
+		_ = slave.Close()
+		return nil, nil, fmt.Errorf("error configuring terminal: %v", err)
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = ptyProcAttr()
+
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		self.readOutput("terminal", master, func(line string) {
+			self.StdoutLineEvent.Broadcast(ext.StripTerminalSequencesKeepColors(line))
+		})
+	}()
+	return master, slave, nil
+}
+
+// ptySize returns the configured terminal size. Unset dimensions are taken
+// from dgbridge's own terminal, if there is one.
+func (self *SubprocessContext) ptySize() (cols uint16, rows uint16) {
+	cols, rows = self.pty.Cols, self.pty.Rows
+	if cols != 0 && rows != 0 {
+		return cols, rows
+	}
+	termCols, termRows, err := getPtySize(os.Stdin)
+	if err != nil || termCols == 0 || termRows == 0 {
+		termCols, termRows = 80, 24
+	}
+	if cols == 0 {
+		cols = termCols
+	}
+	if rows == 0 {
+		rows = termRows
+	}
+	return cols, rows
+}
+
+// resizePty applies the size of dgbridge's terminal to the subprocess'
+// terminal after dgbridge's terminal was resized.
+// The kernel sends SIGWINCH to the subprocess.
+func (self *SubprocessContext) resizePty() {
+	self.mutex.Lock()
+	master := self.ptyMaster
+	self.mutex.Unlock()
+	if master == nil {
+		return
+	}
+	cols, rows := self.ptySize()
+	if err := setPtySize(master, cols, rows); err != nil {
+		self.logger.Println("[error] error resizing terminal:", err)
+	}
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package main
+
+// This file implements the allocation of Linux pseudo-terminals through
+// /dev/ptmx. See pty(7).
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// winsize mirrors the kernel's struct winsize.
+type winsize struct {
+	Rows   uint16
+	Cols   uint16
+	XPixel uint16
+	YPixel uint16
+}
+
+// openPty allocates a pseudo-terminal.
+//
+// Returns:
+//
+//	the master side, read and written by dgbridge, and the slave side, to be
+//	used as the subprocess' terminal.
+func openPty() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening /dev/ptmx: %v", err)
+	}
+	var unlock int32
+	var number uint32
+	err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number))
+	}
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("error unlocking pseudo-terminal: %v", err)
+	}
+	slavePath := "/dev/pts/" + strconv.FormatUint(uint64(number), 10)
+	slave, err = os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("error opening %v: %v", slavePath, err)
+	}
+	return master, slave, nil
+}
+
+// setPtySize sets the window size of a terminal.
+func setPtySize(tty *os.File, cols uint16, rows uint16) error {
+	size := winsize{Rows: rows, Cols: cols}
+	return ioctl(tty, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+}
+
+// getPtySize returns the window size of a terminal.
+func getPtySize(tty *os.File) (cols uint16, rows uint16, err error) {
+	var size winsize
+	err = ioctl(tty, syscall.TIOCGWINSZ, unsafe.Pointer(&size))
+	return size.Cols, size.Rows, err
+}
+
+// setPtyEcho enables or disables the echoing of input characters.
+func setPtyEcho(tty *os.File, echo bool) error {
+	var termios syscall.Termios
+	err := ioctl(tty, syscall.TCGETS, unsafe.Pointer(&termios))
+	if err != nil {
+		return err
+	}
+	if echo {
+		termios.Lflag |= syscall.ECHO
+	} else {
+		termios.Lflag &^= syscall.ECHO
+	}
+	return ioctl(tty, syscall.TCSETS, unsafe.Pointer(&termios))
+}
+
+// ptyProcAttr returns the process attributes that make the subprocess' stdin
+// its controlling terminal.
+func ptyProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errPtyUnsupported = errors.New("pseudo-terminals are only supported on Linux")
+
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errPtyUnsupported
+}
+
+func setPtySize(_ *os.File, _ uint16, _ uint16) error {
+	return errPtyUnsupported
+}
+
+func getPtySize(_ *os.File) (cols uint16, rows uint16, err error) {
+	return 0, 0, errPtyUnsupported
+}
+
+func setPtyEcho(_ *os.File, _ bool) error {
+	return errPtyUnsupported
+}
+
+func ptyProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"dgbridge/src/ext"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ScheduledJob is a job that writes lines to the subprocess' stdin and/or
+// posts a message to Discord according to a cron schedule.
+//
+// Lines and messages are Go templates (see text/template) that can use:
+//
+//	{{.Name}}:      the name of the job
+//	{{.Time}}:      the scheduled time of the job, as a time.Time
+//	{{.Remaining}}: the time left until the scheduled time, e.g. "5 minutes"
+//	{{.Stats}}:     the resources used by the subprocess, see ResourceStats
+type ScheduledJob struct {
+	Name      string           `validate:"required"` // Identifies the job in Discord commands
+	Cron      ext.CronSchedule // When to run the job
+	Stdin     []string         // Lines written to the subprocess' stdin
+	Discord   string           // Message posted to Discord
+	ChannelId string           // Channel to post the message to. Empty means the relay channel.
+	Paused    bool             // Don't run the job until it is resumed
+	Countdown CountdownConfig  // Announcements before the scheduled time
+}
+
+// CountdownConfig configures the announcements made before a job runs, e.g.
+// "Restarting in 5 minutes".
+type CountdownConfig struct {
+	Before  []ext.Duration // How long before the scheduled time to announce it
+	Stdin   []string       // Lines written to the subprocess' stdin
+	Discord string         // Message posted to Discord
+}
+
+// Announcement is a message to post to a Discord channel.
+type Announcement struct {
+	ChannelId string // Empty means the relay channel
+	Content   string
+}
+
+// JobStatus describes the state of a scheduled job.
+type JobStatus struct {
+	Name    string
+	Cron    string
+	Paused  bool
+	NextRun time.Time // Zero if the schedule never matches
+}
+
+// Scheduler runs scheduled jobs.
+type Scheduler struct {
+	subprocess    *SubprocessContext
+	monitor       *Monitor   // Provides the resource usage to the templates, may be nil
+	mutex         sync.Mutex // Guards the jobs' paused state
+	jobs          []*scheduledJobState
+	AnnounceEvent ext.EventChannel[Announcement] // Emits messages to post to Discord
+}
+
+// scheduledJobState is a ScheduledJob with its parsed templates.
+type scheduledJobState struct {
+	job       ScheduledJob
+	paused    bool
+	stdin     []*template.Template
+	discord   *template.Template
+	countdown struct {
+		stdin   []*template.Template
+		discord *template.Template
+	}
+}
+
+// jobTemplateData is passed to the templates of a scheduled job.
+type jobTemplateData struct {
+	Name      string
+	Time      time.Time
+	Remaining string
+	Stats     ResourceStats
+}
+
+// NewScheduler creates a Scheduler for the specified jobs. The jobs' templates
+// are parsed, so that errors are reported before the scheduler is started.
+func NewScheduler(subprocess *SubprocessContext, monitor *Monitor, jobs []ScheduledJob) (*Scheduler, error) {
+	scheduler := &Scheduler{subprocess: subprocess, monitor: monitor}
+	names := make(map[string]bool)
+	for _, job := range jobs {
+		if names[job.Name] {
+			return nil, fmt.Errorf("job %q: duplicate job name", job.Name)
+		}
+		names[job.Name] = true
+		if job.Cron.String() == "" {
+			return nil, fmt.Errorf("job %q: no cron expression", job.Name)
+		}
+
+		state := &scheduledJobState{job: job, paused: job.Paused}
+		var err error
+		if state.stdin, err = parseJobTemplates(job.Stdin); err == nil {
+			if state.discord, err = parseJobTemplate(job.Discord); err == nil {
+				if state.countdown.stdin, err = parseJobTemplates(job.Countdown.Stdin); err == nil {
+					state.countdown.discord, err = parseJobTemplate(job.Countdown.Discord)
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("job %q: %v", job.Name, err)
+		}
+		scheduler.jobs = append(scheduler.jobs, state)
+	}
+	return scheduler, nil
+}
+
+// Start starts a goroutine for each job that runs it on schedule. The jobs
+// stop, and AnnounceEvent is closed, once the subprocess is closed.
+func (self *Scheduler) Start() {
+	var jobs sync.WaitGroup
+	for _, state := range self.jobs {
+		jobs.Add(1)
+		go func(state *scheduledJobState) {
+			defer jobs.Done()
+			self.runJob(state)
+		}(state)
+	}
+	go func() {
+		jobs.Wait()
+		self.AnnounceEvent.Close()
+	}()
+}
+
+// Jobs returns the status of every job, sorted by name.
+func (self *Scheduler) Jobs() []JobStatus {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := time.Now()
+	var statuses []JobStatus
+	for _, state := range self.jobs {
+		statuses = append(statuses, JobStatus{
+			Name:    state.job.Name,
+			Cron:    state.job.Cron.String(),
+			Paused:  state.paused,
+			NextRun: state.job.Cron.Next(now),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// SetPaused pauses or resumes a job.
+func (self *Scheduler) SetPaused(name string, paused bool) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, state := range self.jobs {
+		if state.job.Name == name {
+			state.paused = paused
+			return nil
+		}
+	}
+	return fmt.Errorf("no job named %q", name)
+}
+
+// runJob runs a job on schedule, until the subprocess is closed.
+func (self *Scheduler) runJob(state *scheduledJobState) {
+	for {
+		now := time.Now()
+		scheduled, before := nextJobRun(state.job, now)
+		if scheduled.IsZero() {
+			self.subprocess.logger.Printf("[error] Job %q never runs: %v\n", state.job.Name, state.job.Cron)
+			return
+		}
+		runAt := scheduled.Add(-before)
+		if !self.sleep(time.Until(runAt)) {
+			return
+		}
+
+		if self.isPaused(state) {
+			self.subprocess.logger.Printf("[debug] Skipping paused job %q\n", state.job.Name)
+			continue
+		}
+		data := jobTemplateData{
+			Name:      state.job.Name,
+			Time:      scheduled,
+			Remaining: formatRemaining(before),
+			Stats:     self.stats(),
+		}
+		if before == 0 {
+			self.subprocess.logger.Printf("[info] Running job %q\n", state.job.Name)
+			self.execute(state, state.stdin, state.discord, data)
+		} else {
+			self.subprocess.logger.Printf("[info] Running countdown of job %q, %v left\n", state.job.Name, data.Remaining)
+			self.execute(state, state.countdown.stdin, state.countdown.discord, data)
+		}
+		// Don't run the same minute twice if the clock is slightly early.
+		if !self.sleep(time.Until(runAt.Add(time.Second))) {
+			return
+		}
+	}
+}
+
+// sleep waits for the specified duration.
+//
+// Returns:
+//
+//	false if the subprocess was closed in the meantime.
+func (self *Scheduler) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.subprocess.Closed():
+		return false
+	}
+}
+
+// nextJobRun returns the next time a job or one of its countdown
+// announcements runs.
+//
+// Returns:
+//
+//	the scheduled time of the job, and how long before it the run happens:
+//	0 for the job itself, or one of the countdown's durations.
+func nextJobRun(job ScheduledJob, now time.Time) (scheduled time.Time, before time.Duration) {
+	var bestRun time.Time
+	offsets := []time.Duration{0}
+	for _, duration := range job.Countdown.Before {
+		offsets = append(offsets, duration.Duration)
+	}
+	for _, offset := range offsets {
+		// The first scheduled time whose announcement is still in the future.
+		candidate := job.Cron.Next(now.Add(offset))
+		if candidate.IsZero() {
+			continue
+		}
+		run := candidate.Add(-offset)
+		if bestRun.IsZero() || run.Before(bestRun) {
+			bestRun, scheduled, before = run, candidate, offset
+		}
+	}
+	return scheduled, before
+}
+
+// execute writes the lines of a job to the subprocess' stdin and posts its
+// message to Discord.
+func (self *Scheduler) execute(
+	state *scheduledJobState,
+	stdin []*template.Template,
+	discord *template.Template,
+	data jobTemplateData,
+) {
+	for _, tmpl := range stdin {
+		line, err := executeJobTemplate(tmpl, data)
+		if err != nil {
+			self.subprocess.logger.Printf("[error] Job %q: %v\n", state.job.Name, err)
+			continue
+		}
+		self.subprocess.WriteStdinLineEvent.Broadcast(line + "\n")
+	}
+	if discord != nil {
+		content, err := executeJobTemplate(discord, data)
+		if err != nil {
+			self.subprocess.logger.Printf("[error] Job %q: %v\n", state.job.Name, err)
+			return
+		}
+		self.AnnounceEvent.Broadcast(Announcement{
+			ChannelId: state.job.ChannelId,
+			Content:   content,
+		})
+	}
+}
+
+// stats returns the resources used by the subprocess, or zero stats if they
+// can't be sampled.
+func (self *Scheduler) stats() ResourceStats {
+	if self.monitor == nil {
+		return ResourceStats{}
+	}
+	stats, err := self.monitor.Stats()
+	if err != nil {
+		self.subprocess.logger.Printf("[error] error sampling resources: %v\n", err)
+	}
+	return stats
+}
+
+func (self *Scheduler) isPaused(state *scheduledJobState) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return state.paused
+}
+
+// parseJobTemplate parses a template of a job. Returns nil for an empty template.
+func parseJobTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("").Option("missingkey=error").Parse(text)
+}
+
+// parseJobTemplates parses the templates of a job.
+func parseJobTemplates(texts []string) ([]*template.Template, error) {
+	var templates []*template.Template
+	for _, text := range texts {
+		tmpl, err := parseJobTemplate(text)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl != nil {
+			templates = append(templates, tmpl)
+		}
+	}
+	return templates, nil
+}
+
+func executeJobTemplate(tmpl *template.Template, data jobTemplateData) (string, error) {
+	var result bytes.Buffer
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// formatRemaining formats a countdown duration for humans, e.g. "1 hour 30 minutes".
+func formatRemaining(d time.Duration) string {
+	d = d.Round(time.Second)
+	units := []struct {
+		name   string
+		length time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+	var parts []string
+	for _, unit := range units {
+		count := d / unit.length
+		if count == 0 {
+			continue
+		}
+		d -= count * unit.length
+		part := fmt.Sprintf("%d %v", count, unit.name)
+		if count != 1 {
+			part += "s"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return strings.Join(parts, " ")
+}
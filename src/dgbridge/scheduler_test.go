@@ -0,0 +1,60 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNextJobRun(t *testing.T) {
+	cron, err := ext.ParseCron("0 4 * * *")
+	assert.NoError(t, err)
+	job := ScheduledJob{
+		Name: "restart",
+		Cron: cron,
+		Countdown: CountdownConfig{
+			Before: []ext.Duration{{Duration: 5 * time.Minute}, {Duration: time.Minute}},
+		},
+	}
+	scheduled := time.Date(2023, 1, 1, 4, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Now          time.Time
+		ExpectBefore time.Duration
+	}{
+		{Now: time.Date(2023, 1, 1, 3, 0, 0, 0, time.UTC), ExpectBefore: 5 * time.Minute},
+		{Now: time.Date(2023, 1, 1, 3, 55, 0, 0, time.UTC), ExpectBefore: time.Minute},
+		{Now: time.Date(2023, 1, 1, 3, 59, 30, 0, time.UTC), ExpectBefore: 0},
+	}
+	for _, test := range tests {
+		gotScheduled, gotBefore := nextJobRun(job, test.Now)
+		assert.Equal(t, scheduled, gotScheduled, "now: %v", test.Now)
+		assert.Equal(t, test.ExpectBefore, gotBefore, "now: %v", test.Now)
+	}
+}
+
+func TestFormatRemaining(t *testing.T) {
+	tests := []struct {
+		Duration time.Duration
+		Expect   string
+	}{
+		{Duration: time.Minute, Expect: "1 minute"},
+		{Duration: 5 * time.Minute, Expect: "5 minutes"},
+		{Duration: 90 * time.Minute, Expect: "1 hour 30 minutes"},
+		{Duration: 0, Expect: "0 seconds"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Expect, formatRemaining(test.Duration))
+	}
+}
+
+func TestNewSchedulerErrors(t *testing.T) {
+	cron, err := ext.ParseCron("@hourly")
+	assert.NoError(t, err)
+	_, err = NewScheduler(nil, nil, []ScheduledJob{{Name: "a", Cron: cron}, {Name: "a", Cron: cron}})
+	assert.Error(t, err)
+	_, err = NewScheduler(nil, nil, []ScheduledJob{{Name: "a"}})
+	assert.Error(t, err)
+	_, err = NewScheduler(nil, nil, []ScheduledJob{{Name: "a", Cron: cron, Discord: "{{.Remaining"}})
+	assert.Error(t, err)
+}
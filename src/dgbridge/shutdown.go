@@ -0,0 +1,159 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ShutdownConfig configures the sequence used to stop the subprocess.
+//
+// The sequence has up to three stages. Each stage waits for the subprocess
+// to exit before moving on to the next one:
+//  1. Write StopCommand to the subprocess' stdin and wait up to StopTimeout.
+//     Without a StopCommand, the signal that dgbridge received is forwarded
+//     instead, unless it is SIGTERM.
+//  2. Send SIGTERM and wait up to TermTimeout.
+//  3. Send SIGKILL.
+type ShutdownConfig struct {
+	StopCommand string       // Line written to stdin to stop the subprocess, e.g. "stop"
+	StopTimeout ext.Duration // How long to wait for the subprocess to exit after the first stage
+	TermTimeout ext.Duration // How long to wait for the subprocess to exit after SIGTERM
+}
+
+// DefaultShutdownConfig returns the shutdown sequence used when none is configured.
+func DefaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{
+		StopTimeout: ext.Duration{Duration: 30 * time.Second},
+		TermTimeout: ext.Duration{Duration: 10 * time.Second},
+	}
+}
+
+// shutdownStage is a step of the shutdown sequence.
+type shutdownStage struct {
+	description string        // Describes what the stage did, e.g. "sent SIGTERM"
+	action      func() error  // Asks the subprocess to exit
+	timeout     time.Duration // How long to wait for the subprocess to exit. 0 means forever.
+}
+
+// Shutdown stops the subprocess with the shutdown sequence and prevents it
+// from being restarted. Each stage is announced as a NoticeEvent.
+// Calling Shutdown again while the sequence runs skips to the next stage.
+//
+// Parameters:
+//
+//	sig: the signal that triggered the shutdown, or nil.
+func (self *Supervisor) Shutdown(sig os.Signal) {
+	self.mutex.Lock()
+	if self.stopping {
+		self.mutex.Unlock()
+		select {
+		case self.skipStage <- struct{}{}:
+		default:
+		}
+		return
+	}
+	self.stopping = true
+	self.subprocess.RequestStop()
+	close(self.stopCh)
+	exited := self.subprocess.Exited()
+	if self.gaveUp {
+		self.mutex.Unlock()
+		return
+	}
+	self.sequences.Add(1)
+	self.mutex.Unlock()
+	defer self.sequences.Done()
+
+	self.runShutdownStages(sig, exited)
+}
+
+// Restart stops the subprocess with the shutdown sequence, then starts it
+// again right away, regardless of the restart policy. Nothing happens if the
+// subprocess isn't running, or is already being stopped or restarted.
+//
+// Parameters:
+//
+//	reason: why the subprocess is restarted, e.g. "no output for 5m0s".
+func (self *Supervisor) Restart(reason string) {
+	self.mutex.Lock()
+	if self.stopping || !self.subprocess.Running() || self.restartRequested || self.gaveUp {
+		self.mutex.Unlock()
+		return
+	}
+	self.restartRequested = true
+	self.subprocess.RequestStop()
+	exited := self.subprocess.Exited()
+	self.sequences.Add(1)
+	self.mutex.Unlock()
+	defer self.sequences.Done()
+
+	self.notice(fmt.Sprintf(":arrows_counterclockwise: Restarting server: %v.", reason))
+	self.runShutdownStages(nil, exited)
+}
+
+// runShutdownStages runs the stages of the shutdown sequence until the
+// subprocess exits.
+func (self *Supervisor) runShutdownStages(sig os.Signal, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		// Not running, e.g. while waiting to be restarted.
+		return
+	default:
+	}
+	for _, stage := range self.shutdownStages(sig) {
+		if err := stage.action(); err != nil {
+			self.subprocess.logger.Printf("[error] error stopping subprocess (%v): %v\n", stage.description, err)
+		}
+		self.notice(fmt.Sprintf(":octagonal_sign: Stopping server: %v.", stage.description))
+
+		var timeout <-chan time.Time
+		if stage.timeout > 0 {
+			timeout = time.After(stage.timeout)
+		}
+		select {
+		case <-exited:
+			self.notice(":white_check_mark: Server stopped.")
+			return
+		case <-timeout:
+			self.notice(fmt.Sprintf(":warning: Server did not stop within %v.", stage.timeout))
+		case <-self.skipStage:
+		}
+	}
+}
+
+// shutdownStages returns the stages of the shutdown sequence.
+func (self *Supervisor) shutdownStages(sig os.Signal) []shutdownStage {
+	var stages []shutdownStage
+	if self.shutdown.StopCommand != "" {
+		stages = append(stages, shutdownStage{
+			description: fmt.Sprintf("sent `%v` command", self.shutdown.StopCommand),
+			action: func() error {
+				// The stdin pipe of a hung subprocess may be full, which must
+				// not keep the next stages from running.
+				go self.subprocess.WriteStdinLineEvent.Broadcast(self.shutdown.StopCommand + "\n")
+				return nil
+			},
+			timeout: self.shutdown.StopTimeout.Duration,
+		})
+	} else if sig != nil && sig != syscall.SIGTERM {
+		stages = append(stages, self.signalStage(sig, self.shutdown.StopTimeout.Duration))
+	}
+	return append(stages,
+		self.signalStage(syscall.SIGTERM, self.shutdown.TermTimeout.Duration),
+		self.signalStage(syscall.SIGKILL, 0),
+	)
+}
+
+// signalStage returns a shutdown stage that sends a signal to the subprocess.
+func (self *Supervisor) signalStage(sig os.Signal, timeout time.Duration) shutdownStage {
+	return shutdownStage{
+		description: fmt.Sprintf("sent %v", signalName(sig)),
+		action: func() error {
+			return self.subprocess.Signal(sig)
+		},
+		timeout: timeout,
+	}
+}
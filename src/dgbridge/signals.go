@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// SignalActionKind tells what dgbridge does when it receives a signal.
+type SignalActionKind string
+
+const (
+	SignalForward  SignalActionKind = "forward"  // Forward the signal to the subprocess' process group
+	SignalIgnore   SignalActionKind = "ignore"   // Ignore the signal
+	SignalShutdown SignalActionKind = "shutdown" // Stop the subprocess with the shutdown sequence
+	SignalStdin    SignalActionKind = "stdin"    // Write a line to the subprocess' stdin
+	SignalDefault  SignalActionKind = "default"  // Don't handle the signal, keeping its default behavior
+)
+
+// SignalAction tells what dgbridge does when it receives a signal.
+//
+// In configuration files, it is written as the name of its kind, e.g.
+// "forward", or as "stdin:<line>" for SignalStdin, e.g. "stdin:save-all".
+type SignalAction struct {
+	Kind SignalActionKind
+	Line string // Line written to the subprocess' stdin for SignalStdin
+}
+
+// SignalMap maps signal names, e.g. SIGUSR1, to the actions dgbridge takes
+// when it receives them. Signals that aren't in the map keep their default
+// behavior.
+type SignalMap map[string]SignalAction
+
+// Signals that can be handled, by name.
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGPIPE":  syscall.SIGPIPE,
+	"SIGALRM":  syscall.SIGALRM,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGTTIN":  syscall.SIGTTIN,
+	"SIGTTOU":  syscall.SIGTTOU,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// DefaultSignalMap returns the signal map used when none is configured.
+func DefaultSignalMap() SignalMap {
+	return SignalMap{
+		"SIGINT":   {Kind: SignalShutdown},
+		"SIGTERM":  {Kind: SignalShutdown},
+		"SIGHUP":   {Kind: SignalForward},
+		"SIGQUIT":  {Kind: SignalForward},
+		"SIGUSR1":  {Kind: SignalForward},
+		"SIGUSR2":  {Kind: SignalForward},
+		"SIGWINCH": {Kind: SignalForward},
+	}
+}
+
+// ParseSignalAction converts a string such as "forward" or "stdin:save-all" to a SignalAction.
+func ParseSignalAction(action string) (SignalAction, error) {
+	kind, line, hasLine := strings.Cut(action, ":")
+	switch SignalActionKind(kind) {
+	case SignalStdin:
+		if !hasLine || line == "" {
+			return SignalAction{}, fmt.Errorf("signal action %q needs a line to write, e.g. stdin:save-all", action)
+		}
+		return SignalAction{Kind: SignalStdin, Line: line}, nil
+	case SignalForward, SignalIgnore, SignalShutdown, SignalDefault:
+		if hasLine {
+			break
+		}
+		return SignalAction{Kind: SignalActionKind(kind)}, nil
+	}
+	return SignalAction{}, fmt.Errorf("unknown signal action %q (expected %v, %v, %v, %v or %v:<line>)",
+		action, SignalForward, SignalIgnore, SignalShutdown, SignalDefault, SignalStdin)
+}
+
+func (action *SignalAction) UnmarshalText(b []byte) error {
+	parsed, err := ParseSignalAction(string(b))
+	if err != nil {
+		return err
+	}
+	*action = parsed
+	return nil
+}
+
+func (action SignalAction) MarshalText() ([]byte, error) {
+	if action.Kind == SignalStdin {
+		return []byte(string(action.Kind) + ":" + action.Line), nil
+	}
+	return []byte(action.Kind), nil
+}
+
+// ParseSignal converts a signal name such as SIGUSR1, USR1 or usr1 to a signal.
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown or unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// Set sets the action taken when receiving the named signal.
+// The name is normalized, so that e.g. USR1 and SIGUSR1 refer to the same entry.
+func (self SignalMap) Set(name string, action SignalAction) error {
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+	self[signalName(sig)] = action
+	return nil
+}
+
+// UnmarshalJSON merges the signal map in a configuration file into the
+// existing map, so that the defaults of signals that aren't mentioned are kept.
+func (self *SignalMap) UnmarshalJSON(b []byte) error {
+	var actions map[string]SignalAction
+	if err := json.Unmarshal(b, &actions); err != nil {
+		return err
+	}
+	if *self == nil {
+		*self = make(SignalMap)
+	}
+	for name, action := range actions {
+		if err := self.Set(name, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names of signals that can't be handled, but may kill the subprocess.
+var fatalSignalNames = map[os.Signal]string{
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+// signalName returns the conventional name of a signal, e.g. SIGTERM.
+func signalName(sig os.Signal) string {
+	if name, ok := fatalSignalNames[sig]; ok {
+		return name
+	}
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// Resolve converts the signal names to signals and leaves out the signals
+// with the default behavior.
+func (self SignalMap) Resolve() (map[os.Signal]SignalAction, error) {
+	actions := make(map[os.Signal]SignalAction)
+	for name, action := range self {
+		sig, err := ParseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+		if action.Kind != SignalDefault {
+			actions[sig] = action
+		}
+	}
+	return actions, nil
+}
+
+// relaySignalsUntilExit handles the signals that dgbridge receives according
+// to the signal map. When ExitEvent is broadcast, the function exits.
+func (self *Supervisor) relaySignalsUntilExit(actions map[os.Signal]SignalAction) {
+	var handled []os.Signal
+	for sig := range actions {
+		handled = append(handled, sig)
+	}
+	if len(handled) == 0 {
+		return
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, handled...)
+	defer signal.Stop(sigCh)
+
+	exitCh := self.ExitEvent.Listen()
+	defer self.ExitEvent.Off(exitCh)
+
+	for {
+		select {
+		case sig := <-sigCh:
+			self.handleSignal(sig, actions[sig])
+		case <-exitCh:
+			return
+		}
+	}
+}
+
+// handleSignal takes the action configured for a signal.
+func (self *Supervisor) handleSignal(sig os.Signal, action SignalAction) {
+	switch action.Kind {
+	case SignalForward:
+		if sig == syscall.SIGWINCH && self.subprocess.pty.Enabled {
+			// The kernel signals the subprocess when its terminal is resized.
+			self.subprocess.resizePty()
+			return
+		}
+		if isTerminationSignal(sig) {
+			self.subprocess.RequestStop()
+		}
+		if err := self.subprocess.Signal(sig); err != nil {
+			self.subprocess.logger.Printf("[debug] Couldn't send signal \"%v\" to subprocess: %v\n", signalName(sig), err)
+		}
+	case SignalShutdown:
+		go self.Shutdown(sig)
+	case SignalStdin:
+		self.subprocess.logger.Printf("[info] Received %v, writing to subprocess: %v\n", signalName(sig), action.Line)
+		self.subprocess.WriteStdinLineEvent.Broadcast(action.Line + "\n")
+	case SignalIgnore:
+		self.subprocess.logger.Printf("[debug] Ignoring signal %v\n", signalName(sig))
+	}
+}
+
+// isTerminationSignal reports whether sig asks a process to terminate.
+// SIGHUP and SIGQUIT aren't among them: servers usually take SIGHUP as a
+// request to reload, and the JVM takes SIGQUIT as a request for a thread dump.
+func isTerminationSignal(sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGTERM:
+		return true
+	}
+	return false
+}
@@ -5,185 +5,378 @@ package main
 // https://www.yellowduck.be/posts/reading-command-output-line-by-line
 
 import (
-	"bufio"
 	"dgbridge/src/ext"
+	"dgbridge/src/lib"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// How long to wait for the output pipes to drain after the subprocess exited.
+// A descendant that inherited the pipes could otherwise keep them open forever.
+const pipeDrainTimeout = 2 * time.Second
+
 // SubprocessContext is a struct that holds all events for reading and writing to a subprocess' streams.
+//
+// A SubprocessContext can be started again after the subprocess exits. The events are kept across restarts, so
+// subscribers stay attached to the new process.
 type SubprocessContext struct {
-	cmd                 *exec.Cmd
-	StdoutLineEvent     ext.EventChannel[string] // Emits when subprocess' stdout emits a line
-	StderrLineEvent     ext.EventChannel[string] // Emits when subprocess' stderr emits a line
-	WriteStdinLineEvent ext.EventChannel[string] // Listens for data to write to stdin
-	ExitEvent           ext.EventChannel[int]    // Emits when subprocess exits
+	command             CommandSpec                  // Describes how to start the process
+	logger              *log.Logger                  // Logs the events of the subprocess
+	pty                 PtyConfig                    // Pseudo-terminal settings
+	input               InputWriter                  // Receives the lines for stdin instead of stdin, may be nil
+	output              OutputConfig                 // How the output is read
+	encoding            EncodingConfig               // Character encodings of the input and output
+	mutex               sync.Mutex                   // Guards cmd, stdin and ptyMaster
+	cmd                 *exec.Cmd                    // Currently running command, nil if not running
+	stdin               io.WriteCloser               // Stdin of the currently running command
+	ptyMaster           *os.File                     // Terminal of the currently running command in PTY mode
+	exited              chan struct{}                // Closed when the currently running command exits
+	pgid                int                          // Process group of the last started command
+	startedAt           time.Time                    // When the last command was started
+	stdinOnce           sync.Once                    // Tracks if the stdin writer was started
+	stopRequested       atomic.Bool                  // Set when the subprocess was asked to terminate
+	closed              chan struct{}                // Closed by Close
+	closeOnce           sync.Once                    // Closes closed once
+	StdoutLineEvent     ext.EventChannel[string]     // Emits when subprocess' stdout emits a line
+	StderrLineEvent     ext.EventChannel[string]     // Emits when subprocess' stderr emits a line
+	WriteStdinLineEvent ext.EventChannel[string]     // Listens for data to write to stdin
+	ExitEvent           ext.EventChannel[ExitStatus] // Emits when subprocess exits
+}
+
+// SubprocessParameters holds data to be passed to NewSubprocess.
+type SubprocessParameters struct {
+	Command  CommandSpec    // Describes how to start the process
+	Pty      PtyConfig      // Pseudo-terminal settings
+	Logger   *log.Logger    // Logs the events of the subprocess. nil means the standard logger.
+	Input    InputWriter    // Receives the lines for stdin instead of stdin, may be nil
+	Output   OutputConfig   // How the output is read
+	Encoding EncodingConfig // Character encodings of the input and output
 }
 
-// NewSubprocess creates a command handle from the specified system command string and returns a SubprocessContext
-// struct.
+// NewSubprocess creates a SubprocessContext struct for the specified command.
 // The subprocess is not started.
-//
-// Parameters:
-//
-//	command: system command string to use to start the process.
-func NewSubprocess(command string) SubprocessContext {
-	cmd := createCommand(command)
+func NewSubprocess(params SubprocessParameters) SubprocessContext {
+	logger := params.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
 	return SubprocessContext{
-		cmd: cmd,
+		command:  params.Command,
+		logger:   logger,
+		pty:      params.Pty,
+		input:    params.Input,
+		output:   params.Output,
+		encoding: params.Encoding,
+		closed:   make(chan struct{}),
 	}
 }
 
-// Start starts the subprocess.
+// Start starts the subprocess. It may be called again after the previous
+// subprocess has exited.
 // Starts goroutines:
 //  1. Read from the stdout
 //  2. Write to the stdin
 //  3. Wait for subprocess to finish
-//  4. Handle signals sent to the subprocess
 func (self *SubprocessContext) Start() error {
-	err := self.watchStdout()
-	if err != nil {
-		return err
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.cmd != nil {
+		return errors.New("subprocess is already running")
 	}
-	err = self.watchStderr()
+	cmd, err := createCommand(self.command)
 	if err != nil {
 		return err
 	}
-	err = self.listenStdin()
-	if err != nil {
-		return err
+
+	var readers sync.WaitGroup
+	var stdin io.WriteCloser
+	var outputs []io.Closer
+	var ptyMaster, ptySlave *os.File
+	if self.pty.Enabled {
+		ptyMaster, ptySlave, err = self.watchPty(cmd, &readers)
+		if err != nil {
+			return err
+		}
+		stdin = ptyMaster
+		outputs = []io.Closer{ptyMaster}
+	} else {
+		var stdout, stderr io.ReadCloser
+		stdout, stderr, stdin, err = openPipes(cmd)
+		if err != nil {
+			return err
+		}
+		// The readers only start once every pipe was created, so that
+		// nothing is left reading a pipe if one of them can't be.
+		self.watchStdout(stdout, &readers)
+		self.watchStderr(stderr, &readers)
+		outputs = []io.Closer{stdout, stderr}
+		// In PTY mode, the subprocess gets its own session, and therefore
+		// its own process group, instead.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	self.StartInput()
+
+	err = cmd.Start()
+	if ptySlave != nil {
+		// The subprocess has its own copy of the terminal now.
+		_ = ptySlave.Close()
 	}
-	err = self.cmd.Start()
 	if err != nil {
+		if ptyMaster != nil {
+			_ = ptyMaster.Close()
+		}
 		return err
 	}
-	go self.relaySignalsToSubprocessUntilExit()
-	go self.watchSubprocessExit()
+	self.cmd = cmd
+	self.stdin = stdin
+	self.ptyMaster = ptyMaster
+	self.exited = make(chan struct{})
+	self.pgid = cmd.Process.Pid
+	self.startedAt = time.Now()
+	self.stopRequested.Store(false)
+
+	go self.watchSubprocessExit(cmd, self.exited, &readers, outputs...)
 	return nil
 }
 
-// createCommand returns a command handle created from the specified system command string.
-// It doesn't run the command.
-func createCommand(command string) *exec.Cmd {
-	trimmed := strings.TrimSpace(command)
-	tokens := strings.Split(trimmed, " ")
-	cmd := exec.Command(tokens[0], tokens[1:]...)
-	return cmd
+// Exited returns a channel that is closed when the running subprocess exits.
+// If no subprocess is running, the returned channel is already closed.
+func (self *SubprocessContext) Exited() <-chan struct{} {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.cmd == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return self.exited
+}
+
+// Running reports whether the subprocess is running.
+func (self *SubprocessContext) Running() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.cmd != nil
 }
 
-// watchStdout watches the subprocess' stdout.
-// It broadcasts StdoutLineEvent whenever the process emits a line.
-func (self *SubprocessContext) watchStdout() error {
-	pipe, err := self.cmd.StdoutPipe()
+// Pid returns the PID of the running subprocess and when it was started, or 0
+// if it isn't running.
+func (self *SubprocessContext) Pid() (int, time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.cmd == nil {
+		return 0, time.Time{}
+	}
+	return self.cmd.Process.Pid, self.startedAt
+}
+
+// Signal sends a signal to the running subprocess' process group.
+func (self *SubprocessContext) Signal(sig os.Signal) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.cmd == nil {
+		return errors.New("subprocess is not running")
+	}
+	return signalGroup(self.pgid, sig)
+}
+
+// ReapLeftovers kills the processes left over in the process group of the
+// subprocess after it exited, e.g. the server started by a wrapper script.
+// It must not be called while the subprocess is running.
+func (self *SubprocessContext) ReapLeftovers() {
+	self.mutex.Lock()
+	pgid := self.pgid
+	self.mutex.Unlock()
+	if pgid == 0 {
+		return
+	}
+	if err := reapGroup(pgid, self.logger); err != nil {
+		self.logger.Println("[error] error killing leftover processes:", err)
+	}
+}
+
+// OutputStream returns the stream that StdoutLineEvent lines come from.
+// In PTY mode, stdout and stderr are merged into a single stream.
+func (self *SubprocessContext) OutputStream() lib.Stream {
+	if self.pty.Enabled {
+		return lib.StreamPty
+	}
+	return lib.StreamStdout
+}
+
+// Close closes the events of the subprocess once it won't be started again, so
+// that the loops receiving from them finish. Lines written to
+// WriteStdinLineEvent afterwards are dropped.
+func (self *SubprocessContext) Close() {
+	self.StdoutLineEvent.Close()
+	self.StderrLineEvent.Close()
+	self.WriteStdinLineEvent.Close()
+	self.ExitEvent.Close()
+	self.closeOnce.Do(func() { close(self.closed) })
+}
+
+// Closed returns a channel that is closed once Close was called, so that the
+// goroutines that don't receive from the events of the subprocess can stop too.
+func (self *SubprocessContext) Closed() <-chan struct{} {
+	return self.closed
+}
+
+// RequestStop marks the subprocess as asked to terminate, so that it is not
+// restarted when it exits.
+func (self *SubprocessContext) RequestStop() {
+	self.stopRequested.Store(true)
+}
+
+// StopRequested reports whether the running subprocess was asked to terminate.
+func (self *SubprocessContext) StopRequested() bool {
+	return self.stopRequested.Load()
+}
+
+// openPipes creates the pipes of the subprocess' stdout, stderr and stdin.
+// If one of them can't be created, the ones already created are closed.
+func openPipes(cmd *exec.Cmd) (stdout io.ReadCloser, stderr io.ReadCloser, stdin io.WriteCloser, err error) {
+	stdout, err = cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("error creating stdout pipe: %v", err)
+		return nil, nil, nil, fmt.Errorf("error creating stdout pipe: %v", err)
 	}
+	stderr, err = cmd.StderrPipe()
+	if err != nil {
+		_ = stdout.Close()
+		return nil, nil, nil, fmt.Errorf("error creating stderr pipe: %v", err)
+	}
+	stdin, err = cmd.StdinPipe()
+	if err != nil {
+		_ = stdout.Close()
+		_ = stderr.Close()
+		return nil, nil, nil, fmt.Errorf("error creating stdin pipe: %v", err)
+	}
+	return stdout, stderr, stdin, nil
+}
+
+// watchStdout watches the subprocess' stdout.
+// It broadcasts StdoutLineEvent whenever the process emits a line.
+func (self *SubprocessContext) watchStdout(pipe io.ReadCloser, readers *sync.WaitGroup) {
+	readers.Add(1)
 	go func() {
+		defer readers.Done()
 		defer func(pipe io.ReadCloser) {
 			_ = pipe.Close()
 		}(pipe)
-		scanner := bufio.NewScanner(pipe)
-		for scanner.Scan() {
-			self.StdoutLineEvent.Broadcast(scanner.Text())
-		}
+		self.readOutput("stdout", pipe, self.StdoutLineEvent.Broadcast)
 	}()
-	return nil
 }
 
 // watchStderr watches the subprocess' stderr.
 // It broadcasts StderrLineEvent whenever the process emits a line.
-func (self *SubprocessContext) watchStderr() error {
-	pipe, err := self.cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("error creating stderr pipe: %v", err)
-	}
+func (self *SubprocessContext) watchStderr(pipe io.ReadCloser, readers *sync.WaitGroup) {
+	readers.Add(1)
 	go func() {
+		defer readers.Done()
 		defer func(pipe io.ReadCloser) {
 			_ = pipe.Close()
 		}(pipe)
-		scanner := bufio.NewScanner(pipe)
-		for scanner.Scan() {
-			self.StderrLineEvent.Broadcast(scanner.Text())
-		}
+		self.readOutput("stderr", pipe, self.StderrLineEvent.Broadcast)
 	}()
-	return nil
 }
 
-// listenStdin writes data to the subprocess' stdin whenever a WriteStdinLineEvent is emitted.
-func (self *SubprocessContext) listenStdin() error {
-	pipe, err := self.cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("error creating stdin pipe: %v", err)
-	}
-	writer := bufio.NewWriter(pipe)
+// StartInput starts writing the lines of WriteStdinLineEvent to the
+// subprocess, if it wasn't already started. Start calls it, so it only needs
+// to be called when lines are written to an InputWriter without running the
+// subprocess, e.g. when following a log file.
+func (self *SubprocessContext) StartInput() {
+	self.stdinOnce.Do(self.listenStdin)
+}
 
+// listenStdin writes data to the subprocess' stdin, or to its InputWriter, whenever a WriteStdinLineEvent is emitted.
+// The listener is shared by every run of the subprocess. Lines emitted while no subprocess is running are dropped.
+func (self *SubprocessContext) listenStdin() {
+	lineCh := self.WriteStdinLineEvent.Listen()
 	go func() {
-		defer func(pipe io.WriteCloser) {
-			_ = pipe.Close()
-		}(pipe)
-
-		lineCh := self.WriteStdinLineEvent.Listen()
 		defer self.WriteStdinLineEvent.Off(lineCh)
 
 		for line := range lineCh {
-			_, _ = writer.WriteString(line)
-			_ = writer.Flush()
+			line = self.encoding.encodeInput(line)
+			if self.input != nil {
+				if err := self.input.WriteLine(strings.TrimSuffix(line, "\n")); err != nil {
+					self.logger.Printf("[error] error writing line to subprocess: %v\n", err)
+				}
+				continue
+			}
+			self.mutex.Lock()
+			stdin := self.stdin
+			self.mutex.Unlock()
+			if stdin == nil {
+				self.logger.Printf("[debug] Subprocess is not running, dropping stdin line: %q\n", line)
+				continue
+			}
+			_, _ = io.WriteString(stdin, line)
+		}
+		// The subprocess won't be started again.
+		if self.input != nil {
+			if err := self.input.Close(); err != nil {
+				self.logger.Printf("[error] error closing input: %v\n", err)
+			}
 		}
 	}()
-	return nil
 }
 
 // watchSubprocessExit waits for the subprocess to exit.
 // When the subprocess exits, it emits ExitEvent.
-func (self *SubprocessContext) watchSubprocessExit() {
-	err := self.cmd.Wait()
-
-	// Subprocess exited
-	// Now we can check for the subprocess' exit code, and exit our own process with that same exit code.
-	if exitError, ok := err.(*exec.ExitError); ok {
-		// Subprocess exited abnormally - copy the exit code.
-		waitStatus := exitError.Sys().(syscall.WaitStatus)
-		exitCode := waitStatus.ExitStatus()
-
-		log.Printf("[debug] Subprocess exited abnormally with code %d, emitting exit event\n", exitCode)
-		self.ExitEvent.Broadcast(exitCode)
-	} else if err != nil {
-		// Another type of error occurred while waiting for the command.
-		// This is probably a programming error.
-		log.Panicln("Error: Waiting for subcommand caused an error:", err)
-	} else {
-		// Subprocess exited normally
-		log.Println("[debug] Subprocess exited normally, emitting exit event")
-		self.ExitEvent.Broadcast(0)
-	}
-}
+//
+// Parameters:
+//
+//	exited: closed once the subprocess has exited.
+//	readers: tracks the goroutines reading the output pipes.
+//	pipes: output pipes, closed if they haven't drained in time.
+func (self *SubprocessContext) watchSubprocessExit(
+	cmd *exec.Cmd,
+	exited chan struct{},
+	readers *sync.WaitGroup,
+	pipes ...io.Closer,
+) {
+	state, err := cmd.Process.Wait()
+	close(exited)
 
-// relaySignalsToSubprocessUntilExit continuously relays the current process' signals to the specified command.
-// When ExitEvent is broadcast, the function exits.
-func (self *SubprocessContext) relaySignalsToSubprocessUntilExit() {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh)
+	// Let the readers broadcast the last lines before announcing the exit.
+	drained := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(pipeDrainTimeout):
+		self.logger.Println("[debug] Subprocess output pipes did not drain in time, closing them")
+		for _, pipe := range pipes {
+			_ = pipe.Close()
+		}
+	}
 
-	exitCh := self.ExitEvent.Listen()
-	defer self.ExitEvent.Off(exitCh)
+	self.mutex.Lock()
+	_ = self.stdin.Close()
+	self.stdin = nil
+	self.ptyMaster = nil
+	self.cmd = nil
+	status := newExitStatus(state, err, time.Since(self.startedAt))
+	self.mutex.Unlock()
 
-	for {
-		select {
-		case sig := <-sigCh:
-			// We received a signal, let's try passing it to the subprocess
-			if err := self.cmd.Process.Signal(sig); err != nil {
-				// Not clear how we can hit this, but probably not
-				// worth terminating the child.
-				log.Printf("[debug] Couldn't send signal \"%v\" to subprocess: %v\n", sig, err)
-			}
-		case <-exitCh:
-			break
-		}
+	if err != nil {
+		self.logger.Println("[error] error waiting for subprocess:", err)
+	}
+	if status.Success() {
+		self.logger.Println("[debug] Subprocess exited normally, emitting exit event")
+	} else {
+		self.logger.Printf("[debug] Subprocess %v, emitting exit event\n", status)
 	}
+	self.ExitEvent.Broadcast(status)
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RestartMode tells the Supervisor when to restart an exited subprocess.
+type RestartMode string
+
+const (
+	RestartNever     RestartMode = "never"      // Never restart the subprocess
+	RestartOnFailure RestartMode = "on-failure" // Restart the subprocess if it exited with a non-zero code
+	RestartAlways    RestartMode = "always"     // Restart the subprocess whenever it exits
+)
+
+// RestartPolicy configures how a Supervisor restarts its subprocess.
+type RestartPolicy struct {
+	Mode        RestartMode  // When to restart the subprocess
+	Delay       ext.Duration // Delay before the first restart, doubled for each further restart within Window
+	MaxDelay    ext.Duration // Upper bound of the restart delay
+	MaxRestarts int          // Give up after this many restarts within Window. 0 means never give up.
+	Window      ext.Duration // Time window in which restarts are counted
+}
+
+// DefaultRestartPolicy returns the restart policy used when none is configured.
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Mode:        RestartNever,
+		Delay:       ext.Duration{Duration: time.Second},
+		MaxDelay:    ext.Duration{Duration: time.Minute},
+		MaxRestarts: 5,
+		Window:      ext.Duration{Duration: 10 * time.Minute},
+	}
+}
+
+// ParseRestartMode converts a string to a RestartMode.
+func ParseRestartMode(mode string) (RestartMode, error) {
+	switch RestartMode(mode) {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return RestartMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown restart mode %q (expected %v, %v or %v)",
+		mode, RestartNever, RestartOnFailure, RestartAlways)
+}
+
+func (mode *RestartMode) UnmarshalText(b []byte) error {
+	parsed, err := ParseRestartMode(string(b))
+	if err != nil {
+		return err
+	}
+	*mode = parsed
+	return nil
+}
+
+// SupervisorParameters holds data to be passed to NewSupervisor.
+type SupervisorParameters struct {
+	Restart  RestartPolicy              // When to restart the subprocess
+	Shutdown ShutdownConfig             // How to stop the subprocess
+	Signals  map[os.Signal]SignalAction // What to do when dgbridge receives a signal
+}
+
+// Supervisor restarts a subprocess according to a RestartPolicy, stops it
+// with the shutdown sequence and handles the signals dgbridge receives.
+type Supervisor struct {
+	subprocess       *SubprocessContext
+	policy           RestartPolicy
+	shutdown         ShutdownConfig
+	signals          map[os.Signal]SignalAction
+	restarts         []time.Time                  // Times of the restarts within the policy's window
+	mutex            sync.Mutex                   // Guards stopping, so that a stopped subprocess isn't restarted
+	stopping         bool                         // Set once Shutdown was called
+	restartRequested bool                         // Set while Restart stops the subprocess, so that it is started again
+	stopCh           chan struct{}                // Closed once Shutdown was called
+	skipStage        chan struct{}                // Skips the current stage of the shutdown sequence
+	gaveUp           bool                         // Set once the subprocess won't be restarted anymore
+	sequences        sync.WaitGroup               // Tracks the running shutdown sequences, which only start before gaveUp is set
+	NoticeEvent      ext.EventChannel[string]     // Emits human-readable notices about restarts
+	ExitEvent        ext.EventChannel[ExitStatus] // Emits when the subprocess exited and won't be restarted
+}
+
+// NewSupervisor creates a Supervisor for the specified subprocess.
+// The subprocess is not started.
+func NewSupervisor(subprocess *SubprocessContext, params SupervisorParameters) *Supervisor {
+	return &Supervisor{
+		subprocess: subprocess,
+		policy:     params.Restart,
+		shutdown:   params.Shutdown,
+		signals:    params.Signals,
+		stopCh:     make(chan struct{}),
+		skipStage:  make(chan struct{}),
+	}
+}
+
+// Start starts the subprocess and goroutines that:
+//  1. Restart it whenever it exits, until the restart policy says otherwise
+//  2. Handle the signals dgbridge receives
+func (self *Supervisor) Start() error {
+	exitCh := self.subprocess.ExitEvent.Listen()
+	err := self.subprocess.Start()
+	if err != nil {
+		self.subprocess.ExitEvent.Off(exitCh)
+		return err
+	}
+	go self.supervise(exitCh)
+	go self.relaySignalsUntilExit(self.signals)
+	return nil
+}
+
+// supervise waits for the subprocess to exit and restarts it.
+// When the subprocess won't be restarted anymore, it closes the subprocess'
+// events, so that their listeners finish, and emits ExitEvent.
+func (self *Supervisor) supervise(exitCh <-chan ExitStatus) {
+	defer self.subprocess.ExitEvent.Off(exitCh)
+
+	for status := range exitCh {
+		self.subprocess.ReapLeftovers()
+		if self.takeRestartRequest() && !self.isStopping() {
+			// Restart asked for the exit. If starting again fails, the
+			// retries count as crashes.
+			if self.startRequested() || self.restart(status) {
+				continue
+			}
+			self.giveUp(status)
+			return
+		}
+		if !self.shouldRestart(status) || !self.restart(status) {
+			self.giveUp(status)
+			return
+		}
+	}
+}
+
+// giveUp closes the subprocess' events and emits ExitEvent once the
+// subprocess won't be restarted anymore, then closes the supervisor's events.
+func (self *Supervisor) giveUp(status ExitStatus) {
+	self.subprocess.Close()
+	self.mutex.Lock()
+	self.gaveUp = true
+	self.mutex.Unlock()
+	// The subprocess exited, so the shutdown sequences end with their last
+	// notice right away.
+	self.sequences.Wait()
+	self.NoticeEvent.Close()
+	self.ExitEvent.Broadcast(status)
+	self.ExitEvent.Close()
+}
+
+// shouldRestart tells whether the policy asks for a restart after the subprocess exited with status.
+func (self *Supervisor) shouldRestart(status ExitStatus) bool {
+	if self.subprocess.StopRequested() || self.isStopping() {
+		return false
+	}
+	switch self.policy.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return !status.Success()
+	default:
+		return false
+	}
+}
+
+// restart waits for the backoff delay and starts the subprocess again.
+// Failed start attempts count as crashes.
+//
+// Returns:
+//
+//	false if the supervisor gave up restarting the subprocess.
+func (self *Supervisor) restart(status ExitStatus) bool {
+	reason := status.String()
+	for {
+		now := time.Now()
+		self.pruneRestarts(now)
+		if self.policy.MaxRestarts > 0 && len(self.restarts) >= self.policy.MaxRestarts {
+			self.notice(fmt.Sprintf(":x: Server %v. Giving up after %d crashes in %v.",
+				reason, len(self.restarts), self.policy.Window))
+			return false
+		}
+
+		delay := self.backoff(len(self.restarts))
+		self.notice(fmt.Sprintf(":warning: Server %v. Restarting in %v.", reason, delay))
+		select {
+		case <-time.After(delay):
+		case <-self.stopCh:
+			return false
+		}
+		self.restarts = append(self.restarts, time.Now())
+
+		self.mutex.Lock()
+		if self.stopping {
+			self.mutex.Unlock()
+			return false
+		}
+		err := self.subprocess.Start()
+		self.mutex.Unlock()
+		if err == nil {
+			self.notice(":arrows_counterclockwise: Server restarted.")
+			return true
+		}
+		self.subprocess.logger.Println("[error] error restarting subprocess:", err)
+		reason = fmt.Sprintf("failed to start (%v)", err)
+	}
+}
+
+// takeRestartRequest reports whether Restart stopped the subprocess, and
+// clears the request.
+func (self *Supervisor) takeRestartRequest() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	requested := self.restartRequested
+	self.restartRequested = false
+	return requested
+}
+
+// startRequested starts the subprocess again after Restart stopped it.
+//
+// Returns:
+//
+//	false if the subprocess couldn't be started, or Shutdown was called in
+//	the meantime.
+func (self *Supervisor) startRequested() bool {
+	self.mutex.Lock()
+	if self.stopping {
+		self.mutex.Unlock()
+		return false
+	}
+	err := self.subprocess.Start()
+	self.mutex.Unlock()
+	if err != nil {
+		self.subprocess.logger.Println("[error] error restarting subprocess:", err)
+		return false
+	}
+	self.notice(":arrows_counterclockwise: Server restarted.")
+	return true
+}
+
+// isStopping reports whether Shutdown was called.
+func (self *Supervisor) isStopping() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.stopping
+}
+
+// pruneRestarts forgets the restarts that fell out of the policy's window.
+func (self *Supervisor) pruneRestarts(now time.Time) {
+	var kept []time.Time
+	for _, t := range self.restarts {
+		if now.Sub(t) < self.policy.Window.Duration {
+			kept = append(kept, t)
+		}
+	}
+	self.restarts = kept
+}
+
+// backoff returns the delay before the next restart, given how many restarts
+// already happened within the policy's window.
+func (self *Supervisor) backoff(restarts int) time.Duration {
+	delay := self.policy.Delay.Duration
+	maxDelay := self.policy.MaxDelay.Duration
+	for i := 0; i < restarts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// notice logs a message and emits it as a NoticeEvent.
+func (self *Supervisor) notice(message string) {
+	self.subprocess.logger.Println("[info]", message)
+	self.NoticeEvent.Broadcast(message)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSupervisorBackoff(t *testing.T) {
+	supervisor := NewSupervisor(nil, SupervisorParameters{
+		Restart: RestartPolicy{
+			Delay:    ext.Duration{Duration: time.Second},
+			MaxDelay: ext.Duration{Duration: 10 * time.Second},
+		},
+	})
+	tests := []struct {
+		Restarts int
+		Expect   time.Duration
+	}{
+		{Restarts: 0, Expect: time.Second},
+		{Restarts: 1, Expect: 2 * time.Second},
+		{Restarts: 3, Expect: 8 * time.Second},
+		{Restarts: 4, Expect: 10 * time.Second},
+		{Restarts: 100, Expect: 10 * time.Second},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Expect, supervisor.backoff(test.Restarts))
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"false"}},
+	})
+	supervisor := NewSupervisor(&subprocess, SupervisorParameters{
+		Restart: RestartPolicy{
+			Mode:        RestartOnFailure,
+			Delay:       ext.Duration{Duration: time.Millisecond},
+			MaxDelay:    ext.Duration{Duration: time.Millisecond},
+			MaxRestarts: 2,
+			Window:      ext.Duration{Duration: time.Minute},
+		},
+	})
+	exitCh := supervisor.ExitEvent.Listen()
+	defer supervisor.ExitEvent.Off(exitCh)
+	lineCh := subprocess.StdoutLineEvent.Listen()
+
+	assert.NoError(t, supervisor.Start())
+	select {
+	case status := <-exitCh:
+		assert.Equal(t, 1, status.Code)
+		assert.Len(t, supervisor.restarts, 2)
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+	// The subprocess won't run again, so its events are closed.
+	_, ok := <-lineCh
+	assert.False(t, ok)
+	assert.True(t, subprocess.WriteStdinLineEvent.Closed())
+}
+
+func TestForwardedSignals(t *testing.T) {
+	tests := []struct {
+		Signal        os.Signal
+		StopRequested bool
+	}{
+		{Signal: syscall.SIGHUP, StopRequested: false},
+		{Signal: syscall.SIGQUIT, StopRequested: false},
+		{Signal: syscall.SIGTERM, StopRequested: true},
+	}
+	for _, test := range tests {
+		subprocess := NewSubprocess(SubprocessParameters{
+			Command: CommandSpec{Argv: []string{"sh", "-c",
+				`trap "echo got it" HUP QUIT TERM; echo ready; while :; do sleep 0.05; done`}},
+		})
+		supervisor := NewSupervisor(&subprocess, SupervisorParameters{})
+		lineCh := subprocess.StdoutLineEvent.Listen()
+		assert.NoError(t, subprocess.Start())
+		assert.Equal(t, []string{"ready"}, receiveLines(t, lineCh, 1))
+
+		// Forwarding a signal only keeps the subprocess from being restarted
+		// if it asks the subprocess to terminate.
+		supervisor.handleSignal(test.Signal, SignalAction{Kind: SignalForward})
+		assert.Equal(t, []string{"got it"}, receiveLines(t, lineCh, 1), test.Signal)
+		assert.Equal(t, test.StopRequested, subprocess.StopRequested(), test.Signal)
+
+		assert.NoError(t, subprocess.Signal(syscall.SIGKILL))
+		subprocess.StdoutLineEvent.Off(lineCh)
+	}
+}
+
+func TestShutdownStdinBlocked(t *testing.T) {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sleep", "10"}},
+	})
+	supervisor := NewSupervisor(&subprocess, SupervisorParameters{
+		Shutdown: ShutdownConfig{
+			StopCommand: "stop",
+			StopTimeout: ext.Duration{Duration: 100 * time.Millisecond},
+			TermTimeout: ext.Duration{Duration: time.Second},
+		},
+	})
+	noticeCh := supervisor.NoticeEvent.Listen()
+	defer supervisor.NoticeEvent.Off(noticeCh)
+	// Nothing receives the stop command, like a full stdin pipe.
+	blocked := subprocess.WriteStdinLineEvent.Listen()
+	defer subprocess.WriteStdinLineEvent.Off(blocked)
+
+	assert.NoError(t, supervisor.Start())
+	go supervisor.Shutdown(nil)
+	var notices []string
+	for len(notices) < 4 {
+		select {
+		case notice := <-noticeCh:
+			notices = append(notices, notice)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notices, got %q", notices)
+		}
+	}
+	assert.Equal(t, []string{
+		":octagonal_sign: Stopping server: sent `stop` command.",
+		":warning: Server did not stop within 100ms.",
+		":octagonal_sign: Stopping server: sent SIGTERM.",
+		":white_check_mark: Server stopped.",
+	}, notices)
+}
+
+// closingInput is an InputWriter that records whether it was closed.
+type closingInput struct {
+	closed chan struct{}
+}
+
+func (self *closingInput) WriteLine(string) error {
+	return nil
+}
+
+func (self *closingInput) Close() error {
+	close(self.closed)
+	return nil
+}
+
+func TestEventsClosedAfterGivingUp(t *testing.T) {
+	input := &closingInput{closed: make(chan struct{})}
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sh", "-c", "sleep 0.2; exit 1"}},
+		Input:   input,
+	})
+	supervisor := NewSupervisor(&subprocess, SupervisorParameters{Restart: RestartPolicy{Mode: RestartNever}})
+	monitor, err := NewMonitor(&subprocess, MonitorConfig{Enabled: true, Interval: ext.Duration{Duration: 10 * time.Millisecond}})
+	assert.NoError(t, err)
+	cron, err := ext.ParseCron("* * * * *")
+	assert.NoError(t, err)
+	scheduler, err := NewScheduler(&subprocess, monitor, []ScheduledJob{{Name: "job", Cron: cron}})
+	assert.NoError(t, err)
+	crashes := NewCrashReporter(&subprocess, CrashReportConfig{Enabled: true, Lines: 10}, "")
+	watchdog := NewWatchdog(&subprocess, supervisor, WatchdogConfig{OutputTimeout: ext.Duration{Duration: time.Minute}})
+
+	crashes.Start()
+	monitor.Start()
+	watchdog.Start()
+	assert.NoError(t, supervisor.Start())
+	scheduler.Start()
+	go supervisor.Shutdown(nil)
+
+	closed := map[string]func() bool{
+		"NoticeEvent":   supervisor.NoticeEvent.Closed,
+		"ExitEvent":     supervisor.ExitEvent.Closed,
+		"AnnounceEvent": scheduler.AnnounceEvent.Closed,
+		"CrashEvent":    crashes.CrashEvent.Closed,
+		"MonitorAlerts": monitor.AlertEvent.Closed,
+		"WatchdogAlert": watchdog.AlertEvent.Closed,
+	}
+	for name, isClosed := range closed {
+		assert.Eventually(t, isClosed, 5*time.Second, 10*time.Millisecond, name)
+	}
+	select {
+	case <-input.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the input wasn't closed")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+// This file implements the watchdog, which detects a server that is still
+// running but hung: it stopped writing output, or it doesn't answer probes.
+
+import (
+	"dgbridge/src/ext"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchdogAction tells the watchdog what to do with a hung subprocess.
+type WatchdogAction string
+
+const (
+	WatchdogAlert   WatchdogAction = "alert"   // Post an alert to Discord
+	WatchdogRestart WatchdogAction = "restart" // Restart the subprocess with the shutdown sequence
+)
+
+// ParseWatchdogAction converts a string to a WatchdogAction.
+func ParseWatchdogAction(action string) (WatchdogAction, error) {
+	switch WatchdogAction(action) {
+	case WatchdogAlert, WatchdogRestart:
+		return WatchdogAction(action), nil
+	}
+	return "", fmt.Errorf("unknown watchdog action %q (expected %v or %v)", action, WatchdogAlert, WatchdogRestart)
+}
+
+func (action *WatchdogAction) UnmarshalText(b []byte) error {
+	parsed, err := ParseWatchdogAction(string(b))
+	if err != nil {
+		return err
+	}
+	*action = parsed
+	return nil
+}
+
+// WatchdogConfig configures detecting a hung subprocess. The watchdog is
+// disabled unless OutputTimeout or a probe is set.
+type WatchdogConfig struct {
+	OutputTimeout ext.Duration   // The subprocess is hung if it writes no output for this long. 0 disables it.
+	Probe         ProbeConfig    // Active check of the subprocess
+	Action        WatchdogAction // What to do with a hung subprocess: alert or restart
+	Grace         ext.Duration   // Time the subprocess has to start up before it is checked
+	ChannelId     string         // Channel that alerts are posted to. Empty means the relay channel.
+}
+
+// ProbeConfig configures an active check of the subprocess: a command
+// written to its stdin that must be answered with a matching output line,
+// and/or a TCP connection to its port. The probe is disabled unless Stdin or
+// Tcp is set.
+type ProbeConfig struct {
+	Stdin    string       // Harmless command written to stdin, e.g. "list"
+	Expect   ext.Regexp   // Output line expected in response to Stdin. Empty means any line.
+	Tcp      string       // host:port that must accept a connection, e.g. localhost:25565
+	Interval ext.Duration // Time between probes
+	Timeout  ext.Duration // How long to wait for the response or the connection
+	Failures int          // Number of failed probes in a row after which the subprocess is hung
+}
+
+// DefaultWatchdogConfig returns the watchdog settings used when none are configured.
+func DefaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		Action: WatchdogAlert,
+		Grace:  ext.Duration{Duration: 2 * time.Minute},
+		Probe: ProbeConfig{
+			Interval: ext.Duration{Duration: time.Minute},
+			Timeout:  ext.Duration{Duration: 10 * time.Second},
+			Failures: 3,
+		},
+	}
+}
+
+// Enabled reports whether the subprocess is watched.
+func (self *WatchdogConfig) Enabled() bool {
+	return self.OutputTimeout.Duration > 0 || self.Probe.Enabled()
+}
+
+// Enabled reports whether the subprocess is probed.
+func (self *ProbeConfig) Enabled() bool {
+	return self.Stdin != "" || self.Tcp != ""
+}
+
+// Watchdog watches the output of a subprocess and probes it, and alerts or
+// restarts it when it seems to be hung.
+type Watchdog struct {
+	config     WatchdogConfig
+	subprocess *SubprocessContext
+	supervisor *Supervisor
+	tick       time.Duration     // How often the state is checked
+	alerts     chan Announcement // Alerts waiting to be emitted, in order
+	writing    atomic.Bool       // A probe is writing to stdin
+	AlertEvent ext.EventChannel[Announcement]
+
+	// The state of the current run, only used by run.
+	startedAt  time.Time // When the current run started, zero if none is running
+	lastOutput time.Time // When the subprocess last wrote a line
+	nextProbe  time.Time // When to start the next probe
+	probe      *watchdogProbe
+	failures   int    // Failed probes in a row
+	hung       string // Why the subprocess is hung, empty if it isn't
+	silent     bool   // The subprocess is hung because it wrote no output
+}
+
+// watchdogProbe is a probe in progress.
+type watchdogProbe struct {
+	response  chan struct{} // Closed when the expected response is read
+	closeOnce sync.Once
+}
+
+// probeResult is the outcome of a probe.
+type probeResult struct {
+	probe *watchdogProbe
+	err   error // nil if the probe succeeded
+}
+
+// NewWatchdog creates a Watchdog for the specified subprocess. Nothing is
+// checked until Start is called.
+func NewWatchdog(subprocess *SubprocessContext, supervisor *Supervisor, config WatchdogConfig) *Watchdog {
+	defaults := DefaultWatchdogConfig()
+	if config.Probe.Interval.Duration <= 0 {
+		config.Probe.Interval = defaults.Probe.Interval
+	}
+	if config.Probe.Timeout.Duration <= 0 {
+		config.Probe.Timeout = defaults.Probe.Timeout
+	}
+	if config.Probe.Failures <= 0 {
+		config.Probe.Failures = defaults.Probe.Failures
+	}
+	return &Watchdog{
+		config:     config,
+		subprocess: subprocess,
+		supervisor: supervisor,
+		tick:       time.Second,
+		alerts:     make(chan Announcement, 16),
+	}
+}
+
+// Start starts watching the subprocess in a goroutine, if the watchdog is
+// enabled. It must be called before the subprocess is started. AlertEvent is
+// closed once the subprocess' events are.
+func (self *Watchdog) Start() {
+	if !self.config.Enabled() {
+		self.AlertEvent.Close()
+		return
+	}
+	stdoutCh := self.subprocess.StdoutLineEvent.Listen()
+	stderrCh := self.subprocess.StderrLineEvent.Listen()
+	go self.run(stdoutCh, stderrCh)
+	go self.emitAlerts()
+}
+
+// run watches the subprocess until its events are closed.
+func (self *Watchdog) run(stdoutCh <-chan string, stderrCh <-chan string) {
+	defer self.subprocess.StdoutLineEvent.Off(stdoutCh)
+	defer self.subprocess.StderrLineEvent.Off(stderrCh)
+	defer close(self.alerts)
+	// Buffered, so that a probe still running when run returns can finish.
+	results := make(chan probeResult, 1)
+	ticker := time.NewTicker(self.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-stdoutCh:
+			if !ok {
+				return
+			}
+			self.output(line)
+		case line, ok := <-stderrCh:
+			if !ok {
+				return
+			}
+			self.output(line)
+		case result := <-results:
+			self.probeDone(result)
+		case now := <-ticker.C:
+			self.check(now, results)
+		}
+	}
+}
+
+// output records a line of output.
+func (self *Watchdog) output(line string) {
+	self.lastOutput = time.Now()
+	expect := self.config.Probe.Expect
+	if self.probe != nil && (expect.Regexp == nil || expect.MatchString(ext.StripTerminalSequences(line))) {
+		self.probe.closeOnce.Do(func() { close(self.probe.response) })
+	}
+	if self.silent {
+		self.recovered()
+	}
+}
+
+// check checks whether the subprocess is hung, and starts a probe when it is due.
+func (self *Watchdog) check(now time.Time, results chan<- probeResult) {
+	pid, startedAt := self.subprocess.Pid()
+	if pid == 0 || self.supervisor.isStopping() {
+		self.startedAt = time.Time{}
+		return
+	}
+	if startedAt != self.startedAt {
+		// A new run, which gets a fresh start.
+		self.startedAt = startedAt
+		self.lastOutput = startedAt
+		self.nextProbe = startedAt.Add(self.config.Grace.Duration)
+		self.probe = nil
+		self.failures = 0
+		self.hung = ""
+		self.silent = false
+	}
+	if now.Sub(startedAt) < self.config.Grace.Duration {
+		return
+	}
+	timeout := self.config.OutputTimeout.Duration
+	if timeout > 0 && now.Sub(self.lastOutput) >= timeout {
+		self.detected(fmt.Sprintf("no output for %v", timeout), true)
+	}
+	if self.config.Probe.Enabled() && self.probe == nil && !now.Before(self.nextProbe) {
+		probe := &watchdogProbe{response: make(chan struct{})}
+		self.probe = probe
+		go func() {
+			results <- probeResult{probe: probe, err: self.runProbe(probe)}
+		}()
+	}
+}
+
+// runProbe probes the subprocess.
+//
+// Returns:
+//
+//	nil if the subprocess passed the probe, or why it failed.
+func (self *Watchdog) runProbe(probe *watchdogProbe) error {
+	config := &self.config.Probe
+	if config.Tcp != "" {
+		conn, err := net.DialTimeout("tcp", config.Tcp, config.Timeout.Duration)
+		if err != nil {
+			return fmt.Errorf("can't connect to %v", config.Tcp)
+		}
+		_ = conn.Close()
+	}
+	if config.Stdin == "" {
+		return nil
+	}
+	timeout := time.After(config.Timeout.Duration)
+	// The stdin pipe of a hung subprocess may be full, so the command is
+	// written from another goroutine, and not written again while an earlier
+	// write is stuck.
+	if self.writing.CompareAndSwap(false, true) {
+		go func() {
+			defer self.writing.Store(false)
+			self.subprocess.WriteStdinLineEvent.Broadcast(config.Stdin + "\n")
+		}()
+	}
+	select {
+	case <-probe.response:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("no response to `%v` within %v", config.Stdin, config.Timeout)
+	}
+}
+
+// probeDone handles the result of a probe.
+func (self *Watchdog) probeDone(result probeResult) {
+	if result.probe != self.probe {
+		// The probe was for a run that is over.
+		return
+	}
+	self.probe = nil
+	self.nextProbe = time.Now().Add(self.config.Probe.Interval.Duration)
+	if result.err == nil {
+		self.failures = 0
+		if self.hung != "" && !self.silent {
+			self.recovered()
+		}
+		return
+	}
+	self.failures++
+	self.subprocess.logger.Printf("[warn] Watchdog probe failed (%d/%d): %v\n",
+		self.failures, self.config.Probe.Failures, result.err)
+	if self.failures >= self.config.Probe.Failures {
+		self.detected(result.err.Error(), false)
+	}
+}
+
+// detected takes the configured action once the subprocess is found hung.
+// Nothing more happens until it recovers or is restarted.
+//
+// Parameters:
+//
+//	silent: the subprocess was found hung because it wrote no output, so
+//	that it recovers once it writes a line.
+func (self *Watchdog) detected(reason string, silent bool) {
+	if self.hung != "" {
+		return
+	}
+	self.hung = reason
+	self.silent = silent
+	self.subprocess.logger.Printf("[warn] Server seems to be hung: %v\n", reason)
+	switch self.config.Action {
+	case WatchdogRestart:
+		go self.supervisor.Restart(reason)
+	default:
+		self.alert(fmt.Sprintf(":warning: Server seems to be hung: %v.", reason))
+	}
+}
+
+// recovered reports that the subprocess responds again after it was found hung.
+func (self *Watchdog) recovered() {
+	self.subprocess.logger.Printf("[info] Server responds again\n")
+	if self.config.Action != WatchdogRestart {
+		self.alert(":white_check_mark: Server responds again.")
+	}
+	self.hung = ""
+	self.silent = false
+}
+
+// alert emits an alert, without blocking the watchdog. Alerts that don't fit
+// in the queue are dropped.
+func (self *Watchdog) alert(content string) {
+	select {
+	case self.alerts <- Announcement{ChannelId: self.config.ChannelId, Content: content}:
+	default:
+		self.subprocess.logger.Printf("[warn] Too many watchdog alerts, dropping: %v\n", content)
+	}
+}
+
+// emitAlerts emits the queued alerts one at a time, so that they are received
+// in order, until run returns.
+func (self *Watchdog) emitAlerts() {
+	defer self.AlertEvent.Close()
+	for alert := range self.alerts {
+		self.AlertEvent.Broadcast(alert)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// startWatchdog runs a shell script as a supervised subprocess with a
+// watchdog that checks it often.
+func startWatchdog(t *testing.T, script string, config WatchdogConfig) (*Watchdog, <-chan Announcement) {
+	subprocess := NewSubprocess(SubprocessParameters{
+		Command: CommandSpec{Argv: []string{"sh", "-c", script}},
+	})
+	supervisor := NewSupervisor(&subprocess, SupervisorParameters{
+		Restart:  DefaultRestartPolicy(),
+		Shutdown: ShutdownConfig{TermTimeout: ext.Duration{Duration: time.Second}},
+	})
+	watchdog := NewWatchdog(&subprocess, supervisor, config)
+	watchdog.tick = 20 * time.Millisecond
+	alertCh := watchdog.AlertEvent.Listen()
+	t.Cleanup(func() { watchdog.AlertEvent.Off(alertCh) })
+	watchdog.Start()
+	assert.NoError(t, supervisor.Start())
+	t.Cleanup(func() {
+		go supervisor.Shutdown(nil)
+		<-subprocess.Exited()
+	})
+	return watchdog, alertCh
+}
+
+func receiveAlert(t *testing.T, alertCh <-chan Announcement) string {
+	select {
+	case alert := <-alertCh:
+		return alert.Content
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert")
+		return ""
+	}
+}
+
+func TestWatchdogOutputTimeout(t *testing.T) {
+	_, alertCh := startWatchdog(t, "echo starting; sleep 0.5; echo back; sleep 10", WatchdogConfig{
+		OutputTimeout: ext.Duration{Duration: 200 * time.Millisecond},
+		Action:        WatchdogAlert,
+	})
+	assert.Equal(t, ":warning: Server seems to be hung: no output for 200ms.", receiveAlert(t, alertCh))
+	assert.Equal(t, ":white_check_mark: Server responds again.", receiveAlert(t, alertCh))
+}
+
+func TestWatchdogStdinProbe(t *testing.T) {
+	probe := ProbeConfig{
+		Stdin:    "list",
+		Expect:   ext.Regexp{Regexp: regexp.MustCompile(`There are \d+ players`)},
+		Interval: ext.Duration{Duration: 50 * time.Millisecond},
+		Timeout:  ext.Duration{Duration: 100 * time.Millisecond},
+		Failures: 2,
+	}
+	t.Run("Answered", func(t *testing.T) {
+		_, alertCh := startWatchdog(t,
+			`while read line; do [ "$line" = list ] && echo "There are 0 players"; done`,
+			WatchdogConfig{Probe: probe, Action: WatchdogAlert})
+		select {
+		case alert := <-alertCh:
+			t.Fatalf("unexpected alert: %v", alert.Content)
+		case <-time.After(time.Second):
+		}
+	})
+	t.Run("Ignored", func(t *testing.T) {
+		_, alertCh := startWatchdog(t, "cat >/dev/null", WatchdogConfig{Probe: probe, Action: WatchdogAlert})
+		assert.Equal(t, ":warning: Server seems to be hung: no response to `list` within 100ms.",
+			receiveAlert(t, alertCh))
+	})
+}
+
+func TestWatchdogStdinProbeBlocked(t *testing.T) {
+	watchdog, alertCh := startWatchdog(t, "sleep 10", WatchdogConfig{
+		Probe: ProbeConfig{
+			Stdin:    "list",
+			Interval: ext.Duration{Duration: 50 * time.Millisecond},
+			Timeout:  ext.Duration{Duration: 100 * time.Millisecond},
+			Failures: 2,
+		},
+		Action: WatchdogAlert,
+	})
+	// Nothing receives the probe command, like a full stdin pipe.
+	blocked := watchdog.subprocess.WriteStdinLineEvent.Listen()
+	defer watchdog.subprocess.WriteStdinLineEvent.Off(blocked)
+	assert.Equal(t, ":warning: Server seems to be hung: no response to `list` within 100ms.",
+		receiveAlert(t, alertCh))
+}
+
+func TestWatchdogTcpProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	// Nothing listens on the port anymore.
+	_ = listener.Close()
+
+	_, alertCh := startWatchdog(t, "sleep 10", WatchdogConfig{
+		Probe: ProbeConfig{
+			Tcp:      address,
+			Interval: ext.Duration{Duration: 50 * time.Millisecond},
+			Failures: 1,
+		},
+		Action: WatchdogAlert,
+	})
+	assert.Equal(t, ":warning: Server seems to be hung: can't connect to "+address+".", receiveAlert(t, alertCh))
+}
+
+func TestWatchdogRestart(t *testing.T) {
+	watchdog, _ := startWatchdog(t, "echo starting; sleep 10", WatchdogConfig{
+		OutputTimeout: ext.Duration{Duration: 200 * time.Millisecond},
+		Action:        WatchdogRestart,
+	})
+	noticeCh := watchdog.supervisor.NoticeEvent.Listen()
+	defer watchdog.supervisor.NoticeEvent.Off(noticeCh)
+	_, startedAt := watchdog.subprocess.Pid()
+
+	var notices []string
+	timeout := time.After(5 * time.Second)
+	for len(notices) == 0 || notices[len(notices)-1] != ":arrows_counterclockwise: Server restarted." {
+		select {
+		case notice := <-noticeCh:
+			notices = append(notices, notice)
+		case <-timeout:
+			t.Fatalf("the server wasn't restarted, notices: %v", notices)
+		}
+	}
+	assert.Equal(t, ":arrows_counterclockwise: Restarting server: no output for 200ms.", notices[0])
+	assert.Contains(t, notices, ":octagonal_sign: Stopping server: sent SIGTERM.")
+	_, restartedAt := watchdog.subprocess.Pid()
+	assert.True(t, restartedAt.After(startedAt))
+}
@@ -0,0 +1,229 @@
+package ext
+
+// This file implements converting the colors of terminal output to the ones
+// that Discord's ```ansi code blocks support: bold, underline, and 8
+// foreground and background colors.
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// AnsiText is a line of terminal output whose colors were converted by
+// ConvertAnsiColors.
+type AnsiText struct {
+	Plain   string // Text without escape sequences
+	Colored string // Text with the SGR sequences that Discord supports
+	offsets []int  // offsets[i] is the index in Colored of byte i of Plain, or of the sequence before it. The last entry is len(Colored).
+	styles  []ansiStyleChange
+}
+
+// ansiStyleChange records that the style changes at a byte of AnsiText.Plain.
+type ansiStyleChange struct {
+	at    int
+	style ansiStyle
+}
+
+// ansiStyle holds the text attributes that Discord supports.
+type ansiStyle struct {
+	bold       bool
+	underline  bool
+	foreground int // 30-37, or 0 for the default color
+	background int // 40-47, or 0 for the default color
+}
+
+// ansiReset is the SGR sequence that resets the style.
+const ansiReset = "\x1b[0m"
+
+// ConvertAnsiColors removes the terminal control sequences from a line like
+// StripTerminalSequences, and converts its colors to the ones that Discord
+// supports. Bright colors are shown as the normal ones, 256 colors and RGB
+// colors as the closest of the 8 basic colors, and other attributes, like
+// italics, are dropped.
+func ConvertAnsiColors(line string) AnsiText {
+	line = StripTerminalSequencesKeepColors(line)
+	var text AnsiText
+	var plain, colored strings.Builder
+	var current, written ansiStyle
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == esc {
+			end := skipEscapeSequence(runes, i)
+			if isSgrSequence(runes[i : end+1]) {
+				current = current.apply(string(runes[i+2 : end]))
+			}
+			i = end
+			continue
+		}
+		// Styles are only written before the text they apply to, so that
+		// sequences that are overridden right away are dropped.
+		text.offsets = append(text.offsets, colored.Len())
+		if current != written {
+			colored.WriteString(current.sequence())
+			written = current
+			text.styles = append(text.styles, ansiStyleChange{at: plain.Len(), style: current})
+		}
+		for k := 1; k < utf8.RuneLen(r); k++ {
+			text.offsets = append(text.offsets, colored.Len()+k)
+		}
+		plain.WriteRune(r)
+		colored.WriteRune(r)
+	}
+	text.offsets = append(text.offsets, colored.Len())
+	text.Plain = plain.String()
+	text.Colored = colored.String()
+	return text
+}
+
+// Slice returns the colored text of Plain[start:end]. It starts with the
+// style of Plain[start] and ends with a reset, so that it can be inserted in
+// other text.
+func (self AnsiText) Slice(start int, end int) string {
+	if start >= end {
+		return ""
+	}
+	var result strings.Builder
+	style := self.styleAt(start)
+	// The segment starts with the style's sequence if the style changes at start.
+	segment := strings.TrimPrefix(self.Colored[self.offsets[start]:self.offsets[end]], style.sequence())
+	if style != (ansiStyle{}) {
+		result.WriteString(style.sequence())
+	}
+	result.WriteString(segment)
+	if style != (ansiStyle{}) || strings.ContainsRune(segment, esc) {
+		result.WriteString(ansiReset)
+	}
+	return result.String()
+}
+
+// styleAt returns the style of byte i of Plain.
+func (self AnsiText) styleAt(i int) ansiStyle {
+	n := sort.Search(len(self.styles), func(k int) bool {
+		return self.styles[k].at > i
+	})
+	if n == 0 {
+		return ansiStyle{}
+	}
+	return self.styles[n-1].style
+}
+
+// sequence returns the SGR sequence that sets the style.
+func (self ansiStyle) sequence() string {
+	codes := []string{"0"}
+	if self.bold {
+		codes = append(codes, "1")
+	}
+	if self.underline {
+		codes = append(codes, "4")
+	}
+	if self.foreground != 0 {
+		codes = append(codes, strconv.Itoa(self.foreground))
+	}
+	if self.background != 0 {
+		codes = append(codes, strconv.Itoa(self.background))
+	}
+	return "\x1b[" + strings.Join(codes, ";") + "m"
+}
+
+// apply returns the style after the parameters of an SGR sequence,
+// e.g. "1;31", are applied to it.
+func (self ansiStyle) apply(parameters string) ansiStyle {
+	var codes []int
+	for _, parameter := range strings.Split(parameters, ";") {
+		// An empty parameter means 0.
+		code, _ := strconv.Atoi(parameter)
+		codes = append(codes, code)
+	}
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			self = ansiStyle{}
+		case code == 1:
+			self.bold = true
+		case code == 22:
+			self.bold = false
+		case code == 4:
+			self.underline = true
+		case code == 24:
+			self.underline = false
+		case code >= 30 && code <= 37:
+			self.foreground = code
+		case code == 39:
+			self.foreground = 0
+		case code >= 40 && code <= 47:
+			self.background = code
+		case code == 49:
+			self.background = 0
+		case code >= 90 && code <= 97:
+			self.foreground = code - 60
+		case code >= 100 && code <= 107:
+			self.background = code - 60
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if color < 0 {
+				continue
+			}
+			if code == 38 {
+				self.foreground = 30 + color
+			} else {
+				self.background = 40 + color
+			}
+		}
+	}
+	return self
+}
+
+// extendedColor converts the parameters that follow 38 or 48 in an SGR
+// sequence, "5;n" for 256 colors or "2;r;g;b" for RGB colors, to the closest
+// of the 8 basic colors.
+//
+// Returns:
+//
+//	the color from 0 to 7, or -1 if the parameters are invalid, and the
+//	number of parameters used.
+func extendedColor(codes []int) (int, int) {
+	switch {
+	case len(codes) >= 2 && codes[0] == 5:
+		n := codes[1]
+		switch {
+		case n < 0 || n > 255:
+			return -1, 2
+		case n < 8:
+			return n, 2
+		case n < 16:
+			return n - 8, 2
+		case n < 232:
+			// 6x6x6 color cube
+			levels := []int{0, 95, 135, 175, 215, 255}
+			n -= 16
+			return closestColor(levels[n/36], levels[n/6%6], levels[n%6]), 2
+		default:
+			// Grayscale ramp
+			gray := 8 + (n-232)*10
+			return closestColor(gray, gray, gray), 2
+		}
+	case len(codes) >= 4 && codes[0] == 2:
+		return closestColor(codes[1], codes[2], codes[3]), 4
+	}
+	return -1, len(codes)
+}
+
+// closestColor returns the basic color, from 0 to 7, closest to an RGB color.
+func closestColor(r int, g int, b int) int {
+	color := 0
+	if r >= 128 {
+		color |= 1
+	}
+	if g >= 128 {
+		color |= 2
+	}
+	if b >= 128 {
+		color |= 4
+	}
+	return color
+}
@@ -0,0 +1,93 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConvertAnsiColors(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Input         string
+		ExpectPlain   string
+		ExpectColored string
+	}{
+		{Name: "Plain text", Input: "Hello", ExpectPlain: "Hello", ExpectColored: "Hello"},
+		{
+			Name:          "Basic colors",
+			Input:         "\x1b[1;32m[INFO]\x1b[0m Done",
+			ExpectPlain:   "[INFO] Done",
+			ExpectColored: "\x1b[0;1;32m[INFO]\x1b[0m Done",
+		},
+		{
+			Name:          "Bright colors",
+			Input:         "\x1b[91mError\x1b[39m",
+			ExpectPlain:   "Error",
+			ExpectColored: "\x1b[0;31mError",
+		},
+		{
+			Name:          "256 colors",
+			Input:         "\x1b[38;5;214mWarn\x1b[48;5;21mBlue",
+			ExpectPlain:   "WarnBlue",
+			ExpectColored: "\x1b[0;33mWarn\x1b[0;33;44mBlue",
+		},
+		{
+			Name:          "RGB colors",
+			Input:         "\x1b[38;2;0;200;200mCyan",
+			ExpectPlain:   "Cyan",
+			ExpectColored: "\x1b[0;36mCyan",
+		},
+		{
+			Name:          "Unsupported attributes",
+			Input:         "\x1b[3mItalic\x1b[23m",
+			ExpectPlain:   "Italic",
+			ExpectColored: "Italic",
+		},
+		{
+			Name:          "Overridden sequences",
+			Input:         "\x1b[31m\x1b[32m\x1b[4mA\x1b[0m\x1b[0mB\x1b[33m",
+			ExpectPlain:   "AB",
+			ExpectColored: "\x1b[0;4;32mA\x1b[0mB",
+		},
+		{
+			Name:          "Several lines",
+			Input:         "\x1b[31mError\n\tat Main",
+			ExpectPlain:   "Error\n\tat Main",
+			ExpectColored: "\x1b[0;31mError\n\tat Main",
+		},
+		{
+			Name:          "Other sequences",
+			Input:         "\x1b]0;Server\x07\x1b[2K\x1b[31mStarted",
+			ExpectPlain:   "Started",
+			ExpectColored: "\x1b[0;31mStarted",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			text := ConvertAnsiColors(test.Input)
+			assert.Equal(t, test.ExpectPlain, text.Plain)
+			assert.Equal(t, test.ExpectColored, text.Colored)
+		})
+	}
+}
+
+func TestAnsiTextSlice(t *testing.T) {
+	text := ConvertAnsiColors("\x1b[33m[12:00 INFO]\x1b[0m: \x1b[1mSteve\x1b[22m joined")
+	assert.Equal(t, "[12:00 INFO]: Steve joined", text.Plain)
+
+	tests := []struct {
+		Start  int
+		End    int
+		Expect string
+	}{
+		{Start: 0, End: 0, Expect: ""},
+		{Start: 1, End: 6, Expect: "\x1b[0;33m12:00\x1b[0m"},
+		{Start: 12, End: 14, Expect: ": "},
+		{Start: 14, End: 19, Expect: "\x1b[0;1mSteve\x1b[0m"},
+		{Start: 12, End: 26, Expect: ": \x1b[0;1mSteve\x1b[0m joined\x1b[0m"},
+		{Start: 20, End: 26, Expect: "joined"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Expect, text.Slice(test.Start, test.End))
+	}
+}
@@ -0,0 +1,66 @@
+package ext
+
+// This file declares a ByteSize type for amounts of memory. It implements
+// marshalling functions so that you can serialize and deserialize sizes such
+// as "512MiB" or "4G" from JSON.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is an amount of memory in bytes.
+type ByteSize uint64
+
+// Binary units of ByteSize. "K", "M" and "G" without "i" mean the same.
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "512MiB", "4G" or "1024".
+// Units are binary, so "1K" is 1024 bytes.
+func ParseByteSize(text string) (ByteSize, error) {
+	number := strings.TrimSpace(text)
+	unit := ByteSize(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(u.suffix)) {
+			number = strings.TrimSpace(number[:len(number)-len(u.suffix)])
+			unit = u.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", text)
+	}
+	return ByteSize(value * float64(unit)), nil
+}
+
+// String formats the size with the largest unit that fits, e.g. "1.5GiB".
+func (self ByteSize) String() string {
+	for _, u := range byteUnits[:4] {
+		if self >= u.size {
+			return strconv.FormatFloat(float64(self)/float64(u.size), 'f', 1, 64) + u.suffix
+		}
+	}
+	return strconv.FormatUint(uint64(self), 10) + "B"
+}
+
+func (self *ByteSize) UnmarshalText(b []byte) error {
+	size, err := ParseByteSize(string(b))
+	if err != nil {
+		return err
+	}
+	*self = size
+	return nil
+}
+
+func (self ByteSize) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
@@ -0,0 +1,42 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Expect ByteSize
+		Error  bool
+	}{
+		{Input: "1024", Expect: 1024},
+		{Input: "512B", Expect: 512},
+		{Input: "4K", Expect: 4096},
+		{Input: "512MiB", Expect: 512 << 20},
+		{Input: "1.5 GiB", Expect: 3 << 29},
+		{Input: "2g", Expect: 2 << 30},
+		{Input: "1T", Expect: 1 << 40},
+		{Input: "", Error: true},
+		{Input: "lots", Error: true},
+		{Input: "-1M", Error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Input, func(t *testing.T) {
+			size, err := ParseByteSize(test.Input)
+			if test.Error {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, size)
+		})
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	assert.Equal(t, "512B", ByteSize(512).String())
+	assert.Equal(t, "1.5KiB", ByteSize(1536).String())
+	assert.Equal(t, "1.5GiB", ByteSize(3<<29).String())
+}
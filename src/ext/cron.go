@@ -0,0 +1,210 @@
+package ext
+
+// This file implements parsing and evaluation of cron expressions. The
+// CronSchedule struct implements marshalling functions so that you can
+// serialize and deserialize cron expressions from JSON.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with the five standard fields:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field accepts `*`, numbers, ranges (`1-5`), lists (`1,3,5`) and steps
+// (`*/15`, `0-30/10`). Months and days of the week also accept the first three
+// letters of their English names (`jan`, `mon`). Sunday is 0 or 7.
+// As in Vixie cron, when both the day of the month and the day of the week are
+// restricted, a day matches if either of them matches.
+//
+// The descriptors @yearly, @annually, @monthly, @weekly, @daily, @midnight and
+// @hourly are accepted too.
+type CronSchedule struct {
+	expr       string
+	minute     uint64 // Bit n is set if minute n matches
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDay     bool // Day of the month is unrestricted
+	anyWeekday bool // Day of the week is unrestricted
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronWeekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (CronSchedule, error) {
+	schedule := CronSchedule{expr: expr}
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		descriptor, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return CronSchedule{}, fmt.Errorf("unknown cron descriptor %q", fields[0])
+		}
+		fields = strings.Fields(descriptor)
+	}
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("minute: %v", err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("hour: %v", err)
+	}
+	if schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("day of month: %v", err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return CronSchedule{}, fmt.Errorf("month: %v", err)
+	}
+	if schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil {
+		return CronSchedule{}, fmt.Errorf("day of week: %v", err)
+	}
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		// 7 is another name for Sunday
+		schedule.dayOfWeek |= 1
+	}
+	schedule.anyDay = strings.HasPrefix(fields[2], "*")
+	schedule.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return schedule, nil
+}
+
+// parseCronField parses a field of a cron expression.
+//
+// Parameters:
+//
+//	min, max: range of valid values.
+//	names: names of the values starting at min, or nil.
+//
+// Returns:
+//
+//	a bit set with bit n set if value n matches.
+func parseCronField(field string, min int, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		var first, last int
+		if rangePart == "*" {
+			first, last = min, max
+		} else {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			first, err = parseCronValue(startPart, min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				last, err = parseCronValue(endPart, min, max, names)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "a/n" means every n-th value starting at a.
+				last = max
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+		for value := first; value <= last; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// parseCronValue parses a single value of a cron field, either a number or a name.
+func parseCronValue(value string, min int, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return min + i, nil
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	if number < min || number > max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", number, min, max)
+	}
+	return number, nil
+}
+
+// Next returns the first time after t that matches the schedule.
+// Returns the zero time if no time matches within the next five years,
+// e.g. for February 30th.
+func (c CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether the day of t matches the day of the month and day of the week fields.
+func (c CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := c.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := c.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// String returns the cron expression the schedule was parsed from.
+func (c CronSchedule) String() string {
+	return c.expr
+}
+
+func (c *CronSchedule) UnmarshalText(b []byte) error {
+	schedule, err := ParseCron(string(b))
+	if err != nil {
+		return err
+	}
+	*c = schedule
+	return nil
+}
+
+func (c CronSchedule) MarshalText() ([]byte, error) {
+	return []byte(c.expr), nil
+}
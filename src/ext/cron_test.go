@@ -0,0 +1,45 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2023, time.May, 10, 12, 30, 15, 0, time.UTC)
+	tests := []struct {
+		Expr   string
+		Expect time.Time
+	}{
+		{Expr: "* * * * *", Expect: time.Date(2023, time.May, 10, 12, 31, 0, 0, time.UTC)},
+		{Expr: "*/15 * * * *", Expect: time.Date(2023, time.May, 10, 12, 45, 0, 0, time.UTC)},
+		{Expr: "0 4 * * *", Expect: time.Date(2023, time.May, 11, 4, 0, 0, 0, time.UTC)},
+		{Expr: "30 12 * * *", Expect: time.Date(2023, time.May, 11, 12, 30, 0, 0, time.UTC)},
+		{Expr: "0 9-17/4 * * mon-fri", Expect: time.Date(2023, time.May, 10, 13, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 * * sun", Expect: time.Date(2023, time.May, 14, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 * * 7", Expect: time.Date(2023, time.May, 14, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 1 jan,jul *", Expect: time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 13 * fri", Expect: time.Date(2023, time.May, 12, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 31 * *", Expect: time.Date(2023, time.May, 31, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 29 2 *", Expect: time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{Expr: "@hourly", Expect: time.Date(2023, time.May, 10, 13, 0, 0, 0, time.UTC)},
+		{Expr: "@weekly", Expect: time.Date(2023, time.May, 14, 0, 0, 0, 0, time.UTC)},
+		{Expr: "0 0 30 2 *", Expect: time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.Expr, func(t *testing.T) {
+			schedule, err := ParseCron(test.Expr)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, schedule.Next(from))
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@often", "* * * foo *"} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,24 @@
+package ext
+
+// This file declares a Duration struct that wraps around time.Duration.
+// The wrapper implements marshalling functions so that you can serialize and
+// deserialize durations such as "1m30s" from JSON.
+
+import "time"
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	duration, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
@@ -1,45 +1,478 @@
 package ext
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
+// Overflow tells what Broadcast does when the buffer of a subscriber is full.
+type Overflow int
+
+const (
+	OverflowBlock      Overflow = iota // Wait until the subscriber receives the item
+	OverflowDropOldest                 // Drop the oldest buffered item to make room
+	OverflowDropNewest                 // Drop the new item
+	OverflowCoalesce                   // Merge the new item into the newest buffered item
+)
+
+var overflowNames = []string{"block", "drop_oldest", "drop_newest", "coalesce"}
+
+func (overflow Overflow) String() string {
+	if overflow < 0 || int(overflow) >= len(overflowNames) {
+		return fmt.Sprintf("Overflow(%d)", int(overflow))
+	}
+	return overflowNames[overflow]
+}
+
+// ParseOverflow converts a name such as drop_oldest to an Overflow.
+func ParseOverflow(name string) (Overflow, error) {
+	for i, overflowName := range overflowNames {
+		if name == overflowName {
+			return Overflow(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q (expected one of %v)", name, overflowNames)
+}
+
+func (overflow Overflow) MarshalText() ([]byte, error) {
+	return []byte(overflow.String()), nil
+}
+
+func (overflow *Overflow) UnmarshalText(b []byte) error {
+	parsed, err := ParseOverflow(string(b))
+	if err != nil {
+		return err
+	}
+	*overflow = parsed
+	return nil
+}
+
+// ListenOptions configures a subscription to an EventChannel.
+type ListenOptions[T any] struct {
+	// Number of items kept for the subscriber while it isn't receiving. With
+	// OverflowBlock, 0 means that Broadcast waits for every item to be
+	// received. With the other policies, the buffer holds at least one item.
+	Buffer int
+	// What happens to an item that doesn't fit in the buffer.
+	Overflow Overflow
+	// Merges a new item into the newest buffered item with OverflowCoalesce.
+	// nil replaces the buffered item with the new one.
+	Merge func(buffered T, item T) T
+	// Receive the items kept for late subscribers first, see SetReplay.
+	Replay bool
+}
+
+// ReplayOptions configures the items that an EventChannel keeps for the
+// subscribers that start listening late. Items are kept while both limits
+// allow it.
+type ReplayOptions struct {
+	Count int           // Number of items kept, 0 for no limit
+	Age   time.Duration // How long items are kept, 0 for no limit
+}
+
+// Enabled reports whether items are kept.
+func (self ReplayOptions) Enabled() bool {
+	return self.Count > 0 || self.Age > 0
+}
+
+// replayItem is an item kept for late subscribers.
+type replayItem[T any] struct {
+	item T
+	time time.Time // When the item was broadcast
+}
+
+// EventChannel broadcasts items to subscribers. The zero value is ready to use.
+//
+// Once closed, an EventChannel closes the channels of its subscribers, after
+// the items queued for them, and ignores the items broadcast to it, so that
+// loops ranging over the channels end.
+//
+// Broadcast never holds the lock of the EventChannel while sending, so a slow
+// subscriber only ever holds up Broadcast if it subscribed with OverflowBlock.
+// The items of one Broadcast caller are received in order; items broadcast
+// concurrently by several callers may be received in any order.
 type EventChannel[T any] struct {
-	mutex    sync.Mutex
-	channels []chan T
+	mutex       sync.Mutex
+	subscribers []*subscriber[T] // Replaced, never modified, so Broadcast can use it without the lock
+	closed      bool             // Set by Close
+	replay      ReplayOptions    // Which items are kept for late subscribers
+	replayItems []replayItem[T]  // Items kept for late subscribers, oldest first
+	draining    []*subscriber[T] // Subscribers still sending their queue after Close, so that Off can remove them
+}
+
+// subscriber is a subscription to an EventChannel.
+type subscriber[T any] struct {
+	channel chan T // Channel that the subscriber receives from
+	options ListenOptions[T]
+	done    chan struct{} // Closed when the subscriber is removed
+	dropped atomic.Uint64 // Number of items dropped or coalesced
+	sending sync.RWMutex  // Held for reading while sending to channel, and for writing while closing it
+	once    sync.Once     // Closes the subscriber once
+
+	// Closed once the replayed items were sent with OverflowBlock, so that
+	// Broadcast sends its items after them. nil if nothing is replayed.
+	replayed chan struct{}
+
+	// Only used by the policies that never block.
+	mutex sync.Mutex    // Guards queue
+	queue []T           // Items waiting to be sent to channel
+	wake  chan struct{} // Signals the pump that queue isn't empty
+	drain chan struct{} // Closed by Close, so that the pump closes channel once queue is empty
 }
 
 // Broadcast broadcasts an item to all channels on an EventChannel.
 func (em *EventChannel[T]) Broadcast(item T) {
 	em.mutex.Lock()
-	defer em.mutex.Unlock()
+	if em.replay.Enabled() && !em.closed {
+		em.replayItems = append(em.replayItems, replayItem[T]{item: item, time: time.Now()})
+		em.pruneReplay(time.Now())
+	}
+	subscribers := em.subscribers
+	em.mutex.Unlock()
+
+	// A closed EventChannel has no subscribers.
 
-	for _, channel := range em.channels {
-		channel <- item
+	for _, s := range subscribers {
+		s.send(item)
 	}
 }
 
 // Listen creates a new receive-only channel for an EventChannel. The created channel
-// will receive broadcast events.
+// will receive broadcast events. Broadcast waits for every event to be received.
 func (em *EventChannel[T]) Listen() <-chan T {
+	return em.ListenWith(ListenOptions[T]{})
+}
+
+// ListenWith creates a new receive-only channel for an EventChannel, with a
+// buffer and a policy for the events that don't fit in it. If the EventChannel
+// is closed, the returned channel is closed too.
+func (em *EventChannel[T]) ListenWith(options ListenOptions[T]) <-chan T {
+	if options.Buffer < 0 {
+		options.Buffer = 0
+	}
+	s := &subscriber[T]{options: options, done: make(chan struct{})}
+	if options.Overflow == OverflowBlock {
+		s.channel = make(chan T, options.Buffer)
+	} else {
+		if s.options.Buffer == 0 {
+			s.options.Buffer = 1
+		}
+		// The pump holds the item being received, the queue holds the rest.
+		s.channel = make(chan T)
+		s.wake = make(chan struct{}, 1)
+		s.drain = make(chan struct{})
+	}
+
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	if em.closed {
+		s.close()
+		return s.channel
+	}
+	// Subscribing and taking the replayed items under the lock makes sure
+	// that every item is either replayed or broadcast to the subscriber.
+	if options.Replay {
+		em.pruneReplay(time.Now())
+		s.startReplay(em.replayItems)
+	}
+	if s.wake != nil {
+		go s.pump()
+	}
+	subscribers := make([]*subscriber[T], len(em.subscribers), len(em.subscribers)+1)
+	copy(subscribers, em.subscribers)
+	em.subscribers = append(subscribers, s)
+	return s.channel
+}
+
+// SetReplay sets which items are kept for the subscribers that start listening
+// late and opt in with ListenOptions.Replay. Zero options stop keeping items.
+func (em *EventChannel[T]) SetReplay(options ReplayOptions) {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
+	em.replay = options
+	if !options.Enabled() {
+		em.replayItems = nil
+		return
+	}
+	em.pruneReplay(time.Now())
+}
+
+// pruneReplay drops the kept items beyond the replay limits. The lock must be
+// held.
+func (em *EventChannel[T]) pruneReplay(now time.Time) {
+	drop := 0
+	if em.replay.Count > 0 && len(em.replayItems) > em.replay.Count {
+		drop = len(em.replayItems) - em.replay.Count
+	}
+	if em.replay.Age > 0 {
+		for drop < len(em.replayItems) && now.Sub(em.replayItems[drop].time) > em.replay.Age {
+			drop++
+		}
+	}
+	if drop > 0 {
+		// Release the dropped items; append copies the rest to a new array
+		// once the capacity runs out.
+		var zero replayItem[T]
+		for i := 0; i < drop; i++ {
+			em.replayItems[i] = zero
+		}
+		em.replayItems = em.replayItems[drop:]
+	}
+}
 
-	channel := make(chan T)
-	em.channels = append(em.channels, channel)
-	return channel
+// ListenContext creates a new receive-only channel for an EventChannel, like
+// Listen, that is removed from the EventChannel once ctx is done.
+func (em *EventChannel[T]) ListenContext(ctx context.Context) <-chan T {
+	return em.ListenContextWith(ctx, ListenOptions[T]{})
 }
 
-// Off removes the specified channel from an EventChannel.
+// ListenContextWith creates a new receive-only channel for an EventChannel,
+// like ListenWith, that is removed from the EventChannel once ctx is done.
+func (em *EventChannel[T]) ListenContextWith(ctx context.Context, options ListenOptions[T]) <-chan T {
+	c := em.ListenWith(options)
+	if ctx.Done() == nil {
+		return c
+	}
+	s := em.find(c)
+	if s == nil {
+		// The EventChannel is closed.
+		return c
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			em.Off(c)
+		case <-s.done:
+		}
+	}()
+	return c
+}
+
+// Off removes the specified channel from an EventChannel and closes it. A
+// Broadcast waiting for the channel to receive gives up. Items that the
+// channel buffered can still be received.
 func (em *EventChannel[T]) Off(c <-chan T) {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
 
 	// Remove all channels that are not `c`
-	var filtered []chan T
-	for _, s := range em.channels {
-		if s != c {
+	var filtered []*subscriber[T]
+	for _, s := range em.subscribers {
+		if s.channel != c {
 			filtered = append(filtered, s)
+		} else {
+			s.close()
+		}
+	}
+	em.subscribers = filtered
+	// A subscriber that stops receiving after Close drops the rest of its queue.
+	for _, s := range em.draining {
+		if s.channel == c {
+			s.close()
 		}
 	}
-	em.channels = filtered
 	// `c` is no longer needed and should be garbage collected.
 }
+
+// Close closes the channels of all subscribers, once they received the items
+// queued for them. Later broadcasts are ignored, and later subscribers receive
+// a closed channel. Closing an EventChannel again does nothing.
+func (em *EventChannel[T]) Close() {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	for _, s := range em.subscribers {
+		if s.drain != nil {
+			close(s.drain)
+			em.draining = append(em.draining, s)
+		} else {
+			s.close()
+		}
+	}
+	em.subscribers = nil
+	em.closed = true
+}
+
+// Closed reports whether the EventChannel was closed.
+func (em *EventChannel[T]) Closed() bool {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	return em.closed
+}
+
+// Dropped returns the number of events that were dropped, or merged into
+// another event, because the specified channel didn't receive them in time.
+func (em *EventChannel[T]) Dropped(c <-chan T) uint64 {
+	if s := em.find(c); s != nil {
+		return s.dropped.Load()
+	}
+	return 0
+}
+
+// find returns the subscriber of the specified channel, or nil if it isn't
+// subscribed.
+func (em *EventChannel[T]) find(c <-chan T) *subscriber[T] {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	for _, s := range em.subscribers {
+		if s.channel == c {
+			return s
+		}
+	}
+	return nil
+}
+
+// send hands an item to the subscriber according to its overflow policy.
+func (self *subscriber[T]) send(item T) {
+	if self.options.Overflow == OverflowBlock {
+		self.deliver(item)
+		return
+	}
+
+	self.mutex.Lock()
+	if len(self.queue) < self.options.Buffer {
+		self.queue = append(self.queue, item)
+	} else {
+		self.dropped.Add(1)
+		switch self.options.Overflow {
+		case OverflowDropOldest:
+			self.queue = append(self.queue[1:], item)
+		case OverflowCoalesce:
+			last := len(self.queue) - 1
+			if self.options.Merge != nil {
+				item = self.options.Merge(self.queue[last], item)
+			}
+			self.queue[last] = item
+		}
+	}
+	self.mutex.Unlock()
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+		// The pump was already woken up.
+	}
+}
+
+// pump sends the queued items to the subscriber until it is removed, or
+// until the queue is empty once the EventChannel is closed.
+func (self *subscriber[T]) pump() {
+	for {
+		self.mutex.Lock()
+		if len(self.queue) == 0 {
+			self.mutex.Unlock()
+			select {
+			case <-self.wake:
+				continue
+			case <-self.drain:
+				// Items broadcast concurrently with Close may still be queued.
+				self.mutex.Lock()
+				empty := len(self.queue) == 0
+				self.mutex.Unlock()
+				if !empty {
+					continue
+				}
+				self.close()
+				return
+			case <-self.done:
+				return
+			}
+		}
+		item := self.queue[0]
+		// Don't keep the sent items alive through the backing array.
+		var zero T
+		self.queue[0] = zero
+		self.queue = self.queue[1:]
+		self.mutex.Unlock()
+
+		if !self.deliver(item) {
+			return
+		}
+	}
+}
+
+// startReplay hands the replayed items to the subscriber before anything
+// that is broadcast later. With the policies that never block, the newest
+// items that fit in the buffer are queued.
+func (self *subscriber[T]) startReplay(items []replayItem[T]) {
+	if len(items) == 0 {
+		return
+	}
+	if self.options.Overflow != OverflowBlock {
+		if len(items) > self.options.Buffer {
+			self.dropped.Add(uint64(len(items) - self.options.Buffer))
+			items = items[len(items)-self.options.Buffer:]
+		}
+		for _, item := range items {
+			self.queue = append(self.queue, item.item)
+		}
+		self.wake <- struct{}{}
+		return
+	}
+	replay := make([]T, len(items))
+	for i, item := range items {
+		replay[i] = item.item
+	}
+	self.replayed = make(chan struct{})
+	go func() {
+		defer close(self.replayed)
+		for _, item := range replay {
+			if !self.sendNow(item) {
+				return
+			}
+		}
+	}()
+}
+
+// deliver sends an item to the channel after the replayed items, unless the
+// subscriber is removed first.
+//
+// Returns:
+//
+//	false if the subscriber was removed.
+func (self *subscriber[T]) deliver(item T) bool {
+	if self.replayed != nil {
+		select {
+		case <-self.replayed:
+		case <-self.done:
+			return false
+		}
+	}
+	return self.sendNow(item)
+}
+
+// sendNow sends an item to the channel, unless the subscriber is removed first.
+//
+// Returns:
+//
+//	false if the subscriber was removed.
+func (self *subscriber[T]) sendNow(item T) bool {
+	self.sending.RLock()
+	defer self.sending.RUnlock()
+	select {
+	case <-self.done:
+		// The channel may be closed already.
+		return false
+	default:
+	}
+	select {
+	case self.channel <- item:
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
+// close removes the subscriber: the senders give up, then the channel is
+// closed.
+func (self *subscriber[T]) close() {
+	self.once.Do(func() {
+		close(self.done)
+		self.sending.Lock()
+		close(self.channel)
+		self.sending.Unlock()
+	})
+}
@@ -0,0 +1,274 @@
+package ext
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// receive receives the items that are ready on a channel, until it is closed.
+func receive[T any](c <-chan T) []T {
+	var items []T
+	for {
+		select {
+		case item, ok := <-c:
+			if !ok {
+				return items
+			}
+			items = append(items, item)
+		case <-time.After(100 * time.Millisecond):
+			return items
+		}
+	}
+}
+
+func TestEventChannelOverflow(t *testing.T) {
+	sum := func(buffered int, item int) int { return buffered + item }
+	tests := []struct {
+		Name    string
+		Options ListenOptions[int]
+		Expect  []int
+		Dropped uint64
+	}{
+		{Name: "Drop oldest", Options: ListenOptions[int]{Buffer: 2, Overflow: OverflowDropOldest},
+			Expect: []int{1, 4, 5}, Dropped: 2},
+		{Name: "Drop newest", Options: ListenOptions[int]{Buffer: 2, Overflow: OverflowDropNewest},
+			Expect: []int{1, 2, 3}, Dropped: 2},
+		{Name: "Coalesce", Options: ListenOptions[int]{Buffer: 2, Overflow: OverflowCoalesce, Merge: sum},
+			Expect: []int{1, 2, 12}, Dropped: 2},
+		{Name: "Coalesce to the newest", Options: ListenOptions[int]{Buffer: 2, Overflow: OverflowCoalesce},
+			Expect: []int{1, 2, 5}, Dropped: 2},
+		{Name: "Room left", Options: ListenOptions[int]{Buffer: 10, Overflow: OverflowDropNewest},
+			Expect: []int{1, 2, 3, 4, 5}, Dropped: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var em EventChannel[int]
+			c := em.ListenWith(test.Options)
+			defer em.Off(c)
+
+			em.Broadcast(1)
+			// Wait for the first item to be held by the pump, outside the buffer.
+			s := em.subscribers[0]
+			assert.Eventually(t, func() bool {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				return len(s.queue) == 0
+			}, time.Second, time.Millisecond)
+			for item := 2; item <= 5; item++ {
+				em.Broadcast(item)
+			}
+
+			assert.Equal(t, test.Expect, receive(c))
+			assert.Equal(t, test.Dropped, em.Dropped(c))
+		})
+	}
+}
+
+func TestEventChannelBlock(t *testing.T) {
+	var em EventChannel[int]
+	buffered := em.ListenWith(ListenOptions[int]{Buffer: 2})
+	blocking := em.Listen()
+
+	done := make(chan struct{})
+	go func() {
+		em.Broadcast(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Broadcast didn't wait for the blocking channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The waiting Broadcast doesn't hold the lock.
+	other := em.ListenWith(ListenOptions[int]{Overflow: OverflowDropNewest})
+	defer em.Off(other)
+	// Removing the blocking channel lets the Broadcast finish.
+	em.Off(blocking)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Broadcast is still waiting for a removed channel")
+	}
+	assert.Equal(t, []int{1}, receive(buffered))
+	em.Off(buffered)
+}
+
+func TestParseOverflow(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Expect Overflow
+		Error  bool
+	}{
+		{Name: "block", Expect: OverflowBlock},
+		{Name: "drop_oldest", Expect: OverflowDropOldest},
+		{Name: "drop_newest", Expect: OverflowDropNewest},
+		{Name: "coalesce", Expect: OverflowCoalesce},
+		{Name: "drop", Error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			overflow, err := ParseOverflow(test.Name)
+			if test.Error {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, overflow)
+			assert.Equal(t, test.Name, overflow.String())
+		})
+	}
+}
+
+func TestEventChannelClose(t *testing.T) {
+	var em EventChannel[int]
+	blocking := em.Listen()
+	buffered := em.ListenWith(ListenOptions[int]{Buffer: 2})
+	dropping := em.ListenWith(ListenOptions[int]{Buffer: 2, Overflow: OverflowDropOldest})
+	received := make(chan []int)
+	go func() {
+		var items []int
+		for item := range blocking {
+			items = append(items, item)
+		}
+		received <- items
+	}()
+	em.Broadcast(1)
+	em.Close()
+	select {
+	case items := <-received:
+		assert.Equal(t, []int{1}, items)
+	case <-time.After(time.Second):
+		t.Fatal("the channel wasn't closed")
+	}
+
+	// Buffered items can still be received.
+	assert.Equal(t, []int{1}, receive(buffered))
+	_, ok := <-buffered
+	assert.False(t, ok)
+	// The item held by the pump is sent before the channel is closed.
+	assert.Equal(t, []int{1}, receive(dropping))
+	_, ok = <-dropping
+	assert.False(t, ok)
+
+	// Later broadcasts are ignored, later subscribers get a closed channel.
+	em.Broadcast(2)
+	_, ok = <-em.Listen()
+	assert.False(t, ok)
+	assert.True(t, em.Closed())
+	em.Close()
+}
+
+func TestEventChannelCloseQueued(t *testing.T) {
+	var em EventChannel[int]
+	dropping := em.ListenWith(ListenOptions[int]{Buffer: 3, Overflow: OverflowDropOldest})
+	coalescing := em.ListenWith(ListenOptions[int]{Buffer: 2, Overflow: OverflowCoalesce})
+	stopped := em.ListenWith(ListenOptions[int]{Buffer: 3, Overflow: OverflowDropNewest})
+	for i := 1; i <= 5; i++ {
+		em.Broadcast(i)
+	}
+	em.Close()
+
+	// The queued items are received before the channels are closed. The pump
+	// may hold the first item besides the buffer.
+	items := receive(dropping)
+	assert.Equal(t, []int{3, 4, 5}, items[len(items)-3:])
+	_, ok := <-dropping
+	assert.False(t, ok)
+	items = receive(coalescing)
+	assert.Equal(t, 5, items[len(items)-1])
+	_, ok = <-coalescing
+	assert.False(t, ok)
+
+	// A subscriber that stops receiving drops the rest of its queue.
+	assert.Equal(t, 1, <-stopped)
+	em.Off(stopped)
+	_, ok = <-stopped
+	assert.False(t, ok)
+}
+
+func TestEventChannelOff(t *testing.T) {
+	var em EventChannel[int]
+	c := em.Listen()
+	done := make(chan struct{})
+	go func() {
+		for range c {
+		}
+		close(done)
+	}()
+	em.Broadcast(1)
+	em.Off(c)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the channel wasn't closed")
+	}
+	// Removing it again does nothing.
+	em.Off(c)
+	em.Broadcast(2)
+}
+
+func TestEventChannelListenContext(t *testing.T) {
+	var em EventChannel[int]
+	ctx, cancel := context.WithCancel(context.Background())
+	c := em.ListenContext(ctx)
+	go em.Broadcast(1)
+	assert.Equal(t, 1, <-c)
+
+	cancel()
+	select {
+	case _, ok := <-c:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("the channel wasn't removed")
+	}
+	assert.Eventually(t, func() bool { return em.find(c) == nil }, time.Second, time.Millisecond)
+	// Nobody waits for the removed channel.
+	em.Broadcast(2)
+}
+
+func TestEventChannelReplay(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Replay  ReplayOptions
+		Options ListenOptions[int]
+		Expect  []int // Replayed items
+	}{
+		{Name: "By count", Replay: ReplayOptions{Count: 2},
+			Options: ListenOptions[int]{Replay: true}, Expect: []int{2, 3}},
+		{Name: "By age", Replay: ReplayOptions{Age: 50 * time.Millisecond},
+			Options: ListenOptions[int]{Replay: true}, Expect: []int{3}},
+		{Name: "Opted out", Replay: ReplayOptions{Count: 2},
+			Options: ListenOptions[int]{}, Expect: nil},
+		{Name: "Disabled", Replay: ReplayOptions{},
+			Options: ListenOptions[int]{Replay: true}, Expect: nil},
+		{Name: "Buffered", Replay: ReplayOptions{Count: 10},
+			Options: ListenOptions[int]{Replay: true, Buffer: 10, Overflow: OverflowDropOldest}, Expect: []int{1, 2, 3}},
+		{Name: "Larger than the buffer", Replay: ReplayOptions{Count: 10},
+			Options: ListenOptions[int]{Replay: true, Buffer: 2, Overflow: OverflowDropOldest}, Expect: []int{2, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var em EventChannel[int]
+			em.SetReplay(test.Replay)
+			em.Broadcast(1)
+			em.Broadcast(2)
+			time.Sleep(100 * time.Millisecond)
+			em.Broadcast(3)
+
+			c := em.ListenWith(test.Options)
+			defer em.Off(c)
+			if test.Options.Overflow == OverflowBlock {
+				// Broadcast waits for the replayed items to be received.
+				go em.Broadcast(4)
+				assert.Equal(t, append(test.Expect, 4), receive(c))
+				return
+			}
+			assert.Equal(t, test.Expect, receive(c))
+			em.Broadcast(4)
+			assert.Equal(t, []int{4}, receive(c))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package ext
+
+// This file declares an Encoding struct that wraps around the character
+// encodings of golang.org/x/text, so that legacy encodings such as
+// windows-1252 or shift_jis can be deserialized from JSON by name.
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding is a character encoding. The zero value is UTF-8, which text is
+// converted from and to.
+type Encoding struct {
+	name     string
+	encoding encoding.Encoding // nil for UTF-8
+}
+
+// ParseEncoding looks up an encoding by its name, e.g. utf-8, windows-1252,
+// shift_jis or ibm437.
+func ParseEncoding(name string) (Encoding, error) {
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		// The IANA names include more code pages, e.g. IBM437.
+		e, err = ianaindex.IANA.Encoding(name)
+	}
+	if err != nil || e == nil {
+		return Encoding{}, fmt.Errorf("unknown encoding %q", name)
+	}
+	if e == unicode.UTF8 {
+		return Encoding{}, nil
+	}
+	return Encoding{name: strings.ToLower(name), encoding: e}, nil
+}
+
+// IsUTF8 reports whether the encoding is UTF-8, which needs no conversion.
+func (self Encoding) IsUTF8() bool {
+	return self.encoding == nil
+}
+
+func (self Encoding) String() string {
+	if self.encoding == nil {
+		return "utf-8"
+	}
+	return self.name
+}
+
+func (self *Encoding) UnmarshalText(b []byte) error {
+	parsed, err := ParseEncoding(string(b))
+	if err != nil {
+		return err
+	}
+	*self = parsed
+	return nil
+}
+
+func (self Encoding) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+// NewReader returns a reader that converts the text read from r from the
+// encoding to UTF-8. Bytes that are invalid in the encoding are replaced
+// by U+FFFD.
+func (self Encoding) NewReader(r io.Reader) io.Reader {
+	if self.encoding == nil {
+		return r
+	}
+	return transform.NewReader(r, self.encoding.NewDecoder())
+}
+
+// Decode converts text from the encoding to UTF-8. Bytes that are invalid
+// in the encoding are replaced by U+FFFD.
+func (self Encoding) Decode(text string) string {
+	if self.encoding == nil {
+		return text
+	}
+	decoded, err := self.encoding.NewDecoder().String(text)
+	if err != nil {
+		return strings.ToValidUTF8(text, string(utf8.RuneError))
+	}
+	return decoded
+}
+
+// Encode converts UTF-8 text to the encoding.
+//
+// Parameters:
+//
+//	replacement:
+//		Written instead of the characters that the encoding can't represent.
+//		If it can't be represented either, the encoding's own replacement
+//		character, often "?" or "\x1a", is used.
+func (self Encoding) Encode(text string, replacement string) string {
+	if self.encoding == nil {
+		return text
+	}
+	encoded, err := self.encoding.NewEncoder().String(text)
+	if err == nil {
+		return encoded
+	}
+	// Encode the text one character at a time, to replace the ones that
+	// can't be represented.
+	encoder := self.encoding.NewEncoder()
+	fallback := encoding.ReplaceUnsupported(self.encoding.NewEncoder())
+	encodedReplacement, err := encoder.String(replacement)
+	if err != nil {
+		encodedReplacement, _ = fallback.String(replacement)
+	}
+	var result strings.Builder
+	for _, r := range text {
+		encoded, err := encoder.String(string(r))
+		if err != nil {
+			encoded = encodedReplacement
+		}
+		result.WriteString(encoded)
+	}
+	return result.String()
+}
@@ -0,0 +1,82 @@
+package ext
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ExpectUTF8 bool
+		ExpectErr  bool
+	}{
+		{Name: "utf-8", ExpectUTF8: true},
+		{Name: "UTF8", ExpectUTF8: true},
+		{Name: "windows-1252"},
+		{Name: "Shift_JIS"},
+		{Name: "IBM437"},
+		{Name: "klingon", ExpectErr: true},
+		{Name: "", ExpectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			encoding, err := ParseEncoding(test.Name)
+			if test.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.ExpectUTF8, encoding.IsUTF8())
+		})
+	}
+}
+
+func TestEncodingDecode(t *testing.T) {
+	tests := []struct {
+		Encoding string
+		Input    string
+		Expect   string
+	}{
+		{Encoding: "utf-8", Input: "Café", Expect: "Café"},
+		{Encoding: "windows-1252", Input: "Caf\xe9 \x80", Expect: "Café €"},
+		{Encoding: "shift_jis", Input: "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", Expect: "こんにちは"},
+		{Encoding: "shift_jis", Input: "\x82", Expect: "�"},
+	}
+	for _, test := range tests {
+		t.Run(test.Encoding, func(t *testing.T) {
+			encoding, err := ParseEncoding(test.Encoding)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, encoding.Decode(test.Input))
+			decoded, err := io.ReadAll(encoding.NewReader(bytes.NewBufferString(test.Input)))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, string(decoded))
+		})
+	}
+}
+
+func TestEncodingEncode(t *testing.T) {
+	tests := []struct {
+		Encoding    string
+		Input       string
+		Replacement string
+		Expect      string
+	}{
+		{Encoding: "utf-8", Input: "Café 🎉", Replacement: "?", Expect: "Café 🎉"},
+		{Encoding: "windows-1252", Input: "Café €", Replacement: "?", Expect: "Caf\xe9 \x80"},
+		{Encoding: "windows-1252", Input: "Café 🎉!", Replacement: "?", Expect: "Caf\xe9 ?!"},
+		{Encoding: "windows-1252", Input: "日本", Replacement: "", Expect: ""},
+		{Encoding: "windows-1252", Input: "a日b", Replacement: "[?]", Expect: "a[?]b"},
+		{Encoding: "windows-1252", Input: "a日b", Replacement: "本", Expect: "a\x1ab"},
+		{Encoding: "shift_jis", Input: "こんにちは 🎉", Replacement: "?", Expect: "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd ?"},
+	}
+	for _, test := range tests {
+		t.Run(test.Encoding, func(t *testing.T) {
+			encoding, err := ParseEncoding(test.Encoding)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, encoding.Encode(test.Input, test.Replacement))
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package ext
+
+// This file declares a FileMode struct that wraps around os.FileMode.
+// The wrapper implements marshalling functions so that you can serialize and
+// deserialize permissions in octal, such as "0660", from JSON.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type FileMode struct {
+	os.FileMode
+}
+
+func (mode *FileMode) UnmarshalText(b []byte) error {
+	value, err := strconv.ParseUint(string(b), 8, 32)
+	if err != nil || value > 0o777 {
+		return fmt.Errorf("invalid permissions %q, expected an octal number such as 0660", string(b))
+	}
+	mode.FileMode = os.FileMode(value)
+	return nil
+}
+
+func (mode FileMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04o", uint32(mode.FileMode.Perm()))), nil
+}
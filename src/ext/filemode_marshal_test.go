@@ -0,0 +1,21 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestFileModeUnmarshalText(t *testing.T) {
+	var mode FileMode
+	assert.NoError(t, mode.UnmarshalText([]byte("0660")))
+	assert.Equal(t, os.FileMode(0o660), mode.FileMode)
+	assert.NoError(t, mode.UnmarshalText([]byte("600")))
+	assert.Equal(t, os.FileMode(0o600), mode.FileMode)
+	assert.Error(t, mode.UnmarshalText([]byte("0880")))
+	assert.Error(t, mode.UnmarshalText([]byte("01777")))
+
+	text, err := FileMode{FileMode: 0o640}.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "0640", string(text))
+}
@@ -0,0 +1,213 @@
+package ext
+
+// This file implements reading lines from a stream. Unlike bufio.Scanner,
+// which stops for good at the first line longer than its buffer, ReadLines
+// splits or truncates long lines, and can emit partial lines, such as
+// prompts, that aren't followed by a newline.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// LongLineMode tells ReadLines what to do with lines longer than the maximum length.
+type LongLineMode string
+
+const (
+	LongLineSplit    LongLineMode = "split"    // Emit the line in pieces of the maximum length
+	LongLineTruncate LongLineMode = "truncate" // Emit the beginning of the line and drop the rest
+)
+
+// DefaultMaxLineLength is the maximum line length used when none is configured.
+const DefaultMaxLineLength = 64 * 1024
+
+// ParseLongLineMode converts a string to a LongLineMode.
+func ParseLongLineMode(mode string) (LongLineMode, error) {
+	switch LongLineMode(mode) {
+	case LongLineSplit, LongLineTruncate:
+		return LongLineMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown long line mode %q (expected %v or %v)", mode, LongLineSplit, LongLineTruncate)
+}
+
+func (mode *LongLineMode) UnmarshalText(b []byte) error {
+	parsed, err := ParseLongLineMode(string(b))
+	if err != nil {
+		return err
+	}
+	*mode = parsed
+	return nil
+}
+
+// LineReaderOptions configures ReadLines.
+type LineReaderOptions struct {
+	MaxLength int           // Maximum length of a line in bytes. 0 means DefaultMaxLineLength.
+	LongLines LongLineMode  // What to do with longer lines. Empty means LongLineSplit.
+	IdleFlush time.Duration // Emit a partial line once no data was read for this long. 0 disables it.
+}
+
+// ReadLines reads lines from r until it reaches the end of r, and calls emit
+// for each line. Lines end with "\n" or "\r\n", which isn't passed to emit.
+// The last line is emitted even if it doesn't end with a newline.
+//
+// Returns:
+//
+//	nil once the end of r was reached, or the error that reading r failed with.
+func ReadLines(r io.Reader, options LineReaderOptions, emit func(line string)) error {
+	if options.MaxLength <= 0 {
+		options.MaxLength = DefaultMaxLineLength
+	}
+	reader := lineReader{options: options, emit: emit}
+
+	chunks := make(chan []byte)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				reader.flush()
+				if readErr == io.EOF {
+					return nil
+				}
+				return readErr
+			}
+			reader.write(chunk)
+			if options.IdleFlush > 0 && len(reader.line) > 0 {
+				if idleTimer == nil {
+					idleTimer = time.NewTimer(options.IdleFlush)
+					defer idleTimer.Stop()
+				} else {
+					if !idleTimer.Stop() {
+						select {
+						case <-idleTimer.C:
+						default:
+						}
+					}
+					idleTimer.Reset(options.IdleFlush)
+				}
+				idle = idleTimer.C
+			} else {
+				idle = nil
+			}
+		case <-idle:
+			idle = nil
+			reader.flush()
+		}
+	}
+}
+
+// LineSplitter splits data into lines like ReadLines, for streams that are
+// read piecemeal, e.g. a file that is followed. Unlike ReadLines, it keeps the
+// last line until its newline is written. IdleFlush is ignored.
+type LineSplitter struct {
+	reader lineReader
+}
+
+// NewLineSplitter creates a LineSplitter that splits lines like ReadLines
+// with the specified options.
+func NewLineSplitter(options LineReaderOptions) *LineSplitter {
+	if options.MaxLength <= 0 {
+		options.MaxLength = DefaultMaxLineLength
+	}
+	return &LineSplitter{reader: lineReader{options: options}}
+}
+
+// Write splits data that follows the data previously written, and calls emit
+// for each complete line, and for each piece of a line longer than the
+// maximum length.
+func (self *LineSplitter) Write(data []byte, emit func(line string)) {
+	self.reader.emit = emit
+	defer func() { self.reader.emit = nil }()
+	self.reader.write(data)
+}
+
+// Reset drops the beginning of the current line, e.g. when the stream starts
+// over.
+func (self *LineSplitter) Reset() {
+	self.reader.line = self.reader.line[:0]
+	self.reader.dropping = false
+}
+
+// lineReader splits the data read by ReadLines into lines.
+type lineReader struct {
+	options  LineReaderOptions
+	emit     func(line string)
+	line     []byte // Beginning of the current line
+	dropping bool   // The current line was truncated and emitted, drop the rest of it
+}
+
+// write processes data read from the stream.
+func (self *lineReader) write(data []byte) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			self.append(data)
+			return
+		}
+		// The "\r" of a "\r\n" may be at the end of the previous chunk too.
+		self.append(bytes.TrimSuffix(data[:end], []byte("\r")))
+		if !self.dropping {
+			self.line = bytes.TrimSuffix(self.line, []byte("\r"))
+			self.emitLine()
+		}
+		self.dropping = false
+		data = data[end+1:]
+	}
+}
+
+// append adds data without newlines to the current line.
+func (self *lineReader) append(data []byte) {
+	for !self.dropping && len(data) > 0 {
+		room := self.options.MaxLength - len(self.line)
+		if len(data) <= room {
+			self.line = append(self.line, data...)
+			return
+		}
+		// Don't cut a UTF-8 character in half, unless it doesn't fit at all.
+		cut := room
+		for cut > 0 && !utf8.RuneStart(data[cut]) && room-cut < utf8.UTFMax {
+			cut--
+		}
+		if cut == 0 && len(self.line) == 0 {
+			cut = room
+		}
+		self.line = append(self.line, data[:cut]...)
+		data = data[cut:]
+		self.emitLine()
+		if self.options.LongLines == LongLineTruncate {
+			self.dropping = true
+		}
+	}
+}
+
+// flush emits the current line, if it isn't empty.
+func (self *lineReader) flush() {
+	if len(self.line) > 0 {
+		self.emitLine()
+	}
+}
+
+func (self *lineReader) emitLine() {
+	self.emit(string(self.line))
+	self.line = self.line[:0]
+}
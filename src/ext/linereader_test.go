@@ -0,0 +1,124 @@
+package ext
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAllLines(r io.Reader, options LineReaderOptions) ([]string, error) {
+	var lines []string
+	err := ReadLines(r, options, func(line string) {
+		lines = append(lines, line)
+	})
+	return lines, err
+}
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		Input   string
+		Options LineReaderOptions
+		Expect  []string
+	}{
+		{Input: "", Expect: nil},
+		{Input: "one\ntwo\n", Expect: []string{"one", "two"}},
+		{Input: "one\r\ntwo\r\n", Expect: []string{"one", "two"}},
+		{Input: "one\n\nthree", Expect: []string{"one", "", "three"}},
+		{
+			Input:   "abcdefgh\nij\n",
+			Options: LineReaderOptions{MaxLength: 3},
+			Expect:  []string{"abc", "def", "gh", "ij"},
+		},
+		{
+			Input:   "abcdef\nij\n",
+			Options: LineReaderOptions{MaxLength: 3},
+			Expect:  []string{"abc", "def", "ij"},
+		},
+		{
+			Input:   "abc\r\nij\n",
+			Options: LineReaderOptions{MaxLength: 3},
+			Expect:  []string{"abc", "ij"},
+		},
+		{
+			Input:   "abcdefgh\nij\n",
+			Options: LineReaderOptions{MaxLength: 3, LongLines: LongLineTruncate},
+			Expect:  []string{"abc", "ij"},
+		},
+		{
+			// UTF-8 characters aren't cut in half.
+			Input:   "aé€\n",
+			Options: LineReaderOptions{MaxLength: 4},
+			Expect:  []string{"aé", "€"},
+		},
+		{
+			Input:   strings.Repeat("x", 100000) + "\nafter\n",
+			Options: LineReaderOptions{LongLines: LongLineTruncate},
+			Expect:  []string{strings.Repeat("x", DefaultMaxLineLength), "after"},
+		},
+	}
+	for _, test := range tests {
+		lines, err := readAllLines(strings.NewReader(test.Input), test.Options)
+		assert.NoError(t, err)
+		assert.Equal(t, test.Expect, lines, "input: %q", test.Input)
+	}
+}
+
+func TestReadLinesIdleFlush(t *testing.T) {
+	reader, writer := io.Pipe()
+	lineCh := make(chan string)
+	go func() {
+		_ = ReadLines(reader, LineReaderOptions{IdleFlush: 20 * time.Millisecond}, func(line string) {
+			lineCh <- line
+		})
+		close(lineCh)
+	}()
+
+	_, _ = writer.Write([]byte("line\nPress Y to continue: "))
+	assert.Equal(t, "line", <-lineCh)
+	assert.Equal(t, "Press Y to continue: ", <-lineCh)
+	_, _ = writer.Write([]byte("y\n"))
+	assert.Equal(t, "y", <-lineCh)
+	_ = writer.Close()
+	_, ok := <-lineCh
+	assert.False(t, ok)
+}
+
+func TestReadLinesError(t *testing.T) {
+	readErr := errors.New("read failed")
+	reader := io.MultiReader(strings.NewReader("one\ntw"), &failingReader{err: readErr})
+	lines, err := readAllLines(reader, LineReaderOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, []string{"one", "tw"}, lines)
+}
+
+type failingReader struct {
+	err error
+}
+
+func (self *failingReader) Read([]byte) (int, error) {
+	return 0, self.err
+}
+
+func TestLineSplitter(t *testing.T) {
+	var lines []string
+	emit := func(line string) { lines = append(lines, line) }
+	splitter := NewLineSplitter(LineReaderOptions{MaxLength: 4})
+
+	// The last line is held back until its newline is written.
+	splitter.Write([]byte("one\r"), emit)
+	splitter.Write([]byte("\ntw"), emit)
+	assert.Equal(t, []string{"one"}, lines)
+	splitter.Write([]byte("o\n"), emit)
+	assert.Equal(t, []string{"one", "two"}, lines)
+
+	// Data without newlines doesn't grow past the maximum length.
+	lines = nil
+	splitter.Write([]byte("abcdefghij"), emit)
+	assert.Equal(t, []string{"abcd", "efgh"}, lines)
+	splitter.Reset()
+	splitter.Write([]byte("x\n"), emit)
+	assert.Equal(t, []string{"abcd", "efgh", "x"}, lines)
+}
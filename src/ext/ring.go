@@ -0,0 +1,56 @@
+package ext
+
+// Ring is a ring buffer that keeps the last items pushed to it.
+// It is not safe for concurrent use.
+type Ring[T any] struct {
+	items []T
+	next  int  // Index that the next item is written to
+	full  bool // Set once the buffer wrapped around
+}
+
+// NewRing creates a Ring that keeps the last size items.
+func NewRing[T any](size int) *Ring[T] {
+	if size < 0 {
+		size = 0
+	}
+	return &Ring[T]{items: make([]T, size)}
+}
+
+// Push adds an item, dropping the oldest one if the buffer is full.
+func (self *Ring[T]) Push(item T) {
+	if len(self.items) == 0 {
+		return
+	}
+	self.items[self.next] = item
+	self.next++
+	if self.next == len(self.items) {
+		self.next = 0
+		self.full = true
+	}
+}
+
+// Items returns the items in the buffer, oldest first.
+func (self *Ring[T]) Items() []T {
+	if !self.full {
+		return append([]T(nil), self.items[:self.next]...)
+	}
+	return append(append([]T(nil), self.items[self.next:]...), self.items[:self.next]...)
+}
+
+// Len returns the number of items in the buffer.
+func (self *Ring[T]) Len() int {
+	if self.full {
+		return len(self.items)
+	}
+	return self.next
+}
+
+// Clear removes every item.
+func (self *Ring[T]) Clear() {
+	var zero T
+	for i := range self.items {
+		self.items[i] = zero
+	}
+	self.next = 0
+	self.full = false
+}
@@ -0,0 +1,38 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Size   int
+		Push   []int
+		Expect []int
+	}{
+		{Name: "Empty", Size: 3, Push: nil, Expect: nil},
+		{Name: "Not full", Size: 3, Push: []int{1, 2}, Expect: []int{1, 2}},
+		{Name: "Full", Size: 3, Push: []int{1, 2, 3}, Expect: []int{1, 2, 3}},
+		{Name: "Wrapped around", Size: 3, Push: []int{1, 2, 3, 4, 5}, Expect: []int{3, 4, 5}},
+		{Name: "No room", Size: 0, Push: []int{1, 2}, Expect: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ring := NewRing[int](test.Size)
+			for _, item := range test.Push {
+				ring.Push(item)
+			}
+			assert.Equal(t, test.Expect, ring.Items())
+			assert.Equal(t, len(test.Expect), ring.Len())
+
+			ring.Clear()
+			assert.Empty(t, ring.Items())
+			ring.Push(6)
+			if test.Size > 0 {
+				assert.Equal(t, []int{6}, ring.Items())
+			}
+		})
+	}
+}
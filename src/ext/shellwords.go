@@ -0,0 +1,86 @@
+package ext
+
+// This file implements splitting of command lines into words following the
+// POSIX shell quoting rules. Expansions (variables, globs, etc.) are not
+// performed.
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitShellWords splits a command line into words the way a POSIX shell does.
+//
+// Supported syntax:
+//   - Words are separated by unquoted blanks and newlines.
+//   - Single quotes preserve every character up to the closing quote.
+//   - Double quotes preserve every character except `\`, which escapes
+//     `$`, "`", `"`, `\` and newline.
+//   - An unquoted `\` escapes the next character. A `\` followed by a
+//     newline is removed.
+func SplitShellWords(line string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		escaped bool
+		quote   rune // ' or " while inside quotes
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				word.WriteRune('\\')
+			}
+			if r == '\n' {
+				// Line continuation
+				continue
+			}
+			word.WriteRune(r)
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		default:
+			switch r {
+			case ' ', '\t', '\n':
+				if inWord {
+					words = append(words, word.String())
+					word.Reset()
+					inWord = false
+				}
+				continue
+			case '\\':
+				escaped = true
+				continue
+			case '\'', '"':
+				quote = r
+			default:
+				word.WriteRune(r)
+			}
+		}
+		inWord = true
+	}
+	if escaped && quote == 0 {
+		return nil, errors.New("unexpected end of command line after '\\'")
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command line")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,59 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Input  string
+		Expect []string
+	}{
+		{
+			Name:   "Repeated spaces",
+			Input:  "  java  -jar\tserver.jar   nogui ",
+			Expect: []string{"java", "-jar", "server.jar", "nogui"},
+		},
+		{
+			Name:   "Single quotes",
+			Input:  `./start.sh '/srv/my server/' 'a "b" \c'`,
+			Expect: []string{"./start.sh", "/srv/my server/", `a "b" \c`},
+		},
+		{
+			Name:   "Double quotes",
+			Input:  `echo "it's \"quoted\" \$HOME \n"`,
+			Expect: []string{"echo", `it's "quoted" $HOME \n`},
+		},
+		{
+			Name:   "Backslashes",
+			Input:  "my\\ server \\\\ a\\\nb \\\n c",
+			Expect: []string{"my server", `\`, "ab", "c"},
+		},
+		{
+			Name:   "Empty words",
+			Input:  `a '' "" b`,
+			Expect: []string{"a", "", "", "b"},
+		},
+		{
+			Name:   "Adjacent quotes",
+			Input:  `-Dname='my'"server"`,
+			Expect: []string{"-Dname=myserver"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := SplitShellWords(test.Input)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expect, result)
+		})
+	}
+}
+
+func TestSplitShellWordsErrors(t *testing.T) {
+	for _, input := range []string{`java "-jar`, `java '-jar`, `java \`} {
+		_, err := SplitShellWords(input)
+		assert.Error(t, err, input)
+	}
+}
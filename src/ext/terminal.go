@@ -0,0 +1,137 @@
+package ext
+
+// This file implements the removal of terminal control sequences from the
+// output of programs that believe they are writing to a terminal.
+
+import "strings"
+
+const esc = '\x1b'
+
+// StripTerminalSequences removes terminal control sequences from a line.
+//
+// Escape sequences (CSI, OSC, etc.) and control characters other than tabs
+// are removed. Carriage returns and backspaces move the cursor the way a
+// terminal would, so text written after them overwrites the previous text.
+// If the line is a group of lines joined with newlines, the newlines are kept.
+func StripTerminalSequences(line string) string {
+	return cleanTerminalLine(line, false)
+}
+
+// StripTerminalSequencesKeepColors is like StripTerminalSequences, but keeps
+// the SGR sequences that set colors and text attributes.
+func StripTerminalSequencesKeepColors(line string) string {
+	return cleanTerminalLine(line, true)
+}
+
+// terminalCell is a character on the terminal line.
+type terminalCell struct {
+	style string // SGR sequences written before the character
+	r     rune
+}
+
+func cleanTerminalLine(line string, keepColors bool) string {
+	if strings.IndexFunc(line, isTerminalControl) < 0 {
+		return line
+	}
+	if strings.Contains(line, "\n") {
+		// A group of lines, each of which is cleaned on its own.
+		lines := strings.Split(line, "\n")
+		for i := range lines {
+			lines[i] = cleanTerminalLine(lines[i], keepColors)
+		}
+		return strings.Join(lines, "\n")
+	}
+	var cells []terminalCell
+	var style strings.Builder // SGR sequences not yet followed by a character
+	cursor := 0
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == esc:
+			end := skipEscapeSequence(runes, i)
+			if keepColors && isSgrSequence(runes[i:end+1]) {
+				style.WriteString(string(runes[i : end+1]))
+			}
+			i = end
+		case r == '\r':
+			cursor = 0
+		case r == '\b':
+			if cursor > 0 {
+				cursor--
+			}
+		case r == '\t' || !isTerminalControl(r):
+			cell := terminalCell{style: style.String(), r: r}
+			style.Reset()
+			if cursor < len(cells) {
+				cells[cursor] = cell
+			} else {
+				cells = append(cells, cell)
+			}
+			cursor++
+		}
+	}
+	var result strings.Builder
+	for _, cell := range cells {
+		result.WriteString(cell.style)
+		result.WriteRune(cell.r)
+	}
+	// Keep the sequences written after the last character, e.g. a reset.
+	result.WriteString(style.String())
+	return result.String()
+}
+
+// isSgrSequence reports whether an escape sequence is an SGR sequence, which
+// sets colors and text attributes, e.g. ESC [ 1 ; 3 1 m.
+func isSgrSequence(sequence []rune) bool {
+	if len(sequence) < 3 || sequence[1] != '[' || sequence[len(sequence)-1] != 'm' {
+		return false
+	}
+	for _, r := range sequence[2 : len(sequence)-1] {
+		if (r < '0' || r > '9') && r != ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// skipEscapeSequence returns the index of the last rune of the escape
+// sequence starting at runes[start].
+func skipEscapeSequence(runes []rune, start int) int {
+	i := start + 1
+	if i >= len(runes) {
+		return start
+	}
+	switch runes[i] {
+	case '[':
+		// CSI: parameter and intermediate bytes, terminated by a final byte in 0x40-0x7E.
+		for i++; i < len(runes); i++ {
+			if runes[i] >= 0x40 && runes[i] <= 0x7E {
+				return i
+			}
+		}
+		return len(runes) - 1
+	case ']', 'P', 'X', '^', '_':
+		// OSC, DCS, SOS, PM, APC: terminated by BEL or ST (ESC \).
+		for i++; i < len(runes); i++ {
+			if runes[i] == '\a' {
+				return i
+			}
+			if runes[i] == esc && i+1 < len(runes) && runes[i+1] == '\\' {
+				return i + 1
+			}
+		}
+		return len(runes) - 1
+	default:
+		// Two-byte sequences like ESC 7, or ESC ( B which selects a character set.
+		if runes[i] >= 0x20 && runes[i] <= 0x2F && i+1 < len(runes) {
+			return i + 1
+		}
+		return i
+	}
+}
+
+// isTerminalControl reports whether r is a C0 or C1 control character.
+func isTerminalControl(r rune) bool {
+	return r < 0x20 || r == 0x7F || (r >= 0x80 && r <= 0x9F)
+}
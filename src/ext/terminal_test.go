@@ -0,0 +1,48 @@
+package ext
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStripTerminalSequences(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Input  string
+		Expect string
+	}{
+		{Name: "Plain text", Input: "[12:00:00] Hello\tworld", Expect: "[12:00:00] Hello\tworld"},
+		{Name: "Colors", Input: "\x1b[1;32m[INFO]\x1b[0m Done", Expect: "[INFO] Done"},
+		{Name: "Cursor movement", Input: "\x1b[2K\x1b[1G> list", Expect: "> list"},
+		{Name: "Window title", Input: "\x1b]0;Server\x07Started", Expect: "Started"},
+		{Name: "Window title with ST", Input: "\x1b]0;Server\x1b\\Started", Expect: "Started"},
+		{Name: "Character set", Input: "\x1b(BHello", Expect: "Hello"},
+		{Name: "Carriage return", Input: "Loading 10%\rLoading 20%", Expect: "Loading 20%"},
+		{Name: "Trailing carriage return", Input: "Hello\r", Expect: "Hello"},
+		{Name: "Backspace", Input: "Helx\b \blo", Expect: "Hello"},
+		{Name: "Bell", Input: "Ding\x07!", Expect: "Ding!"},
+		{Name: "Several lines", Input: "\x1b[31mOne\x1b[0m\nLoading\rTwo", Expect: "One\nTwoding"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expect, StripTerminalSequences(test.Input))
+		})
+	}
+}
+
+func TestStripTerminalSequencesKeepColors(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Input  string
+		Expect string
+	}{
+		{Name: "Colors", Input: "\x1b[1;32m[INFO]\x1b[0m Done", Expect: "\x1b[1;32m[INFO]\x1b[0m Done"},
+		{Name: "Cursor movement", Input: "\x1b[2K\x1b[32m> list", Expect: "\x1b[32m> list"},
+		{Name: "Carriage return", Input: "\x1b[31mLoading 10%\r\x1b[32mLoading 20%\x1b[0m", Expect: "\x1b[32mLoading 20%\x1b[0m"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expect, StripTerminalSequencesKeepColors(test.Input))
+		})
+	}
+}
@@ -3,22 +3,53 @@ package lib
 import (
 	"dgbridge/src/ext"
 	"encoding/json"
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
 type (
 	Rules struct {
-		DiscordToSubprocess []Rule `validate:"required"`
-		SubprocessToDiscord []Rule `validate:"required"`
+		DiscordToSubprocess []Rule   `validate:"required"`
+		SubprocessToDiscord []Rule   `validate:"required"`
+		Sets                RuleSets `validate:"dive,dive"`
 	}
 	Rule struct {
-		Match    ext.Regexp `validate:"required"`
-		Template string     `validate:"required"`
+		Match       ext.Regexp     `validate:"required"`
+		Template    string         `validate:"required"`
+		Stream      Stream         `validate:"omitempty,oneof=stdout stderr pty"`
+		Destination string         // Where the output goes instead of the default, e.g. a Discord channel ID
+		Continue    bool           // Keep applying the next rules after this one matched
+		Then        string         // Name of the rule set that the output is passed to, instead of being output
+		Engine      TemplateEngine `validate:"omitempty,oneof=regexp go"` // How Template is expanded, defaults to regexp
+
+		template *template.Template // Template parsed by LoadRules, for the Go engine
+	}
+	// RuleSets are named lists of rules that rules pass their output to with Then.
+	RuleSets map[string][]Rule
+	// Output is a result of applying rules.
+	Output struct {
+		Text        string
+		Destination string // Where the text goes, empty for the default destination
 	}
 )
 
+// Number of rule sets that an output may pass through, in case they pass
+// their output to each other in a loop.
+const maxRuleDepth = 10
+
+// Stream identifies the output stream of a subprocess that a line comes from.
+type Stream string
+
+const (
+	StreamStdout Stream = "stdout" // The subprocess' stdout
+	StreamStderr Stream = "stderr" // The subprocess' stderr
+	StreamPty    Stream = "pty"    // The subprocess' terminal, which merges stdout and stderr
+)
+
 type (
 	Props struct {
 		Author Author `validate:"required"`
@@ -41,36 +72,274 @@ func LoadRules(path string) (*Rules, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := rules.compileTemplates(); err != nil {
+		return nil, err
+	}
+	if err := rules.checkSets(); err != nil {
+		return nil, err
+	}
 	return &rules, err
 }
 
+// compileTemplates parses the templates of the rules that use the Go engine,
+// so that they are only parsed once.
+func (self *Rules) compileTemplates() error {
+	compile := func(where string, rules []Rule) error {
+		for i := range rules {
+			if err := rules[i].compileTemplate(); err != nil {
+				return fmt.Errorf("rule %d of %v: %v", i, where, err)
+			}
+		}
+		return nil
+	}
+	if err := compile("DiscordToSubprocess", self.DiscordToSubprocess); err != nil {
+		return err
+	}
+	if err := compile("SubprocessToDiscord", self.SubprocessToDiscord); err != nil {
+		return err
+	}
+	for name, set := range self.Sets {
+		if err := compile(fmt.Sprintf("set %q", name), set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSets checks that the rule sets named by Then exist and don't pass
+// their output to each other in a loop.
+func (self *Rules) checkSets() error {
+	// 1 while the set is being checked, 2 once it was checked.
+	state := make(map[string]int)
+	var check func(where string, rules []Rule) error
+	check = func(where string, rules []Rule) error {
+		for i, rule := range rules {
+			if rule.Then == "" {
+				continue
+			}
+			set, ok := self.Sets[rule.Then]
+			if !ok {
+				return fmt.Errorf("rule %d of %v: unknown rule set %q", i, where, rule.Then)
+			}
+			switch state[rule.Then] {
+			case 1:
+				return fmt.Errorf("rule %d of %v: rule set %q passes its output back to itself", i, where, rule.Then)
+			case 2:
+				continue
+			}
+			state[rule.Then] = 1
+			if err := check(fmt.Sprintf("set %q", rule.Then), set); err != nil {
+				return err
+			}
+			state[rule.Then] = 2
+		}
+		return nil
+	}
+	if err := check("DiscordToSubprocess", self.DiscordToSubprocess); err != nil {
+		return err
+	}
+	if err := check("SubprocessToDiscord", self.SubprocessToDiscord); err != nil {
+		return err
+	}
+	for name, set := range self.Sets {
+		if state[name] == 0 {
+			state[name] = 1
+			if err := check(fmt.Sprintf("set %q", name), set); err != nil {
+				return err
+			}
+			state[name] = 2
+		}
+	}
+	return nil
+}
+
+// FilterRules returns the rules that apply to lines from the specified stream.
+// Rules without a Stream apply to every stream.
+func FilterRules(rules []Rule, stream Stream) []Rule {
+	var filtered []Rule
+	for _, rule := range rules {
+		if rule.Stream == "" || rule.Stream == stream {
+			filtered = append(filtered, rule)
+		}
+	}
+	return filtered
+}
+
 // ApplyRules applies rules to a string.
 // If props are provided, a matching template will be built using those props.
-func ApplyRules(rules []Rule, props *Props, input string) string {
+//
+// The first rule that matches with a non-empty result produces an output,
+// unless it passes its output to the rule set named by Then, whose outputs are
+// taken instead. The rules after it are applied too if it has Continue set. A
+// rule whose Go template fails produces no output, which is logged, and the
+// rules after it still only apply if it has Continue set.
+//
+// Returns:
+//
+//	the outputs of the rules in order, or nil if no rules matched.
+func ApplyRules(rules []Rule, sets RuleSets, props *Props, input string) []Output {
+	apply := func(rule Rule, input string) (string, bool) {
+		return applyRule(rule, props, input)
+	}
+	pass := func(result string) string { return result }
+	return applyRules(rules, sets, input, apply, pass, 0)
+}
+
+// applyRules applies rules to an input and follows Continue and Then.
+//
+// Parameters:
+//
+//	apply: applies a rule to an input, returns its result and whether the
+//	rule applies, see applyRule.
+//	pass: turns a result into the input of the rule set it is passed to.
+//	depth: number of rule sets that the input already passed through.
+func applyRules[T any](
+	rules []Rule,
+	sets RuleSets,
+	input T,
+	apply func(rule Rule, input T) (string, bool),
+	pass func(result string) T,
+	depth int,
+) []Output {
+	var outputs []Output
 	for _, rule := range rules {
-		result := ApplyRule(rule, props, input)
-		if result != "" {
-			return result
+		result, applies := apply(rule, input)
+		if !applies {
+			continue
+		}
+		switch {
+		case result == "":
+			// The Go template failed.
+		case rule.Then == "":
+			outputs = append(outputs, Output{Text: result, Destination: rule.Destination})
+		case depth < maxRuleDepth:
+			for _, output := range applyRules(sets[rule.Then], sets, pass(result), apply, pass, depth+1) {
+				if output.Destination == "" {
+					output.Destination = rule.Destination
+				}
+				outputs = append(outputs, output)
+			}
+		}
+		if !rule.Continue {
+			break
 		}
 	}
-	return ""
+	return outputs
 }
 
 // ApplyRule applies a rule to a given input string if it matches.
 //
 // Parameters:
-// props: If passed, the Rule's template is built with the given Props.
+// props: If passed, the Rule's template is built with the given Props, and
+// newlines in the input are replaced with spaces, since the result is written
+// to the subprocess as one line. Otherwise, the input may be a group of
+// output lines joined with newlines.
 func ApplyRule(rule Rule, props *Props, input string) string {
-	// Remove newlines from input and replace them with spaces
-	input = strings.ReplaceAll(input, "\n", " ")
+	result, _ := applyRule(rule, props, input)
+	return result
+}
 
-	if rule.Match.MatchString(input) {
-		if props == nil {
-			return rule.Match.ReplaceAllString(input, rule.Template)
+// applyRule applies a rule to an input like ApplyRule.
+//
+// Returns:
+//
+//	the result, and whether the rule applies: it matched and its result isn't
+//	empty, or its Go template failed, which is logged and leaves the result
+//	empty.
+func applyRule(rule Rule, props *Props, input string) (string, bool) {
+	if props != nil {
+		// Remove newlines from input and replace them with spaces
+		input = strings.ReplaceAll(input, "\n", " ")
+	}
+
+	if !rule.Match.MatchString(input) {
+		return "", false
+	}
+	var result string
+	if rule.Engine == EngineGo {
+		var err error
+		result, err = replaceAllTemplate(rule, props, input, func(start int, end int) string {
+			return input[start:end]
+		})
+		if err != nil {
+			logTemplateError(rule, err)
+			return "", true
+		}
+	} else if props == nil {
+		result = rule.Match.ReplaceAllString(input, rule.Template)
+	} else {
+		result = rule.Match.ReplaceAllString(input, buildTemplate(rule.Template, *props))
+	}
+	return result, result != ""
+}
+
+// ApplyRulesColored is like ApplyRules, for a line of terminal output with
+// colors. The rules are matched against the text without colors, so that
+// escape sequences don't get in the way of the regular expressions, and the
+// text that the templates copy from the line keeps its colors.
+//
+// The captures that Go templates get are plain text, since the helper
+// functions would break the escape sequences.
+//
+// Returns the outputs with the SGR sequences that Discord supports.
+func ApplyRulesColored(rules []Rule, sets RuleSets, text ext.AnsiText) []Output {
+	apply := func(rule Rule, text ext.AnsiText) (string, bool) {
+		if !rule.Match.MatchString(text.Plain) {
+			return "", false
+		}
+		var result string
+		if rule.Engine == EngineGo {
+			var err error
+			result, err = replaceAllTemplate(rule, nil, text.Plain, text.Slice)
+			if err != nil {
+				logTemplateError(rule, err)
+				return "", true
+			}
+		} else {
+			result = replaceAllColored(rule.Match.Regexp, text, rule.Template)
+		}
+		// Normalize the sequences of the copied pieces of text.
+		result = ext.ConvertAnsiColors(result).Colored
+		return result, result != ""
+	}
+	return applyRules(rules, sets, text, apply, ext.ConvertAnsiColors, 0)
+}
+
+// templateReference matches the references to capture groups in a template,
+// e.g. $1, ${1} or $name, and the escaped dollar sign $$.
+var templateReference = regexp.MustCompile(`\$(\$|\{\w+\}|\w+)`)
+
+// replaceAllColored does what re.ReplaceAllString(text.Plain, template) does,
+// but builds the result from the colored text.
+func replaceAllColored(re *regexp.Regexp, text ext.AnsiText, template string) string {
+	var result strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(text.Plain, -1) {
+		result.WriteString(text.Slice(last, match[0]))
+		last = match[1]
+
+		literal := 0
+		for _, reference := range templateReference.FindAllStringSubmatchIndex(template, -1) {
+			result.WriteString(template[literal:reference[0]])
+			literal = reference[1]
+			name := template[reference[2]:reference[3]]
+			if name == "$" {
+				result.WriteString("$")
+				continue
+			}
+			name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+			group, err := strconv.Atoi(name)
+			if err != nil {
+				group = re.SubexpIndex(name)
+			}
+			if group >= 0 && 2*group+1 < len(match) && match[2*group] >= 0 {
+				result.WriteString(text.Slice(match[2*group], match[2*group+1]))
+			}
 		}
-		return rule.Match.ReplaceAllString(input, buildTemplate(rule.Template, *props))
+		result.WriteString(template[literal:])
 	}
-	return ""
+	result.WriteString(text.Slice(last, len(text.Plain)))
+	return result.String()
 }
 
 // Builds a rule template for Discord -> Process communication.
@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"dgbridge/src/ext"
 	"github.com/stretchr/testify/assert"
+	"regexp"
 	"testing"
 )
 
@@ -32,3 +34,221 @@ func TestBuildTemplate(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyRulesColored(t *testing.T) {
+	rule := func(match string, template string) Rule {
+		return Rule{Match: ext.Regexp{Regexp: regexp.MustCompile(match)}, Template: template}
+	}
+	line := "\x1b[33m[12:00 INFO]\x1b[0m: \x1b[1;32mSteve\x1b[0m joined the game"
+	tests := []struct {
+		Name   string
+		Rules  []Rule
+		Sets   RuleSets
+		Expect string
+	}{
+		{
+			Name:   "Pass-through",
+			Rules:  []Rule{rule("^(.*)$", "$1")},
+			Expect: "\x1b[0;33m[12:00 INFO]\x1b[0m: \x1b[0;1;32mSteve\x1b[0m joined the game",
+		},
+		{
+			Name:   "Captures keep their colors",
+			Rules:  []Rule{rule(`^\[\S+ INFO\]: (\w+) joined the game$`, "**$1** joined")},
+			Expect: "**\x1b[0;1;32mSteve\x1b[0m** joined",
+		},
+		{
+			Name:   "Named captures",
+			Rules:  []Rule{rule(`^\[(?P<time>\S+) INFO\]: (?P<player>\w+)`, "${player} at $time $$")},
+			Expect: "\x1b[0;1;32mSteve\x1b[0m at \x1b[0;33m12:00\x1b[0m $ joined the game",
+		},
+		{
+			Name:   "First matching rule",
+			Rules:  []Rule{rule("WARN", "warning"), rule("INFO", "info")},
+			Expect: "\x1b[0;33m[12:00 \x1b[0minfo\x1b[0;33m]\x1b[0m: \x1b[0;1;32mSteve\x1b[0m joined the game",
+		},
+		{
+			Name:  "Passed to a rule set",
+			Rules: []Rule{{Match: rule(`^.*?(\w+) joined.*$`, "").Match, Template: "$1", Then: "players"}},
+			Sets: RuleSets{
+				"players": []Rule{rule("^(.*)$", "**$1** is here")},
+			},
+			Expect: "**\x1b[0;1;32mSteve\x1b[0m** is here",
+		},
+		{
+			Name:   "No match",
+			Rules:  []Rule{rule("WARN", "warning")},
+			Expect: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			text := ext.ConvertAnsiColors(line)
+			outputs := ApplyRulesColored(test.Rules, test.Sets, text)
+			plainOutputs := ApplyRules(test.Rules, test.Sets, nil, text.Plain)
+			if test.Expect == "" {
+				assert.Empty(t, outputs)
+				assert.Empty(t, plainOutputs)
+				return
+			}
+			assert.Equal(t, []Output{{Text: test.Expect}}, outputs)
+			// Without colors, the result is the same as the one of ApplyRules.
+			assert.Equal(t, []Output{{Text: ext.StripTerminalSequences(test.Expect)}}, plainOutputs)
+		})
+	}
+}
+
+func TestApplyRulesMultiline(t *testing.T) {
+	rules := []Rule{
+		{
+			Match:    ext.Regexp{Regexp: regexp.MustCompile(`(?s)^[^\n]*/ERROR\][^\n]*\n([\w.]+): [^\n]*\n\s+at ([^\n]+).*$`)},
+			Template: "Crash: $1 at $2",
+		},
+	}
+	input := "[12:00:00] [Server thread/ERROR]: Encountered an unexpected exception\n" +
+		"java.lang.NullPointerException: oops\n" +
+		"\tat net.minecraft.server.Main.tick(Main.java:42)\n" +
+		"\tat net.minecraft.server.Main.run(Main.java:7)"
+	assert.Equal(t, []Output{{Text: "Crash: java.lang.NullPointerException at net.minecraft.server.Main.tick(Main.java:42)"}},
+		ApplyRules(rules, nil, nil, input))
+
+	// Discord messages are written to the subprocess as one line.
+	rules = []Rule{{Match: ext.Regexp{Regexp: regexp.MustCompile(`^(.*)$`)}, Template: "say $1"}}
+	assert.Equal(t, []Output{{Text: "say one two"}}, ApplyRules(rules, nil, &Props{}, "one\ntwo"))
+}
+
+func TestApplyRulesFlow(t *testing.T) {
+	rule := func(match string, template string) Rule {
+		return Rule{Match: ext.Regexp{Regexp: regexp.MustCompile(match)}, Template: template}
+	}
+	chat := rule(`<(\w+)> (.*)`, "**$1** $2")
+	log := rule(`<(\w+)> (.*)`, "$1 said $2")
+	log.Destination = "123"
+	upper := rule(`^(.*)$`, "$1!")
+	empty := rule(`<(\w+)> (.*)`, "")
+	emptyGo := rule(`<(\w+)> (.*)`, `{{if eq (index .Groups 1) "Alice"}}hi Alice{{end}}`)
+	emptyGo.Engine = EngineGo
+	loop := rule(`^(.*)$`, "$1")
+	loop.Then = "loop"
+	withDestination := func(rule Rule, destination string) Rule {
+		rule.Destination = destination
+		return rule
+	}
+	withContinue := func(rule Rule) Rule {
+		rule.Continue = true
+		return rule
+	}
+	withThen := func(rule Rule, then string) Rule {
+		rule.Then = then
+		return rule
+	}
+	sets := RuleSets{
+		"shout": []Rule{upper},
+		"both":  []Rule{withContinue(upper), withDestination(upper, "456")},
+		"loop":  []Rule{loop},
+		"none":  []Rule{rule("WARN", "warning")},
+	}
+	tests := []struct {
+		Name   string
+		Rules  []Rule
+		Expect []Output
+	}{
+		{
+			Name:   "First match only",
+			Rules:  []Rule{chat, log},
+			Expect: []Output{{Text: "**Bob** hi"}},
+		},
+		{
+			Name:   "Continue",
+			Rules:  []Rule{withContinue(chat), log},
+			Expect: []Output{{Text: "**Bob** hi"}, {Text: "Bob said hi", Destination: "123"}},
+		},
+		{
+			Name:   "Continue past rules that don't match",
+			Rules:  []Rule{withContinue(rule("WARN", "warning")), withContinue(log), rule("nothing", "x"), chat},
+			Expect: []Output{{Text: "Bob said hi", Destination: "123"}, {Text: "**Bob** hi"}},
+		},
+		{
+			Name:   "Empty results fall through",
+			Rules:  []Rule{empty, emptyGo, chat, log},
+			Expect: []Output{{Text: "**Bob** hi"}},
+		},
+		{
+			Name:   "Then",
+			Rules:  []Rule{withThen(log, "shout"), chat},
+			Expect: []Output{{Text: "Bob said hi!", Destination: "123"}},
+		},
+		{
+			Name:  "Then with several outputs",
+			Rules: []Rule{withThen(withContinue(chat), "both"), log},
+			Expect: []Output{
+				{Text: "**Bob** hi!"},
+				{Text: "**Bob** hi!", Destination: "456"},
+				{Text: "Bob said hi", Destination: "123"},
+			},
+		},
+		{
+			Name:   "Then without a match",
+			Rules:  []Rule{withThen(withContinue(chat), "none"), log},
+			Expect: []Output{{Text: "Bob said hi", Destination: "123"}},
+		},
+		{
+			Name:   "Loop",
+			Rules:  []Rule{withThen(chat, "loop")},
+			Expect: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expect, ApplyRules(test.Rules, sets, nil, "<Bob> hi"))
+		})
+	}
+	assert.Equal(t, []Output{{Text: "**Bob** hi"}},
+		ApplyRulesColored([]Rule{empty, emptyGo, chat}, sets, ext.ConvertAnsiColors("<Bob> hi")))
+}
+
+func TestCheckSets(t *testing.T) {
+	rule := func(then string) Rule {
+		return Rule{Match: ext.Regexp{Regexp: regexp.MustCompile(".*")}, Template: "$0", Then: then}
+	}
+	tests := []struct {
+		Name  string
+		Rules Rules
+		Error string
+	}{
+		{
+			Name: "Valid",
+			Rules: Rules{
+				SubprocessToDiscord: []Rule{rule("a"), rule("b")},
+				Sets:                RuleSets{"a": {rule("b")}, "b": {rule("")}},
+			},
+		},
+		{
+			Name:  "Unknown set",
+			Rules: Rules{DiscordToSubprocess: []Rule{rule(""), rule("a")}},
+			Error: `rule 1 of DiscordToSubprocess: unknown rule set "a"`,
+		},
+		{
+			Name: "Loop",
+			Rules: Rules{
+				SubprocessToDiscord: []Rule{rule("a")},
+				Sets:                RuleSets{"a": {rule("b")}, "b": {rule("a")}},
+			},
+			Error: `rule 0 of set "b": rule set "a" passes its output back to itself`,
+		},
+		{
+			Name:  "Loop in an unused set",
+			Rules: Rules{Sets: RuleSets{"a": {rule("a")}}},
+			Error: `rule 0 of set "a": rule set "a" passes its output back to itself`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Rules.checkSets()
+			if test.Error == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package lib
+
+// This file implements the Go template engine of rules, which expands
+// templates with text/template instead of the ${1} references of regexp.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateEngine tells how the Template of a rule is expanded.
+type TemplateEngine string
+
+const (
+	EngineRegexp TemplateEngine = "regexp" // ${1} references to the capture groups, and ^U parameters
+	EngineGo     TemplateEngine = "go"     // Go text/template with the captures, Props and helper functions
+)
+
+// templateFuncs are the helper functions available in Go templates.
+var templateFuncs = template.FuncMap{
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"trunc":    truncate,
+	"default":  defaultValue,
+	"replace":  replace,
+	"markdown": escapeMarkdown,
+	"json":     toJson,
+	"now":      time.Now,
+	"date":     formatTime,
+}
+
+// compileTemplate parses the template of a rule that uses the Go engine.
+func (self *Rule) compileTemplate() error {
+	switch self.Engine {
+	case "", EngineRegexp:
+		return nil
+	case EngineGo:
+	default:
+		return fmt.Errorf("unknown template engine %q (expected %v or %v)", self.Engine, EngineRegexp, EngineGo)
+	}
+	parsed, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(self.Template)
+	if err != nil {
+		return err
+	}
+	self.template = parsed
+	return nil
+}
+
+// parsedTemplate returns the parsed Go template of a rule, parsing it if the
+// rule wasn't loaded with LoadRules.
+func (self *Rule) parsedTemplate() (*template.Template, error) {
+	if self.template != nil {
+		return self.template, nil
+	}
+	if err := self.compileTemplate(); err != nil {
+		return nil, err
+	}
+	return self.template, nil
+}
+
+// replaceAllTemplate does what re.ReplaceAllString(input, template) does, with
+// the Go template of a rule expanded for every match.
+//
+// Parameters:
+//
+//	slice: returns the text between two offsets of input, which is copied
+//	as-is to the result around the matches.
+//
+// Returns:
+//
+//	the result, or an error if the template can't be parsed or executed,
+//	e.g. if it refers to a capture group that doesn't exist.
+func replaceAllTemplate(rule Rule, props *Props, input string, slice func(start int, end int) string) (string, error) {
+	parsed, err := rule.parsedTemplate()
+	if err != nil {
+		return "", err
+	}
+	var result strings.Builder
+	last := 0
+	for _, match := range rule.Match.FindAllStringSubmatchIndex(input, -1) {
+		result.WriteString(slice(last, match[0]))
+		last = match[1]
+		if err := parsed.Execute(&result, templateData(rule.Match.Regexp, props, input, match)); err != nil {
+			return "", err
+		}
+	}
+	result.WriteString(slice(last, len(input)))
+	return result.String(), nil
+}
+
+// logTemplateError logs the error that the Go template of a rule failed with,
+// since the rule then outputs nothing.
+func logTemplateError(rule Rule, err error) {
+	log.Printf("[error] error expanding template %q of rule matching %q: %v\n", rule.Template, rule.Match.String(), err)
+}
+
+// templateData returns the data that a Go template is executed with for a
+// match: the named captures by their name, and
+//
+//	.Groups: all the captures, .Groups 0 being the whole match
+//	.Input: the whole input
+//	.Author: the author of the Discord message, for Discord ➡️ Process rules
+func templateData(re *regexp.Regexp, props *Props, input string, match []int) map[string]any {
+	groups := make([]string, len(match)/2)
+	for i := range groups {
+		if match[2*i] >= 0 {
+			groups[i] = input[match[2*i]:match[2*i+1]]
+		}
+	}
+	data := make(map[string]any)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			data[name] = groups[i]
+		}
+	}
+	var author Author
+	if props != nil {
+		author = props.Author
+	}
+	data["Groups"] = groups
+	data["Input"] = input
+	data["Author"] = author
+	return data
+}
+
+// truncate shortens a string to at most length characters.
+func truncate(length int, s string) string {
+	runes := []rune(s)
+	if length < 0 || len(runes) <= length {
+		return s
+	}
+	return string(runes[:length])
+}
+
+// defaultValue returns value, or fallback if value is empty.
+func defaultValue(fallback any, value any) any {
+	if value == nil || value == "" {
+		return fallback
+	}
+	return value
+}
+
+func replace(old string, new string, s string) string {
+	return strings.ReplaceAll(s, old, new)
+}
+
+// markdownSpecial matches the characters that Discord formats messages with.
+var markdownSpecial = regexp.MustCompile("[\\\\*_~`|>]")
+
+// escapeMarkdown escapes the characters of a string that Discord would
+// otherwise take for formatting.
+func escapeMarkdown(s string) string {
+	return markdownSpecial.ReplaceAllString(s, `\$0`)
+}
+
+// toJson encodes a value as JSON, e.g. a string as a quoted JSON string.
+func toJson(value any) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+// formatTime formats a time with a Go layout, e.g. 15:04.
+func formatTime(layout string, t time.Time) string {
+	return t.Format(layout)
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"dgbridge/src/ext"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestGoTemplate(t *testing.T) {
+	chat := `^\[INFO\] <(?P<player>\w+)>(?: (?P<message>.*))?$`
+	tests := []struct {
+		Name     string
+		Match    string
+		Template string
+		Props    *Props
+		Input    string
+		Expect   string
+	}{
+		{Name: "Named captures", Match: chat, Template: "**{{.player}}** {{.message}}",
+			Input: "[INFO] <Bob> hi", Expect: "**Bob** hi"},
+		{Name: "Numbered captures", Match: chat, Template: `{{index .Groups 1}}: {{index .Groups 2}}`,
+			Input: "[INFO] <Bob> hi", Expect: "Bob: hi"},
+		{Name: "Input", Match: `^.*$`, Template: "{{lower .Input}}",
+			Input: "[INFO] <Bob> hi", Expect: "[info] <bob> hi"},
+		{Name: "Every match", Match: `<(?P<player>\w+)>`, Template: "**{{.player}}**",
+			Input: "[INFO] <Bob> hi <Alice>", Expect: "[INFO] **Bob** hi **Alice**"},
+		{Name: "Upper and lower", Match: chat, Template: "{{upper .player}} {{lower .message}}",
+			Input: "[INFO] <Bob> HI", Expect: "BOB hi"},
+		{Name: "Truncate", Match: chat, Template: "{{trunc 5 .message}}",
+			Input: "[INFO] <Bob> héllo world", Expect: "héllo"},
+		{Name: "Default", Match: chat, Template: `{{.player}} {{default "waves" .message}}`,
+			Input: "[INFO] <Bob>", Expect: "Bob waves"},
+		{Name: "Replace and trim", Match: chat, Template: `{{replace "@" "" .message | trim}}`,
+			Input: "[INFO] <Bob> @alice ", Expect: "alice"},
+		{Name: "Markdown", Match: chat, Template: "**{{markdown .player}}** {{markdown .message}}",
+			Input: "[INFO] <Bob_> *hi* `x` ~y~ | >z", Expect: "**Bob\\_** \\*hi\\* \\`x\\` \\~y\\~ \\| \\>z"},
+		{Name: "JSON", Match: chat, Template: `tellraw @a {"text":{{json .message}}}`,
+			Input: `[INFO] <Bob> say "<hi>"`, Expect: `tellraw @a {"text":"say \"<hi>\""}`},
+		{Name: "Props", Match: `^(.*)$`, Template: "say <{{.Author.Username}}#{{.Author.Discriminator}}> {{index .Groups 1}}",
+			Props: &Props{Author: Author{Username: "Mike", Discriminator: "1234"}},
+			Input: "hello\nworld", Expect: "say <Mike#1234> hello world"},
+		{Name: "Time", Match: `^.*$`, Template: `{{date "2006" now}}`,
+			Input: "x", Expect: time.Now().Format("2006")},
+		{Name: "Unknown field", Match: chat, Template: "{{.nobody}}",
+			Input: "[INFO] <Bob> hi", Expect: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rule := Rule{Match: ext.Regexp{Regexp: regexp.MustCompile(test.Match)}, Template: test.Template, Engine: EngineGo}
+			assert.NoError(t, rule.compileTemplate())
+			assert.Equal(t, test.Expect, ApplyRule(rule, test.Props, test.Input))
+		})
+	}
+}
+
+func TestGoTemplateError(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	rules := []Rule{
+		{Match: ext.Regexp{Regexp: regexp.MustCompile(`<(?P<player>\w+)>`)}, Template: "{{.plaeyr}}", Engine: EngineGo},
+		{Match: ext.Regexp{Regexp: regexp.MustCompile(`.*`)}, Template: "$0"},
+	}
+	// The failed rule matched, so the next rule isn't applied, and the error is logged.
+	assert.Nil(t, ApplyRules(rules, nil, nil, "<Bob> hi"))
+	assert.Contains(t, logs.String(), `[error] error expanding template "{{.plaeyr}}" of rule matching "<(?P<player>\\w+)>"`)
+	assert.Contains(t, logs.String(), `map has no entry for key "plaeyr"`)
+
+	logs.Reset()
+	assert.Nil(t, ApplyRulesColored(rules, nil, ext.ConvertAnsiColors("<Bob> hi")))
+	assert.Contains(t, logs.String(), `map has no entry for key "plaeyr"`)
+
+	// Rules that don't match still let the next rules apply.
+	assert.Equal(t, []Output{{Text: "hi"}}, ApplyRules(rules, nil, nil, "hi"))
+}
+
+func TestGoTemplateColored(t *testing.T) {
+	rule := Rule{
+		Match:    ext.Regexp{Regexp: regexp.MustCompile(`<(?P<player>\w+)>`)},
+		Template: "**{{upper .player}}**",
+		Engine:   EngineGo,
+	}
+	text := ext.ConvertAnsiColors("\x1b[33m[INFO]\x1b[0m <\x1b[32mBob\x1b[0m> hi")
+	// The text around the match keeps its colors, the captures are plain.
+	assert.Equal(t, []Output{{Text: "\x1b[0;33m[INFO]\x1b[0m **BOB** hi"}}, ApplyRulesColored([]Rule{rule}, nil, text))
+}
+
+func TestLoadRulesTemplateErrors(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Rules string
+		Error string
+	}{
+		{
+			Name: "Valid",
+			Rules: `{"DiscordToSubprocess": [], "SubprocessToDiscord": [
+				{"Match": ".*", "Template": "{{.Input}}", "Engine": "go"},
+				{"Match": ".*", "Template": "{{", "Engine": "regexp"}
+			]}`,
+		},
+		{
+			Name: "Syntax error",
+			Rules: `{"DiscordToSubprocess": [], "SubprocessToDiscord": [
+				{"Match": ".*", "Template": "$0"},
+				{"Match": ".*", "Template": "{{.Input", "Engine": "go"}
+			]}`,
+			Error: "rule 1 of SubprocessToDiscord: template: :1: unclosed action",
+		},
+		{
+			Name: "Unknown function",
+			Rules: `{"DiscordToSubprocess": [], "SubprocessToDiscord": [], "Sets": {"chat": [
+				{"Match": ".*", "Template": "{{shout .Input}}", "Engine": "go"}
+			]}}`,
+			Error: `rule 0 of set "chat": template: :1: function "shout" not defined`,
+		},
+		{
+			Name: "Unknown engine",
+			Rules: `{"DiscordToSubprocess": [{"Match": ".*", "Template": "$0", "Engine": "jinja"}],
+				"SubprocessToDiscord": []}`,
+			Error: `rule 0 of DiscordToSubprocess: unknown template engine "jinja" (expected regexp or go)`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			assert.NoError(t, os.WriteFile(path, []byte(test.Rules), 0o644))
+			rules, err := LoadRules(path)
+			if test.Error == "" {
+				assert.NoError(t, err)
+				assert.NotNil(t, rules.SubprocessToDiscord[0].template)
+				return
+			}
+			assert.EqualError(t, err, test.Error)
+		})
+	}
+}
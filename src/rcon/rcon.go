@@ -0,0 +1,198 @@
+// Package rcon implements a client for the Source RCON protocol, which many
+// game servers, e.g. Minecraft, Source games, Rust and ARK, accept commands
+// over.
+//
+// See https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
+package rcon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet types
+const (
+	typeResponseValue = 0
+	typeExecCommand   = 2
+	typeAuthResponse  = 2
+	typeAuth          = 3
+)
+
+// Size of the ID and type fields and of the two null bytes that end a packet.
+const packetHeaderSize = 4 + 4 + 2
+
+// Largest packet accepted from the server. Servers split longer responses
+// into several packets.
+const maxPacketSize = 64 * 1024
+
+// ErrAuthFailed is returned by Dial when the server rejects the password.
+var ErrAuthFailed = errors.New("rcon: authentication failed")
+
+// Client is a connection to an RCON server. It is safe for concurrent use.
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader // Reads from conn
+	timeout time.Duration
+	mutex   sync.Mutex // Guards the connection, so that requests don't interleave
+	nextId  int32
+}
+
+// Dial connects to an RCON server and authenticates with the password.
+//
+// Parameters:
+//
+//	timeout: how long connecting, authenticating and each command may take.
+func Dial(address string, password string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{conn: conn, reader: bufio.NewReader(conn), timeout: timeout, nextId: 1}
+	if err := client.authenticate(password); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes the connection.
+func (self *Client) Close() error {
+	return self.conn.Close()
+}
+
+// Alive reports whether the connection is still open, so that a connection
+// closed by the server, e.g. because it restarted, can be replaced before
+// a command is sent on it.
+func (self *Client) Alive() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	_ = self.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer self.setDeadline()
+	// Peeking leaves the data that the server may have sent in the buffer.
+	_, err := self.reader.Peek(1)
+	var netErr net.Error
+	return err == nil || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Execute runs a command on the server and returns its response.
+//
+// If an error is returned, the connection may be unusable and should be
+// closed. The command may have run even so.
+func (self *Client) Execute(command string) (string, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.setDeadline()
+
+	id := self.newId()
+	if err := self.write(id, typeExecCommand, command); err != nil {
+		return "", err
+	}
+	// Long responses are split into several packets, and there is no way to
+	// tell the last one. Servers answer requests in order though, so an
+	// empty request is sent after the command: the packets that come before
+	// its answer are the command's response.
+	endId := self.newId()
+	if err := self.write(endId, typeResponseValue, ""); err != nil {
+		return "", err
+	}
+	var response bytes.Buffer
+	for {
+		packetId, _, body, err := self.read()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case packetId == id:
+			response.WriteString(body)
+		case packetId == endId:
+			return response.String(), nil
+		case packetId > 0 && packetId < id:
+			// Source servers answer an empty response packet with a second,
+			// malformed packet, which is left over from the previous command.
+			continue
+		default:
+			return "", fmt.Errorf("rcon: unexpected response id %d", packetId)
+		}
+	}
+}
+
+// authenticate sends the password and waits for the server to accept it.
+func (self *Client) authenticate(password string) error {
+	self.setDeadline()
+	id := self.newId()
+	if err := self.write(id, typeAuth, password); err != nil {
+		return err
+	}
+	for {
+		packetId, packetType, _, err := self.read()
+		if err != nil {
+			return err
+		}
+		// Source servers send an empty response before the auth response.
+		if packetType != typeAuthResponse {
+			continue
+		}
+		if packetId == -1 {
+			return ErrAuthFailed
+		}
+		if packetId != id {
+			return fmt.Errorf("rcon: unexpected auth response id %d", packetId)
+		}
+		return nil
+	}
+}
+
+func (self *Client) newId() int32 {
+	id := self.nextId
+	self.nextId++
+	if self.nextId <= 0 {
+		// -1 means that authentication failed.
+		self.nextId = 1
+	}
+	return id
+}
+
+func (self *Client) setDeadline() {
+	if self.timeout > 0 {
+		_ = self.conn.SetDeadline(time.Now().Add(self.timeout))
+	}
+}
+
+// write sends a packet.
+func (self *Client) write(id int32, packetType int32, body string) error {
+	var packet bytes.Buffer
+	_ = binary.Write(&packet, binary.LittleEndian, int32(packetHeaderSize+len(body)))
+	_ = binary.Write(&packet, binary.LittleEndian, id)
+	_ = binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+	_, err := self.conn.Write(packet.Bytes())
+	return err
+}
+
+// read receives a packet.
+func (self *Client) read() (id int32, packetType int32, body string, err error) {
+	var size int32
+	if err = binary.Read(self.reader, binary.LittleEndian, &size); err != nil {
+		return 0, 0, "", err
+	}
+	if size < packetHeaderSize || size > maxPacketSize {
+		return 0, 0, "", fmt.Errorf("rcon: invalid packet size %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err = io.ReadFull(self.reader, packet); err != nil {
+		return 0, 0, "", err
+	}
+	id = int32(binary.LittleEndian.Uint32(packet[0:4]))
+	packetType = int32(binary.LittleEndian.Uint32(packet[4:8]))
+	// The body ends with one or two null bytes.
+	body = string(bytes.TrimRight(packet[8:], "\x00"))
+	return id, packetType, body, nil
+}
@@ -0,0 +1,135 @@
+package rcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "secret"
+
+// testServer is a stand-in RCON server. It behaves like a Source server:
+// it sends an empty response before the auth response, splits long responses
+// into several packets, and answers empty response packets twice.
+type testServer struct {
+	listener net.Listener
+	commands chan string // Commands received by the server
+}
+
+func startTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &testServer{listener: listener, commands: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return server
+}
+
+func (self *testServer) address() string {
+	return self.listener.Addr().String()
+}
+
+func (self *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size, id, packetType int32
+		if binary.Read(conn, binary.LittleEndian, &size) != nil {
+			return
+		}
+		_ = binary.Read(conn, binary.LittleEndian, &id)
+		_ = binary.Read(conn, binary.LittleEndian, &packetType)
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		command := string(bytes.TrimRight(body, "\x00"))
+
+		switch packetType {
+		case typeAuth:
+			writeTestPacket(conn, id, typeResponseValue, "")
+			if command != testPassword {
+				id = -1
+			}
+			writeTestPacket(conn, id, typeAuthResponse, "")
+		case typeExecCommand:
+			self.commands <- command
+			switch {
+			case command == "disconnect":
+				return
+			case command == "long":
+				writeTestPacket(conn, id, typeResponseValue, strings.Repeat("a", 4096))
+				writeTestPacket(conn, id, typeResponseValue, "b")
+			case strings.HasPrefix(command, "echo "):
+				writeTestPacket(conn, id, typeResponseValue, strings.TrimPrefix(command, "echo "))
+			default:
+				writeTestPacket(conn, id, typeResponseValue, "")
+			}
+		case typeResponseValue:
+			writeTestPacket(conn, id, typeResponseValue, "")
+			writeTestPacket(conn, id, typeResponseValue, "\x01\x00\x00\x00")
+		}
+	}
+}
+
+func writeTestPacket(conn net.Conn, id int32, packetType int32, body string) {
+	_ = binary.Write(conn, binary.LittleEndian, int32(packetHeaderSize+len(body)))
+	_ = binary.Write(conn, binary.LittleEndian, id)
+	_ = binary.Write(conn, binary.LittleEndian, packetType)
+	_, _ = conn.Write(append([]byte(body), 0, 0))
+}
+
+func TestExecute(t *testing.T) {
+	server := startTestServer(t)
+	client, err := Dial(server.address(), testPassword, time.Second)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	tests := []struct {
+		Command string
+		Expect  string
+	}{
+		{Command: "echo hello", Expect: "hello"},
+		{Command: "say hi", Expect: ""},
+		{Command: "long", Expect: strings.Repeat("a", 4096) + "b"},
+		{Command: "echo after long", Expect: "after long"},
+	}
+	for _, test := range tests {
+		response, err := client.Execute(test.Command)
+		assert.NoError(t, err, test.Command)
+		assert.Equal(t, test.Expect, response, test.Command)
+		assert.Equal(t, test.Command, <-server.commands)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	server := startTestServer(t)
+	_, err := Dial(server.address(), "wrong", time.Second)
+	assert.ErrorIs(t, err, ErrAuthFailed)
+}
+
+func TestConnectionLost(t *testing.T) {
+	server := startTestServer(t)
+	client, err := Dial(server.address(), testPassword, time.Second)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.True(t, client.Alive())
+	_, err = client.Execute("disconnect")
+	assert.Error(t, err)
+	assert.False(t, client.Alive())
+}
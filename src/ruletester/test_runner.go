@@ -67,14 +67,19 @@ func printBanner(bannerTitle string, amountTests int) {
 }
 
 func (t SubprocessToDiscordTest) Run(_ *TestRunner, number int, rules *lib.Rules) bool {
-	result := lib.ApplyRules(rules.SubprocessToDiscord, nil, t.Input)
-	if result != t.Expect {
+	stream := t.Stream
+	if stream == "" {
+		stream = lib.StreamStdout
+	}
+	result := lib.ApplyRules(lib.FilterRules(rules.SubprocessToDiscord, stream), rules.Sets, nil, t.Input)
+	expect := expectedOutputs(t.Expect, t.Outputs)
+	if !equalOutputs(result, expect) {
 		fmt.Printf(
 			"❌  SubprocessToDiscordTest Test #%v: FAIL:\n"+
 				"\tInput:\t\t%v\n"+
 				"\tExpected:\t%v\n"+
 				"\tGot:\t\t%v\n",
-			number, t.Input, t.Expect, result,
+			number, t.Input, formatOutputs(expect), formatOutputs(result),
 		)
 		return false
 	}
@@ -89,14 +94,15 @@ func (t DiscordToSubprocessTest) Run(testRunner *TestRunner, number int, rules *
 		return false
 	}
 
-	result := lib.ApplyRules(rules.DiscordToSubprocess, &userProps, t.Input)
-	if result != t.Expect {
+	result := lib.ApplyRules(rules.DiscordToSubprocess, rules.Sets, &userProps, t.Input)
+	expect := expectedOutputs(t.Expect, t.Outputs)
+	if !equalOutputs(result, expect) {
 		fmt.Printf(
 			"❌  d2s Test #%v: FAIL:\n"+
 				"\tInput:\t\t%v\n"+
 				"\tExpected:\t%v\n"+
 				"\tGot:\t\t%v\n",
-			number, t.Input, t.Expect, result,
+			number, t.Input, formatOutputs(expect), formatOutputs(result),
 		)
 		return false
 	}
@@ -104,6 +110,47 @@ func (t DiscordToSubprocessTest) Run(testRunner *TestRunner, number int, rules *
 	return true
 }
 
+// expectedOutputs returns the outputs that a test expects: Outputs if it is
+// set, or else a single output with the text of Expect, or none if Expect is
+// empty.
+func expectedOutputs(expect string, outputs []lib.Output) []lib.Output {
+	if outputs != nil {
+		return outputs
+	}
+	if expect == "" {
+		return nil
+	}
+	return []lib.Output{{Text: expect}}
+}
+
+func equalOutputs(a []lib.Output, b []lib.Output) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatOutputs formats outputs for a test report. A single output to the
+// default destination is shown as its text alone.
+func formatOutputs(outputs []lib.Output) string {
+	if len(outputs) == 1 && outputs[0].Destination == "" {
+		return outputs[0].Text
+	}
+	var result strings.Builder
+	for _, output := range outputs {
+		result.WriteString("\n\t\t\t" + output.Text)
+		if output.Destination != "" {
+			result.WriteString(" ➡️ " + output.Destination)
+		}
+	}
+	return result.String()
+}
+
 func (r *TestResults) Add(other TestResults) {
 	r.Passed += other.Passed
 	r.Failed += other.Failed
@@ -14,10 +14,13 @@ type (
 	DiscordToSubprocessTest struct {
 		Input     string `validate:"required"`
 		Expect    string
-		UserProps string `validate:"required"`
+		Outputs   []lib.Output // Every expected output, instead of Expect
+		UserProps string       `validate:"required"`
 	}
 	SubprocessToDiscordTest struct {
-		Input  string `validate:"required"`
-		Expect string
+		Input   string `validate:"required"`
+		Expect  string
+		Outputs []lib.Output // Every expected output, instead of Expect
+		Stream  lib.Stream   `validate:"omitempty,oneof=stdout stderr pty"` // Defaults to stdout
 	}
 )